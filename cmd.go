@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/common"
+	"github.com/jumpserver-dev/sdk-go/model"
+	"github.com/jumpserver-dev/sdk-go/service"
+
+	"lion/pkg/config"
+	"lion/pkg/encrypt"
+	"lion/pkg/logger"
+	"lion/pkg/tunnel"
+)
+
+/*
+	离线工具的子命令:
+		lion [-f config.yml] inspect [-json] <session dir>
+		lion [-f config.yml] merge [-o out.guac] <session dir>
+		lion [-f config.yml] validate <session dir | part file>...
+		lion [-f config.yml] verify-replay [-pubkey key.pem] <dir>
+		lion [-f config.yml] pubkey
+		lion [-f config.yml] upload [-force] <session id | session dir>
+		lion [-f config.yml] export [-format png|gif] [-fps 2] [-width 0] [-height 0] [-o out] <session dir>
+*/
+
+func runCommand(args []string) int {
+	switch args[0] {
+	case "inspect":
+		return inspectCommand(args[1:])
+	case "merge":
+		return mergeCommand(args[1:])
+	case "validate":
+		return validateCommand(args[1:])
+	case "verify-replay", "verify":
+		return verifyReplayCommand(args[1:])
+	case "pubkey":
+		return pubKeyCommand(args[1:])
+	case "upload":
+		return uploadCommand(args[1:])
+	case "export":
+		return exportCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, "Commands: inspect, merge, validate, verify-replay, pubkey, upload, export")
+		return 2
+	}
+}
+
+// setupOfflineConfig 离线命令读取本地配置，录像的加密密钥无法解密时命令失败
+func setupOfflineConfig() bool {
+	config.Setup(configPath)
+	if err := setupOfflineEncryption(); err != nil {
+		fmt.Fprintf(os.Stderr, "setup artifact encryption failed: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// setupOfflineEncryption ARTIFACT_ENCRYPT_KEY 需要 core 解密时使用本地的 access key 连接 core，
+// 与 lion 服务共用 resolveArtifactEncryptKey，不会使用密文作为密钥
+func setupOfflineEncryption() error {
+	cfg := config.GlobalConfig
+	if cfg.SecretEncryptKey != "" && cfg.ArtifactEncryptKey != "" {
+		jmsService, err := offlineJMService()
+		if err != nil {
+			return fmt.Errorf("connect core to decrypt ARTIFACT_ENCRYPT_KEY: %w", err)
+		}
+		if err = resolveArtifactEncryptKey(jmsService); err != nil {
+			return err
+		}
+	}
+	return encrypt.SetKey(cfg.ArtifactEncryptKey)
+}
+
+var offlineService *service.JMService
+
+// offlineJMService 使用 lion 已经注册的 access key，离线命令不注册新的终端
+func offlineJMService() (*service.JMService, error) {
+	if offlineService != nil {
+		return offlineService, nil
+	}
+	var key model.AccessKey
+	if err := key.LoadFromFile(config.GlobalConfig.AccessKeyFilePath); err != nil {
+		return nil, fmt.Errorf("load access key %s: %w", config.GlobalConfig.AccessKeyFilePath, err)
+	}
+	jmsService, err := service.NewAuthJMService(service.JMSCoreHost(
+		config.GlobalConfig.CoreHost), service.JMSTimeOut(30*time.Second),
+		service.JMSAccessKey(key.ID, key.Secret),
+	)
+	if err != nil {
+		return nil, err
+	}
+	offlineService = jmsService
+	return jmsService, nil
+}
+
+func verifyReplayCommand(args []string) int {
+	fs := flag.NewFlagSet("verify-replay", flag.ExitOnError)
+	pubKeyPath := fs.String("pubkey", "", "ed25519 public key of the lion node (PEM or base64)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lion verify-replay [-pubkey key.pem] <dir with replay.json and part files>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if !setupOfflineConfig() {
+		return 1
+	}
+	dir := fs.Arg(0)
+	meta, err := tunnel.LoadReplayMeta(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load replay meta failed: %s\n", err)
+		return 1
+	}
+	var pubKey []byte
+	if *pubKeyPath != "" {
+		if pubKey, err = tunnel.LoadPublicKey(*pubKeyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "load public key failed: %s\n", err)
+			return 1
+		}
+	} else {
+		fmt.Println("WARNING: no public key given, the embedded key of the manifest is not trusted")
+	}
+	result := tunnel.VerifyReplayManifest(meta, dir, pubKey)
+	fmt.Printf("Session: %s\n", result.SessionId)
+	for _, part := range result.Parts {
+		status := "OK"
+		if part.Error != "" {
+			status = "FAILED: " + part.Error
+		}
+		fmt.Printf("  %s %s %s\n", part.Name, part.Hash, status)
+	}
+	for _, errMsg := range result.Errors {
+		fmt.Printf("  ERROR: %s\n", errMsg)
+	}
+	switch result.Status() {
+	case tunnel.ManifestFailed:
+		fmt.Println("Result: FAILED")
+		return 1
+	case tunnel.ManifestUnverified:
+		fmt.Println("Result: UNVERIFIED, the manifest is consistent but the signer is unknown;")
+		fmt.Println("  verify with -pubkey using the output of `lion pubkey` on the lion node")
+		return 1
+	}
+	fmt.Println("Result: OK")
+	return 0
+}
+
+// pubKeyCommand 输出节点签名录像清单的公钥，用于 verify-replay -pubkey
+func pubKeyCommand(args []string) int {
+	fs := flag.NewFlagSet("pubkey", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lion pubkey")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	config.Setup(configPath)
+	key, err := tunnel.LoadSignKey(config.GlobalConfig.ReplaySignKeyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load replay sign key failed: %s\n", err)
+		return 1
+	}
+	buf, err := tunnel.EncodePublicKey(key.Public().(ed25519.PublicKey))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "encode public key failed: %s\n", err)
+		return 1
+	}
+	fmt.Print(string(buf))
+	return 0
+}
+
+func inspectCommand(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "output as json")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lion inspect [-json] <session dir>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if !setupOfflineConfig() {
+		return 1
+	}
+	result, err := tunnel.InspectSession(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inspect session failed: %s\n", err)
+		return 1
+	}
+	if *jsonOutput {
+		buf, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(buf))
+		return 0
+	}
+	fmt.Printf("Session: %s (session meta: %t)\n", result.SessionId, result.HasMeta)
+	for _, part := range result.Parts {
+		status := ""
+		if part.Uploaded {
+			status = "uploaded"
+		}
+		if part.Error != "" {
+			status = "ERROR: " + part.Error
+		}
+		fmt.Printf("  %s size=%d duration=%s start=%s %s\n", part.Name, part.Size,
+			formatMillis(part.Duration), formatTimestamp(part.StartTime), status)
+		if part.Gap != nil {
+			fmt.Printf("    recovered after gap of %s\n", formatMillis(part.Gap.Duration()))
+		}
+	}
+	fmt.Printf("Total: %d parts, size=%d, duration=%s\n", len(result.Parts),
+		result.Size, formatMillis(result.Duration))
+	for _, gap := range result.Gaps {
+		fmt.Printf("Gap: %s - %s (%s) %s\n", formatTimestamp(gap.Start), formatTimestamp(gap.End),
+			formatMillis(gap.Duration()), gap.Reason)
+	}
+	if len(result.Markers) > 0 {
+		fmt.Printf("Markers: %d\n", len(result.Markers))
+	}
+	return 0
+}
+
+func formatMillis(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).String()
+}
+
+func formatTimestamp(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.UnixMilli(ms).Format(time.RFC3339)
+}
+
+func mergeCommand(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := fs.String("o", "", "output file, default {session id}.guac")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lion merge [-o out.guac] <session dir>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if !setupOfflineConfig() {
+		return 1
+	}
+	dir := fs.Arg(0)
+	files, err := tunnel.SessionPartFiles(dir)
+	if err != nil || len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "no part files found in %s: %v\n", dir, err)
+		return 1
+	}
+	outPath := *output
+	if outPath == "" {
+		outPath = filepath.Base(filepath.Clean(dir)) + ".guac"
+	}
+	fd, err := os.Create(outPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create %s failed: %s\n", outPath, err)
+		return 1
+	}
+	size, err := tunnel.MergeParts(files, fd)
+	if err1 := fd.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "merge failed: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Merged %d parts into %s (%d bytes)\n", len(files), outPath, size)
+	return 0
+}
+
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lion validate <session dir | part file>...")
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if !setupOfflineConfig() {
+		return 1
+	}
+	var files []string
+	for _, arg := range fs.Args() {
+		if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+			parts, _ := tunnel.SessionPartFiles(arg)
+			files = append(files, parts...)
+			continue
+		}
+		files = append(files, arg)
+	}
+	code := 0
+	for _, file := range files {
+		result := tunnel.ValidatePartFile(file)
+		if result.Error != "" {
+			code = 1
+			fmt.Printf("%s FAILED: %s at offset %d (%d valid instructions)\n",
+				result.Name, result.Error, result.Offset, result.Instructions)
+			continue
+		}
+		fmt.Printf("%s OK: %d instructions, %d bytes\n", result.Name, result.Instructions, result.Size)
+	}
+	return code
+}
+
+// uploadCommand 重新上传会话的录像，-force 忽略会话过程中已经上传的 part。
+// 只处理已经结束(元数据记录了结束时间)且没有被 lion 进程持有(会话目录的锁)的会话
+func uploadCommand(args []string) int {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	force := fs.Bool("force", false, "recompress and upload all parts, ignore uploaded state")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lion upload [-force] <session id | session dir>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if !setupOfflineConfig() {
+		return 1
+	}
+	logger.SetupLogger(config.GlobalConfig)
+	rootPath := fs.Arg(0)
+	if fi, err := os.Stat(rootPath); err != nil || !fi.IsDir() {
+		rootPath = filepath.Join(config.GlobalConfig.SessionFolderPath, fs.Arg(0))
+	}
+	sessionId := filepath.Base(filepath.Clean(rootPath))
+	if !common.IsUUID(sessionId) || !common.Have(rootPath) {
+		fmt.Fprintf(os.Stderr, "invalid session dir: %s\n", rootPath)
+		return 1
+	}
+	ended, err := tunnel.SessionDirEnded(rootPath, sessionId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load session %s meta failed: %s\n", sessionId, err)
+		return 1
+	}
+	if !ended {
+		fmt.Fprintf(os.Stderr, "session %s has not ended, replays of unfinished sessions are uploaded by lion on startup\n", sessionId)
+		return 1
+	}
+	if err = tunnel.LockSessionDir(rootPath, sessionId); err != nil {
+		fmt.Fprintf(os.Stderr, "session %s is in use: %s\n", sessionId, err)
+		return 1
+	}
+	defer tunnel.UnlockSessionDir(rootPath, sessionId)
+	if *force {
+		_ = os.Remove(filepath.Join(rootPath, sessionId+tunnel.UploadStateSuffix))
+		_ = os.RemoveAll(filepath.Join(rootPath, "upload"))
+	}
+	jmsService, err := offlineJMService()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect core failed: %s\n", err)
+		return 1
+	}
+	terminalConf, err := jmsService.GetTerminalConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "get terminal config failed: %s\n", err)
+		return 1
+	}
+	uploader := tunnel.PartUploader{
+		RootPath:  rootPath,
+		SessionId: sessionId,
+		ApiClient: jmsService,
+		TermCfg:   &terminalConf,
+	}
+	uploader.Start()
+	// 上传成功后会删除会话目录
+	if common.Have(rootPath) {
+		fmt.Printf("Upload session %s failed, see logs for details\n", sessionId)
+		return 1
+	}
+	fmt.Printf("Upload session %s success\n", sessionId)
+	return 0
+}
+
+// exportCommand 将录像渲染为 png 序列或 gif 动图
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var opts tunnel.ExportOptions
+	fs.StringVar(&opts.Format, "format", tunnel.ExportFormatPNG, "png (frame sequence) or gif")
+	fs.IntVar(&opts.FPS, "fps", 2, "frames per second")
+	fs.IntVar(&opts.Width, "width", 0, "max width of frames, 0 keeps the original size (gif default 1024)")
+	fs.IntVar(&opts.Height, "height", 0, "max height of frames, 0 keeps the original size")
+	fs.IntVar(&opts.MaxFrames, "max-frames", 0, "max number of frames, lower the fps if exceeded (png default 7200, gif default 600)")
+	output := fs.String("o", "", "output dir for png, output file for gif, default {session id}.frames or {session id}.gif")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lion export [-format png|gif] [-fps 2] [-width 0] [-height 0] [-o out] <session dir>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if !setupOfflineConfig() {
+		return 1
+	}
+	dir := fs.Arg(0)
+	files, err := tunnel.SessionPartFiles(dir)
+	if err != nil || len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "no part files found in %s: %v\n", dir, err)
+		return 1
+	}
+	outPath := *output
+	if outPath == "" {
+		outPath = filepath.Base(filepath.Clean(dir)) + ".frames"
+		if opts.Format == tunnel.ExportFormatGIF {
+			outPath = filepath.Base(filepath.Clean(dir)) + ".gif"
+		}
+	}
+	lastPercent := -1
+	result, err := tunnel.ExportReplayToDir(context.Background(), files, opts, outPath,
+		func(progress tunnel.ExportProgress) {
+			if percent := progress.Percent(); percent != lastPercent {
+				lastPercent = percent
+				fmt.Printf("\rExporting %3d%% %s/%s, %d frames", percent,
+					formatMillis(progress.Position), formatMillis(progress.Duration), progress.Frames)
+			}
+		})
+	fmt.Println()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Exported %d frames of %s into %s\n", result.Frames, formatMillis(result.Duration), outPath)
+	return 0
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/gorilla/websocket"
 
 	"lion/pkg/config"
+	"lion/pkg/encrypt"
 	"lion/pkg/logger"
 	"lion/pkg/middleware"
 	"lion/pkg/proxy"
@@ -58,6 +59,9 @@ func main() {
 		fmt.Printf("Go Version:          %s\n", Goversion)
 		return
 	}
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
 	config.Setup(configPath)
 	logger.SetupLogger(config.GlobalConfig)
 	jmsService := MustJMService()
@@ -308,6 +312,14 @@ func registerRouter(jmsService *service.JMService, tunnelService *tunnel.Guacamo
 		tokenTunnels := tokenGroup.Group("/tunnels")
 		tokenTunnels.GET("/:tid/streams/:index/:filename", tunnelService.DownloadFile)
 		tokenTunnels.POST("/:tid/streams/:index/:filename", tunnelService.UploadFile)
+		tokenGroup.Any("/tunnel/", tunnelService.HttpTunnel)
+	}
+
+	// 不支持 websocket 的网络使用 http tunnel
+	{
+		httpTunnelGroup := lionGroup.Group("/tunnel")
+		httpTunnelGroup.Use(middleware.JmsCookieAuth(jmsService))
+		httpTunnelGroup.Any("/", tunnelService.HttpTunnel)
 	}
 
 	// ws的设置
@@ -321,6 +333,12 @@ func registerRouter(jmsService *service.JMService, tunnelService *tunnel.Guacamo
 		wsGroup.Group("/share").Use(
 			middleware.JmsCookieAuth(jmsService)).GET("/", tunnelService.Share)
 
+		wsGroup.Group("/wall").Use(
+			middleware.JmsCookieAuth(jmsService)).GET("/", tunnelService.SessionWall)
+
+		wsGroup.Group("/replay").Use(
+			middleware.JmsCookieAuth(jmsService)).GET("/", tunnelService.Replay)
+
 		wsGroup.Group("/token").Use(
 			middleware.SessionAuth(jmsService)).GET("/", tunnelService.Connect)
 
@@ -334,6 +352,21 @@ func registerRouter(jmsService *service.JMService, tunnelService *tunnel.Guacamo
 		apiGroup.POST("/share/", tunnelService.CreateShare)
 		apiGroup.POST("/share/remove/", tunnelService.DeleteShare)
 		apiGroup.POST("/share/:id/", tunnelService.GetShare)
+		apiGroup.GET("/sessions/:sid/screenshot/", tunnelService.Screenshot)
+		apiGroup.POST("/sessions/:sid/takeover/", tunnelService.TakeoverSession)
+		apiGroup.DELETE("/sessions/:sid/takeover/", tunnelService.ReleaseSession)
+		apiGroup.GET("/sessions/:sid/replay/thumbnail/", tunnelService.ReplayThumbnail)
+		apiGroup.POST("/sessions/:sid/replay/exports/", tunnelService.CreateReplayExport)
+		apiGroup.GET("/replay/exports/:id/", tunnelService.GetReplayExport)
+		apiGroup.GET("/replay/exports/:id/download/", tunnelService.DownloadReplayExport)
+		apiGroup.DELETE("/replay/exports/:id/", tunnelService.DeleteReplayExport)
+	}
+
+	// 监控、分享用户的发送队列状态
+	debugRouter := eng.Group("/debug")
+	{
+		debugRouter.Use(middleware.HTTPMiddleDebugAuth())
+		debugRouter.GET("/viewers/", tunnelService.ViewerStats)
 	}
 
 	pprofRouter := eng.Group("/debug/pprof")
@@ -357,6 +390,7 @@ func registerRouter(jmsService *service.JMService, tunnelService *tunnel.Guacamo
 
 func bootstrap(jmsService *service.JMService) {
 	updateEncryptConfigValue(jmsService)
+	setupArtifactEncryption()
 	replayDir := config.GlobalConfig.RecordPath
 	ftpFilePath := config.GlobalConfig.FTPFilePath
 	sessionDir := config.GlobalConfig.SessionFolderPath
@@ -364,6 +398,7 @@ func bootstrap(jmsService *service.JMService) {
 	go uploadRemainReplay(jmsService, allRemainFiles)
 	go uploadRemainFTPFile(jmsService, ftpFilePath)
 	go uploadRemainSessionPartReplay(jmsService, sessionDir)
+	go tunnel.CleanExportFolder()
 }
 
 func updateEncryptConfigValue(jmsService *service.JMService) {
@@ -371,17 +406,52 @@ func updateEncryptConfigValue(jmsService *service.JMService) {
 	encryptKey := cfg.SecretEncryptKey
 	if encryptKey != "" {
 		redisPassword := cfg.RedisPassword
-		ret, err := jmsService.GetEncryptedConfigValue(encryptKey, redisPassword)
-		if err != nil {
-			logger.Error("Get encrypted config value failed: " + err.Error())
-			return
-		}
-		if ret.Value != "" {
-			cfg.UpdateRedisPassword(ret.Value)
-		} else {
-			logger.Error("Get encrypted config value failed: empty value")
+		if value := getEncryptedConfigValue(jmsService, encryptKey, redisPassword); value != "" {
+			cfg.UpdateRedisPassword(value)
 		}
 	}
+	if err := resolveArtifactEncryptKey(jmsService); err != nil {
+		logger.Fatalf("%s, refuse to record with undecrypted key", err)
+	}
+}
+
+// resolveArtifactEncryptKey 配置了 SECRET_ENCRYPT_KEY 时 ARTIFACT_ENCRYPT_KEY 为密文，需要 core 解密，
+// 解密失败不能使用密文作为密钥，否则录像无法解密。lion 服务和离线命令共用
+func resolveArtifactEncryptKey(jmsService *service.JMService) error {
+	cfg := config.GlobalConfig
+	if cfg.SecretEncryptKey == "" || cfg.ArtifactEncryptKey == "" {
+		return nil
+	}
+	value := getEncryptedConfigValue(jmsService, cfg.SecretEncryptKey, cfg.ArtifactEncryptKey)
+	if value == "" {
+		return errors.New("decrypt ARTIFACT_ENCRYPT_KEY failed")
+	}
+	cfg.UpdateArtifactEncryptKey(value)
+	return nil
+}
+
+func getEncryptedConfigValue(jmsService *service.JMService, encryptKey, value string) string {
+	ret, err := jmsService.GetEncryptedConfigValue(encryptKey, value)
+	if err != nil {
+		logger.Error("Get encrypted config value failed: " + err.Error())
+		return ""
+	}
+	if ret.Value == "" {
+		logger.Error("Get encrypted config value failed: empty value")
+	}
+	return ret.Value
+}
+
+func setupArtifactEncryption() {
+	if err := encrypt.SetKey(config.GlobalConfig.ArtifactEncryptKey); err != nil {
+		logger.Fatalf("Setup artifact encryption failed: %s", err)
+	}
+	if err := encrypt.SetupTempDir(config.GlobalConfig.PlainTempPath); err != nil {
+		logger.Fatalf("Setup artifact plain temp dir failed: %s", err)
+	}
+	if encrypt.Enabled() {
+		logger.Info("Artifact encryption enabled")
+	}
 }
 func uploadRemainFTPFile(jmsService *service.JMService, fileStoreDir string) {
 	err := config.EnsureDirExist(fileStoreDir)
@@ -398,6 +468,11 @@ func uploadRemainFTPFile(jmsService *service.JMService, fileStoreDir string) {
 		if err != nil || info.IsDir() {
 			return nil
 		}
+		// 旧版本遗留的明文文件
+		if encrypt.IsPlainTemp(info.Name()) {
+			_ = os.Remove(path)
+			return nil
+		}
 		var fid string
 		filename := info.Name()
 		if len(filename) == 36 {
@@ -420,7 +495,10 @@ func uploadRemainFTPFile(jmsService *service.JMService, fileStoreDir string) {
 		dateTarget, _ := filepath.Rel(fileStoreDir, path)
 		target := strings.Join([]string{proxy.FTPTargetPrefix, dateTarget}, "/")
 		logger.Infof("Upload FTP file: %s, type: %s", path, ftpFileStorage.TypeName())
-		if err = ftpFileStorage.Upload(path, target); err != nil {
+		err = encrypt.WithDecryptedFile(path, func(plainPath string) error {
+			return ftpFileStorage.Upload(plainPath, target)
+		})
+		if err != nil {
 			logger.Errorf("Upload remain FTP file %s failed: %s", path, err)
 			continue
 		}
@@ -500,6 +578,10 @@ func scanRemainReplay(jmsService *service.JMService, replayDir string) map[strin
 		if err != nil || info.IsDir() {
 			return nil
 		}
+		if encrypt.IsPlainTemp(info.Name()) {
+			_ = os.Remove(path)
+			return nil
+		}
 		sidFilename := info.Name()
 		var sid string
 		sidFilename = strings.TrimSuffix(sidFilename, session.ReplayFileNameSuffix)
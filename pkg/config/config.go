@@ -25,6 +25,9 @@ type Config struct {
 	AccessKeyFilePath string
 	CertsFolderPath   string
 	SessionFolderPath string
+	ExportFolderPath  string
+	// 加密文件上传时的明文临时目录，启动时清空
+	PlainTempPath string
 
 	Name           string `mapstructure:"NAME"`
 	CoreHost       string `mapstructure:"CORE_HOST"`
@@ -59,16 +62,55 @@ type Config struct {
 	PandaHost         string `mapstructure:"PANDA_HOST"`
 	EnablePanda       bool   `mapstructure:"ENABLE_PANDA"`
 
-	ReplayMaxSize    int    `mapstructure:"REPLAY_MAX_SIZE"`
-	SecretEncryptKey string `mapstructure:"SECRET_ENCRYPT_KEY"`
+	ReplayMaxSize     int    `mapstructure:"REPLAY_MAX_SIZE"`
+	ReplayMaxDuration int    `mapstructure:"REPLAY_MAX_DURATION"`
+	SecretEncryptKey  string `mapstructure:"SECRET_ENCRYPT_KEY"`
 
 	VncClipboardEncoding string `mapstructure:"VNC_CLIPBOARD_ENCODING"`
+
+	ReattachGraceTime int `mapstructure:"REATTACH_GRACE_TIME"`
+
+	WsBatchMaxBytes     int  `mapstructure:"WS_BATCH_MAX_BYTES"`
+	WsBatchMaxDelay     int  `mapstructure:"WS_BATCH_MAX_DELAY"`
+	EnableWsCompression bool `mapstructure:"ENABLE_WS_COMPRESSION"`
+
+	ViewerQueueMaxSize   int    `mapstructure:"VIEWER_QUEUE_MAX_SIZE"`
+	ViewerSlowPolicy     string `mapstructure:"VIEWER_SLOW_POLICY"`
+	ViewerDegradeQuality int    `mapstructure:"VIEWER_DEGRADE_QUALITY"`
+
+	EnableSessionWall   bool `mapstructure:"ENABLE_SESSION_WALL"`
+	SessionWallInterval int  `mapstructure:"SESSION_WALL_INTERVAL"`
+
+	ArtifactEncryptKey string `mapstructure:"ARTIFACT_ENCRYPT_KEY"`
+
+	ReplaySignKeyPath string `mapstructure:"REPLAY_SIGN_KEY_PATH"`
+
+	ReplayRequired          bool   `mapstructure:"REPLAY_REQUIRED"`
+	ReplayRequiredPlatforms string `mapstructure:"REPLAY_REQUIRED_PLATFORMS"`
+	ReplayRecoverTimeout    int    `mapstructure:"REPLAY_RECOVER_TIMEOUT"`
+
+	ReplayKeyframeInterval int `mapstructure:"REPLAY_KEYFRAME_INTERVAL"`
+
+	ReplayRecordInput bool `mapstructure:"REPLAY_RECORD_INPUT"`
+	ReplayInputMask   bool `mapstructure:"REPLAY_INPUT_MASK"`
+
+	RewindMaxDuration int `mapstructure:"REWIND_MAX_DURATION"`
+	RewindMaxSize     int `mapstructure:"REWIND_MAX_SIZE"`
+
+	ChatReplayMarker bool `mapstructure:"CHAT_REPLAY_MARKER"`
+
+	ShareApproval        bool `mapstructure:"SHARE_APPROVAL"`
+	ShareApprovalTimeout int  `mapstructure:"SHARE_APPROVAL_TIMEOUT"`
 }
 
 func (c *Config) UpdateRedisPassword(val string) {
 	c.RedisPassword = val
 }
 
+func (c *Config) UpdateArtifactEncryptKey(val string) {
+	c.ArtifactEncryptKey = val
+}
+
 func (c *Config) SelectGuacdAddr() string {
 	if len(c.GuacdAddrs) == 0 {
 		return net.JoinHostPort(c.GuaHost, c.GuaPort)
@@ -77,6 +119,22 @@ func (c *Config) SelectGuacdAddr() string {
 	return addresses[rand.Intn(len(addresses))]
 }
 
+// IsReplayRequired 全局开启强制录像，或者资产的平台在 REPLAY_REQUIRED_PLATFORMS 中
+func (c *Config) IsReplayRequired(platform string) bool {
+	if c.ReplayRequired {
+		return true
+	}
+	if c.ReplayRequiredPlatforms == "" || platform == "" {
+		return false
+	}
+	for _, name := range strings.Split(c.ReplayRequiredPlatforms, ",") {
+		if strings.EqualFold(strings.TrimSpace(name), platform) {
+			return true
+		}
+	}
+	return false
+}
+
 func Setup(configPath string) {
 	var conf = getDefaultConfig()
 	loadConfigFromEnv(&conf)
@@ -94,13 +152,16 @@ func getDefaultConfig() Config {
 	recordFolderPath := filepath.Join(dataFolderPath, "replays")
 	sessionsPath := filepath.Join(dataFolderPath, "sessions")
 	ftpFileFolderPath := filepath.Join(dataFolderPath, "ftp_files")
+	exportFolderPath := filepath.Join(dataFolderPath, "exports")
+	plainTempPath := filepath.Join(dataFolderPath, "plain_tmp")
 	LogDirPath := filepath.Join(dataFolderPath, "logs")
 	keyFolderPath := filepath.Join(dataFolderPath, "keys")
 	CertsFolderPath := filepath.Join(dataFolderPath, "certs")
 	accessKeyFilePath := filepath.Join(keyFolderPath, ".access_key")
+	replaySignKeyPath := filepath.Join(keyFolderPath, "replay_sign.key")
 
 	folders := []string{dataFolderPath, driveFolderPath, recordFolderPath,
-		keyFolderPath, LogDirPath, CertsFolderPath, sessionsPath}
+		keyFolderPath, LogDirPath, CertsFolderPath, sessionsPath, exportFolderPath}
 	for i := range folders {
 		if err := EnsureDirExist(folders[i]); err != nil {
 			log.Fatalf("Create folder failed: %s", err.Error())
@@ -115,7 +176,10 @@ func getDefaultConfig() Config {
 		DrivePath:                 driveFolderPath,
 		CertsFolderPath:           CertsFolderPath,
 		AccessKeyFilePath:         accessKeyFilePath,
+		ReplaySignKeyPath:         replaySignKeyPath,
 		SessionFolderPath:         sessionsPath,
+		ExportFolderPath:          exportFolderPath,
+		PlainTempPath:             plainTempPath,
 		CoreHost:                  "http://localhost:8080",
 		BootstrapToken:            "",
 		BindHost:                  "0.0.0.0",
@@ -130,7 +194,19 @@ func getDefaultConfig() Config {
 		CleanDriveScheduleTime:    1,
 		PandaHost:                 "http://panda:9001",
 		ReplayMaxSize:             defaultMaxSize,
+		ReplayMaxDuration:         defaultReplayMaxDuration,
 		VideoWorkerHost:           "http://video:9000",
+		ReattachGraceTime:         defaultReattachGraceTime,
+		WsBatchMaxBytes:           defaultWsBatchMaxBytes,
+		WsBatchMaxDelay:           defaultWsBatchMaxDelay,
+		ViewerQueueMaxSize:        defaultViewerQueueMaxSize,
+		ViewerSlowPolicy:          "drop",
+		ViewerDegradeQuality:      defaultViewerDegradeQuality,
+		SessionWallInterval:       defaultSessionWallInterval,
+		ReplayRecoverTimeout:      defaultReplayRecoverTimeout,
+		ReplayKeyframeInterval:    defaultReplayKeyframeInterval,
+		RewindMaxSize:             defaultRewindMaxSize,
+		ShareApprovalTimeout:      defaultShareApprovalTimeout,
 	}
 
 }
@@ -138,6 +214,39 @@ func getDefaultConfig() Config {
 // 300MB
 const defaultMaxSize = 1024 * 1024 * 300
 
+// 30 分钟
+const defaultReplayMaxDuration = 30
+
+// 强制录像模式下，录像中断后等待恢复的时间(秒)
+const defaultReplayRecoverTimeout = 10
+
+// 录像回放 seek 使用的关键帧间隔(秒)
+const defaultReplayKeyframeInterval = 120
+
+// 监控回看缓冲区的最大字节数 32MB
+const defaultRewindMaxSize = 32 * 1024 * 1024
+
+// 分享用户等待主用户同意加入的时间(秒)
+const defaultShareApprovalTimeout = 60
+
+// websocket 断开后，保留会话等待重连的时间(秒)
+const defaultReattachGraceTime = 60
+
+// 合并发送给浏览器的 instruction，单个 websocket frame 的最大字节数和最长等待时间(毫秒)
+const (
+	defaultWsBatchMaxBytes = 64 * 1024
+	defaultWsBatchMaxDelay = 10
+)
+
+// 监控、分享用户的发送队列上限 16MB，降低画质时使用的 jpeg 质量
+const (
+	defaultViewerQueueMaxSize   = 1024 * 1024 * 16
+	defaultViewerDegradeQuality = 60
+)
+
+// 会话墙缩略图的刷新间隔(秒)
+const defaultSessionWallInterval = 5
+
 func EnsureDirExist(path string) error {
 	if !haveDir(path) {
 		if err := os.MkdirAll(path, os.ModePerm); err != nil {
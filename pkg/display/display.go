@@ -0,0 +1,379 @@
+package display
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"lion/pkg/guacd"
+)
+
+/*
+	无界面的 Guacamole display，根据 guacd 的绘制指令维护图层，用于生成会话截图。
+	只支持 guacd 常用的指令：size、img/blob/end、png、jpeg、copy、transfer、
+	rect/cfill/lfill、move、shade、dispose；路径和变换类指令会被忽略。
+	未结束的图片流按数量和缓存的字节数限制，超过时丢弃最早的图片流，
+	避免 guacd 没有结束的流(或异常的录像)持续占用内存。
+*/
+
+const (
+	maxImageStreams = 64
+	maxStreamBytes  = 32 << 20
+)
+
+func New() *Display {
+	d := Display{
+		layers:         make(map[int]*Layer),
+		streams:        make(map[string]*imageStream),
+		maxStreams:     maxImageStreams,
+		maxStreamBytes: maxStreamBytes,
+	}
+	d.getLayer(0)
+	return &d
+}
+
+type Display struct {
+	lock    sync.Mutex
+	layers  map[int]*Layer
+	streams map[string]*imageStream
+
+	// 未结束的图片流缓存的字节数，streamSeq 用于找到最早的图片流
+	streamBytes    int
+	streamSeq      uint64
+	maxStreams     int
+	maxStreamBytes int
+
+	// 每处理一个绘制指令加一，用于判断画面是否变化
+	version uint64
+}
+
+type imageStream struct {
+	seq      uint64
+	layer    int
+	mask     int
+	mimetype string
+	x, y     int
+	data     bytes.Buffer
+}
+
+func (d *Display) getLayer(index int) *Layer {
+	layer, ok := d.layers[index]
+	if !ok {
+		layer = newLayer(index)
+		d.layers[index] = layer
+	}
+	return layer
+}
+
+func (d *Display) removeStream(index string) {
+	if stream, ok := d.streams[index]; ok {
+		d.streamBytes -= stream.data.Len()
+		delete(d.streams, index)
+	}
+}
+
+func (d *Display) removeOldestStream() {
+	oldest := ""
+	var seq uint64
+	for index, stream := range d.streams {
+		if oldest == "" || stream.seq < seq {
+			oldest, seq = index, stream.seq
+		}
+	}
+	d.removeStream(oldest)
+}
+
+// Size 默认图层的大小即为画面的大小
+func (d *Display) Size() (width, height int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	layer := d.getLayer(0)
+	return layer.Width(), layer.Height()
+}
+
+func (d *Display) Version() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.version
+}
+
+// Process 处理一个指令，不支持的指令直接忽略
+func (d *Display) Process(ins *guacd.Instruction) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	args := ins.Args
+	switch ins.Opcode {
+	case guacd.InstructionDrawingSize:
+		// size,layer,width,height
+		if len(args) < 3 {
+			return
+		}
+		d.getLayer(atoi(args[0])).Resize(atoi(args[1]), atoi(args[2]))
+	case guacd.InstructionStreamingImg:
+		// img,stream,mask,layer,mimetype,x,y
+		if len(args) < 6 {
+			return
+		}
+		d.removeStream(args[0])
+		if len(d.streams) >= d.maxStreams {
+			d.removeOldestStream()
+		}
+		d.streamSeq++
+		d.streams[args[0]] = &imageStream{
+			seq:      d.streamSeq,
+			mask:     atoi(args[1]),
+			layer:    atoi(args[2]),
+			mimetype: args[3],
+			x:        atoi(args[4]),
+			y:        atoi(args[5]),
+		}
+	case guacd.InstructionStreamingBlob:
+		if len(args) < 2 {
+			return
+		}
+		if stream, ok := d.streams[args[0]]; ok {
+			if data, err := base64.StdEncoding.DecodeString(args[1]); err == nil {
+				for d.streamBytes+len(data) > d.maxStreamBytes && d.streams[args[0]] == stream {
+					d.removeOldestStream()
+				}
+				if d.streams[args[0]] != stream {
+					return
+				}
+				stream.data.Write(data)
+				d.streamBytes += len(data)
+			}
+		}
+	case guacd.InstructionStreamingEnd:
+		if len(args) < 1 {
+			return
+		}
+		if stream, ok := d.streams[args[0]]; ok {
+			d.removeStream(args[0])
+			d.drawEncodedImage(stream.layer, stream.x, stream.y, stream.mask,
+				stream.mimetype, &stream.data)
+		}
+	case guacd.InstructionDrawingPng, guacd.InstructionDrawingJpeg:
+		// png,mask,layer,x,y,data
+		if len(args) < 5 {
+			return
+		}
+		data, err := base64.StdEncoding.DecodeString(args[4])
+		if err != nil {
+			return
+		}
+		mimetype := "image/" + ins.Opcode
+		d.drawEncodedImage(atoi(args[1]), atoi(args[2]), atoi(args[3]), atoi(args[0]),
+			mimetype, bytes.NewReader(data))
+	case guacd.InstructionDrawingCopy, guacd.InstructionDrawingTransfer:
+		// copy,srclayer,srcx,srcy,width,height,mask,dstlayer,dstx,dsty
+		// transfer 的第六个参数为 function，按照 SRC 处理
+		if len(args) < 9 {
+			return
+		}
+		mask := atoi(args[5])
+		if ins.Opcode == guacd.InstructionDrawingTransfer {
+			mask = ChannelMaskSrc
+		}
+		d.copy(atoi(args[0]), atoi(args[1]), atoi(args[2]), atoi(args[3]), atoi(args[4]),
+			mask, atoi(args[6]), atoi(args[7]), atoi(args[8]))
+	case guacd.InstructionDrawingRect:
+		// rect,layer,x,y,width,height
+		if len(args) < 5 {
+			return
+		}
+		x, y := atoi(args[1]), atoi(args[2])
+		d.getLayer(atoi(args[0])).AddRect(image.Rect(x, y, x+atoi(args[3]), y+atoi(args[4])))
+	case guacd.InstructionDrawingCfill:
+		// cfill,mask,layer,r,g,b,a
+		if len(args) < 6 {
+			return
+		}
+		c := color.NRGBA{R: uint8(atoi(args[2])), G: uint8(atoi(args[3])),
+			B: uint8(atoi(args[4])), A: uint8(atoi(args[5]))}
+		d.getLayer(atoi(args[1])).FillColor(c, atoi(args[0]))
+	case guacd.InstructionDrawingLfill:
+		// lfill,mask,layer,srclayer
+		if len(args) < 3 {
+			return
+		}
+		d.getLayer(atoi(args[1])).FillLayer(d.getLayer(atoi(args[2])), atoi(args[0]))
+	case guacd.InstructionDrawingCstroke, guacd.InstructionDrawingLstroke:
+		if len(args) < 2 {
+			return
+		}
+		d.getLayer(atoi(args[1])).ClearPath()
+	case guacd.InstructionDrawingMove:
+		// move,layer,parent,x,y,z
+		if len(args) < 5 {
+			return
+		}
+		layer := d.getLayer(atoi(args[0]))
+		layer.parent = atoi(args[1])
+		layer.x, layer.y, layer.z = atoi(args[2]), atoi(args[3]), atoi(args[4])
+	case guacd.InstructionDrawingShade:
+		// shade,layer,opacity
+		if len(args) < 2 {
+			return
+		}
+		d.getLayer(atoi(args[0])).opacity = uint8(atoi(args[1]))
+	case guacd.InstructionDrawingDispose:
+		if len(args) < 1 {
+			return
+		}
+		if index := atoi(args[0]); index != 0 {
+			delete(d.layers, index)
+		}
+	default:
+		return
+	}
+	d.version++
+}
+
+func (d *Display) drawEncodedImage(index, x, y, mask int, mimetype string, r io.Reader) {
+	var (
+		img image.Image
+		err error
+	)
+	switch mimetype {
+	case "image/png":
+		img, err = png.Decode(r)
+	case "image/jpeg":
+		img, err = jpeg.Decode(r)
+	default:
+		// webp 等格式标准库无法解码
+		return
+	}
+	if err != nil {
+		return
+	}
+	d.getLayer(index).DrawImage(x, y, img, mask)
+}
+
+func (d *Display) copy(srcIndex, sx, sy, width, height, mask, dstIndex, dx, dy int) {
+	src := d.getLayer(srcIndex)
+	dst := d.getLayer(dstIndex)
+	srcRect := image.Rect(sx, sy, sx+width, sy+height).Intersect(src.img.Rect)
+	if srcRect.Empty() {
+		return
+	}
+	dx += srcRect.Min.X - sx
+	dy += srcRect.Min.Y - sy
+	var srcImg image.Image = src.img
+	sp := srcRect.Min
+	// 同一个图层内复制，区域可能重叠，需要先拷贝一份
+	if src == dst {
+		tmp := image.NewRGBA(image.Rect(0, 0, srcRect.Dx(), srcRect.Dy()))
+		draw.Draw(tmp, tmp.Rect, src.img, srcRect.Min, draw.Src)
+		srcImg = tmp
+		sp = image.Point{}
+	}
+	dstRect := image.Rect(dx, dy, dx+srcRect.Dx(), dy+srcRect.Dy())
+	dst.Draw(dstRect, srcImg, sp, mask)
+}
+
+// Snapshot 合成所有可见图层，返回当前画面
+func (d *Display) Snapshot() *image.RGBA {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	root := d.getLayer(0)
+	ret := image.NewRGBA(root.img.Rect)
+	draw.Draw(ret, ret.Rect, root.img, image.Point{}, draw.Src)
+	d.drawChildren(ret, 0, 0, 0, map[int]bool{0: true})
+	return ret
+}
+
+func (d *Display) drawChildren(dst *image.RGBA, parent, offsetX, offsetY int, visited map[int]bool) {
+	children := make([]*Layer, 0)
+	for index, layer := range d.layers {
+		if index > 0 && layer.parent == parent && !visited[index] {
+			children = append(children, layer)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].z == children[j].z {
+			return children[i].index < children[j].index
+		}
+		return children[i].z < children[j].z
+	})
+	for _, layer := range children {
+		visited[layer.index] = true
+		x, y := offsetX+layer.x, offsetY+layer.y
+		r := image.Rect(x, y, x+layer.Width(), y+layer.Height())
+		mask := image.NewUniform(color.Alpha{A: layer.opacity})
+		draw.DrawMask(dst, r, layer.img, image.Point{}, mask, image.Point{}, draw.Over)
+		d.drawChildren(dst, layer.index, x, y, visited)
+	}
+}
+
+// Thumbnail 等比缩小画面，宽高不超过 maxWidth 和 maxHeight
+func (d *Display) Thumbnail(maxWidth, maxHeight int) *image.RGBA {
+	return Scale(d.Snapshot(), maxWidth, maxHeight)
+}
+
+func (d *Display) EncodePNG(w io.Writer) error {
+	return png.Encode(w, d.Snapshot())
+}
+
+// Scale 使用区域平均的方式等比缩小图片，不会放大
+func Scale(src *image.RGBA, maxWidth, maxHeight int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if sw == 0 || sh == 0 || maxWidth <= 0 || maxHeight <= 0 ||
+		(sw <= maxWidth && sh <= maxHeight) {
+		return src
+	}
+	ratio := float64(maxWidth) / float64(sw)
+	if r := float64(maxHeight) / float64(sh); r < ratio {
+		ratio = r
+	}
+	dw, dh := int(float64(sw)*ratio), int(float64(sh)*ratio)
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(src.Rect.Min.X+x0, src.Rect.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[offset])
+					g += uint32(src.Pix[offset+1])
+					b += uint32(src.Pix[offset+2])
+					a += uint32(src.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+func atoi(s string) int {
+	v, _ := strconv.Atoi(s)
+	return v
+}
@@ -0,0 +1,154 @@
+package display
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"lion/pkg/guacd"
+)
+
+func encodeTestPng(t *testing.T, width, height int, c color.Color) string {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func process(d *Display, opcode string, args ...string) {
+	ins := guacd.NewInstruction(opcode, args...)
+	d.Process(&ins)
+}
+
+func assertColor(t *testing.T, img *image.RGBA, x, y int, want color.RGBA) {
+	got := img.RGBAAt(x, y)
+	if got != want {
+		t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+	}
+}
+
+func TestDisplayProcess(t *testing.T) {
+	red := color.RGBA{R: 0xFF, A: 0xFF}
+	blue := color.RGBA{B: 0xFF, A: 0xFF}
+	green := color.RGBA{G: 0xFF, A: 0xFF}
+
+	d := New()
+	process(d, "size", "0", "100", "80")
+	process(d, "rect", "0", "0", "0", "100", "80")
+	process(d, "cfill", "14", "0", "255", "0", "0", "255")
+
+	data := encodeTestPng(t, 10, 10, blue)
+	process(d, "img", "1", "14", "0", "image/png", "20", "20")
+	process(d, "blob", "1", data)
+	process(d, "end", "1")
+
+	// 离屏缓冲区自动扩大，再复制到默认图层
+	process(d, "rect", "-1", "0", "0", "5", "5")
+	process(d, "cfill", "12", "-1", "0", "255", "0", "255")
+	process(d, "copy", "-1", "0", "0", "5", "5", "12", "0", "50", "50")
+
+	// 可见图层按照位置合成
+	process(d, "size", "1", "4", "4")
+	process(d, "rect", "1", "0", "0", "4", "4")
+	process(d, "cfill", "12", "1", "0", "0", "255", "255")
+	process(d, "move", "1", "0", "70", "10", "1")
+
+	width, height := d.Size()
+	if width != 100 || height != 80 {
+		t.Fatalf("display size %dx%d", width, height)
+	}
+	img := d.Snapshot()
+	assertColor(t, img, 0, 0, red)
+	assertColor(t, img, 25, 25, blue)
+	assertColor(t, img, 52, 52, green)
+	assertColor(t, img, 71, 11, blue)
+	assertColor(t, img, 75, 11, red)
+
+	process(d, "shade", "1", "0")
+	assertColor(t, d.Snapshot(), 71, 11, red)
+
+	process(d, "dispose", "1")
+	process(d, "copy", "0", "20", "20", "10", "10", "12", "0", "0", "0")
+	img = d.Snapshot()
+	assertColor(t, img, 5, 5, blue)
+
+	thumb := d.Thumbnail(50, 50)
+	if thumb.Rect.Dx() != 50 || thumb.Rect.Dy() != 40 {
+		t.Fatalf("thumbnail size %v", thumb.Rect)
+	}
+	var buf bytes.Buffer
+	if err := d.EncodePNG(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDisplayKeyframe(t *testing.T) {
+	red := color.RGBA{R: 0xFF, A: 0xFF}
+	green := color.RGBA{G: 0xFF, A: 0xFF}
+
+	d := New()
+	process(d, "size", "0", "64", "48")
+	process(d, "rect", "0", "0", "0", "64", "48")
+	process(d, "cfill", "14", "0", "255", "0", "0", "255")
+	process(d, "rect", "-1", "0", "0", "8", "8")
+	process(d, "cfill", "12", "-1", "0", "255", "0", "255")
+	process(d, "size", "1", "4", "4")
+	process(d, "move", "1", "0", "10", "10", "1")
+	process(d, "rect", "1", "0", "0", "4", "4")
+	process(d, "cfill", "12", "1", "0", "255", "0", "255")
+
+	// 克隆后继续修改原画面，不影响克隆的画面
+	clone := d.Clone()
+	process(d, "dispose", "1")
+
+	restored := New()
+	for _, ins := range clone.Keyframe(100) {
+		if ins.Opcode == "blob" && len(ins.Args[1]) > 100 {
+			t.Fatalf("blob size %d exceeds limit", len(ins.Args[1]))
+		}
+		restored.Process(&ins)
+	}
+	img := restored.Snapshot()
+	assertColor(t, img, 0, 0, red)
+	assertColor(t, img, 11, 11, green)
+	// 离屏缓冲区也需要重建，后续的 copy 才能正确绘制
+	process(restored, "copy", "-1", "0", "0", "2", "2", "12", "0", "30", "30")
+	assertColor(t, restored.Snapshot(), 31, 31, green)
+}
+
+func TestDisplayStreamLimit(t *testing.T) {
+	d := New()
+	d.maxStreams = 2
+	d.maxStreamBytes = 16
+	blob := base64.StdEncoding.EncodeToString([]byte("12345678"))
+	process(d, "img", "1", "14", "0", "image/png", "0", "0")
+	process(d, "img", "2", "14", "0", "image/png", "0", "0")
+	process(d, "blob", "1", blob)
+	// 超过数量时丢弃最早的图片流
+	process(d, "img", "3", "14", "0", "image/png", "0", "0")
+	if _, ok := d.streams["1"]; ok || len(d.streams) != 2 || d.streamBytes != 0 {
+		t.Fatalf("streams %d, bytes %d after count limit", len(d.streams), d.streamBytes)
+	}
+	process(d, "blob", "2", blob)
+	process(d, "blob", "3", blob)
+	// 超过字节数时丢弃最早的图片流
+	process(d, "blob", "3", blob)
+	if _, ok := d.streams["2"]; ok || d.streamBytes != 16 {
+		t.Fatalf("streams %d, bytes %d after bytes limit", len(d.streams), d.streamBytes)
+	}
+	// 单个图片流超过上限时丢弃
+	process(d, "blob", "3", blob)
+	if len(d.streams) != 0 || d.streamBytes != 0 {
+		t.Fatalf("streams %d, bytes %d after oversize stream", len(d.streams), d.streamBytes)
+	}
+}
@@ -0,0 +1,82 @@
+package display
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"sort"
+	"strconv"
+
+	"lion/pkg/guacd"
+)
+
+// Clone 复制所有图层，未结束的图片流不会复制
+func (d *Display) Clone() *Display {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	ret := Display{
+		layers:  make(map[int]*Layer, len(d.layers)),
+		streams: make(map[string]*imageStream),
+		version: d.version,
+
+		maxStreams:     d.maxStreams,
+		maxStreamBytes: d.maxStreamBytes,
+	}
+	for index, layer := range d.layers {
+		clone := *layer
+		clone.img = image.NewRGBA(layer.img.Rect)
+		copy(clone.img.Pix, layer.img.Pix)
+		clone.path = append([]image.Rectangle(nil), layer.path...)
+		ret.layers[index] = &clone
+	}
+	return &ret
+}
+
+// Keyframe 生成在 Guacamole 客户端上重建当前画面的指令，包括离屏缓冲区:
+// size 设置图层大小，move 和 shade 设置可见图层的位置和透明度，图片以 img 流发送，
+// 每个 blob 的 base64 数据不超过 blobSize (按 4 字节对齐，保证每个 blob 可以单独解码)
+func (d *Display) Keyframe(blobSize int) []guacd.Instruction {
+	blobSize -= blobSize % 4
+	if blobSize <= 0 {
+		blobSize = 4096
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	indexes := make([]int, 0, len(d.layers))
+	for index := range d.layers {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	ret := make([]guacd.Instruction, 0, len(indexes)*4)
+	for i, index := range indexes {
+		layer := d.layers[index]
+		layerIndex := strconv.Itoa(index)
+		ret = append(ret, guacd.NewInstruction(guacd.InstructionDrawingSize, layerIndex,
+			strconv.Itoa(layer.Width()), strconv.Itoa(layer.Height())))
+		if index > 0 {
+			ret = append(ret,
+				guacd.NewInstruction(guacd.InstructionDrawingMove, layerIndex, strconv.Itoa(layer.parent),
+					strconv.Itoa(layer.x), strconv.Itoa(layer.y), strconv.Itoa(layer.z)),
+				guacd.NewInstruction(guacd.InstructionDrawingShade, layerIndex, strconv.Itoa(int(layer.opacity))))
+		}
+		if layer.Width() == 0 || layer.Height() == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, layer.img); err != nil {
+			continue
+		}
+		stream := strconv.Itoa(i)
+		ret = append(ret, guacd.NewInstruction(guacd.InstructionStreamingImg, stream,
+			strconv.Itoa(ChannelMaskSrc), layerIndex, "image/png", "0", "0"))
+		data := base64.StdEncoding.EncodeToString(buf.Bytes())
+		for len(data) > 0 {
+			n := min(blobSize, len(data))
+			ret = append(ret, guacd.NewInstruction(guacd.InstructionStreamingBlob, stream, data[:n]))
+			data = data[n:]
+		}
+		ret = append(ret, guacd.NewInstruction(guacd.InstructionStreamingEnd, stream))
+	}
+	return ret
+}
@@ -0,0 +1,123 @@
+package display
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Guacamole 图层合成方式，只区分 SRC 和 OVER，其他方式按照 OVER 处理
+const (
+	ChannelMaskSrc  = 0xC
+	ChannelMaskOver = 0xE
+)
+
+func newLayer(index int) *Layer {
+	return &Layer{
+		index:   index,
+		img:     image.NewRGBA(image.Rect(0, 0, 0, 0)),
+		opacity: 0xFF,
+		// 离屏缓冲区绘制超出范围时自动扩大
+		autosize: index < 0,
+	}
+}
+
+type Layer struct {
+	index int
+	img   *image.RGBA
+
+	parent int
+	x, y   int
+	z      int
+
+	opacity  uint8
+	autosize bool
+
+	path []image.Rectangle
+}
+
+func (l *Layer) Width() int {
+	return l.img.Rect.Dx()
+}
+
+func (l *Layer) Height() int {
+	return l.img.Rect.Dy()
+}
+
+func (l *Layer) Resize(width, height int) {
+	if width < 0 {
+		width = 0
+	}
+	if height < 0 {
+		height = 0
+	}
+	if width == l.Width() && height == l.Height() {
+		return
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Rect, l.img, image.Point{}, draw.Src)
+	l.img = img
+}
+
+// fit 离屏缓冲区需要容纳绘制的区域
+func (l *Layer) fit(r image.Rectangle) {
+	if !l.autosize {
+		return
+	}
+	width, height := l.Width(), l.Height()
+	if r.Max.X > width {
+		width = r.Max.X
+	}
+	if r.Max.Y > height {
+		height = r.Max.Y
+	}
+	l.Resize(width, height)
+}
+
+func (l *Layer) Draw(r image.Rectangle, src image.Image, sp image.Point, mask int) {
+	l.fit(r)
+	op := draw.Over
+	if mask == ChannelMaskSrc {
+		op = draw.Src
+	}
+	draw.Draw(l.img, r, src, sp, op)
+}
+
+func (l *Layer) DrawImage(x, y int, src image.Image, mask int) {
+	b := src.Bounds()
+	r := image.Rect(x, y, x+b.Dx(), y+b.Dy())
+	l.Draw(r, src, b.Min, mask)
+}
+
+func (l *Layer) AddRect(r image.Rectangle) {
+	l.path = append(l.path, r)
+}
+
+func (l *Layer) ClearPath() {
+	l.path = l.path[:0]
+}
+
+func (l *Layer) FillColor(c color.Color, mask int) {
+	src := image.NewUniform(c)
+	for _, r := range l.path {
+		l.Draw(r, src, image.Point{}, mask)
+	}
+	l.ClearPath()
+}
+
+func (l *Layer) FillLayer(pattern *Layer, mask int) {
+	pw, ph := pattern.Width(), pattern.Height()
+	if pw == 0 || ph == 0 {
+		l.ClearPath()
+		return
+	}
+	for _, r := range l.path {
+		for y := r.Min.Y; y < r.Max.Y; y += ph {
+			for x := r.Min.X; x < r.Max.X; x += pw {
+				tile := image.Rect(x, y, x+pw, y+ph).Intersect(r)
+				l.Draw(tile, pattern.img, image.Point{}, mask)
+			}
+		}
+	}
+	l.ClearPath()
+}
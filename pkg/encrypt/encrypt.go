@@ -0,0 +1,479 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+	录像、文件传输等落盘文件的加密，使用分块的 AES-256-GCM，方便按照明文的偏移量读取
+
+	密钥:
+		主密钥   配置的 key 经过 PBKDF2-SHA256 派生，只在启动时计算一次
+		文件密钥 每个文件随机生成 32 字节的 salt，使用 HKDF-SHA256(主密钥, salt) 派生，
+		         不同文件的密钥不同，分块序号作为 nonce 不会在同一个密钥下重复
+	文件格式:
+		header: magic(8) + salt(32) + 分块大小(4)
+		chunk:  密文 + tag(16)，最后一个分块标记为 final，防止文件被截断
+	nonce 为分块序号，additional data 为 header + final 标记
+*/
+
+const (
+	magicSize        = 8
+	saltSize         = 32
+	headerSize       = magicSize + saltSize + 4
+	defaultChunkSize = 32 * 1024
+
+	keySize          = 32
+	masterKeyIter    = 600000
+	masterKeySalt    = "jumpserver-lion-artifact-encrypt"
+	fileKeyInfo      = "lion artifact file key"
+	PlainTempSuffix  = ".plain"
+	plainTempDirMode = 0700
+	plainTempMode    = 0600
+)
+
+var magic = []byte("LIONENC\x02")
+
+var (
+	ErrInvalidHeader = errors.New("invalid encrypted file header")
+	ErrNoKey         = errors.New("encrypt key not set")
+	ErrTruncated     = errors.New("encrypted file truncated")
+)
+
+var (
+	keyLock   sync.RWMutex
+	masterKey []byte
+
+	tempLock sync.RWMutex
+	tempDir  string
+)
+
+// SetKey 使用 PBKDF2 将配置的 key 派生为主密钥，key 为空则不加密
+func SetKey(key string) error {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	if key == "" {
+		masterKey = nil
+		return nil
+	}
+	derived, err := pbkdf2.Key(sha256.New, key, []byte(masterKeySalt), masterKeyIter, keySize)
+	if err != nil {
+		return err
+	}
+	masterKey = derived
+	return nil
+}
+
+func Enabled() bool {
+	return currentMasterKey() != nil
+}
+
+func currentMasterKey() []byte {
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+	return masterKey
+}
+
+// fileAEAD 使用 header 中的 salt 派生文件密钥
+func fileAEAD(header []byte) (cipher.AEAD, error) {
+	master := currentMasterKey()
+	if master == nil {
+		return nil, ErrNoKey
+	}
+	salt := header[magicSize : magicSize+saltSize]
+	key, err := hkdf.Key(sha256.New, master, salt, fileKeyInfo, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(index uint64) []byte {
+	ret := make([]byte, 12)
+	binary.BigEndian.PutUint64(ret[4:], index)
+	return ret
+}
+
+func additionalData(header []byte, final bool) []byte {
+	ret := make([]byte, headerSize+1)
+	copy(ret, header)
+	if final {
+		ret[headerSize] = 1
+	}
+	return ret
+}
+
+func NewWriter(w io.Writer) (*Writer, error) {
+	if !Enabled() {
+		return nil, ErrNoKey
+	}
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	if _, err := io.ReadFull(rand.Reader, header[magicSize:magicSize+saltSize]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(header[magicSize+saltSize:], defaultChunkSize)
+	gcm, err := fileAEAD(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:         w,
+		aead:      gcm,
+		header:    header,
+		chunkSize: defaultChunkSize,
+		buf:       make([]byte, 0, defaultChunkSize),
+	}, nil
+}
+
+type Writer struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+	index     uint64
+	buf       []byte
+	closed    bool
+}
+
+func (e *Writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// 缓冲区满且还有数据时才写入，保证最后一个分块在 Close 时写入
+		if len(e.buf) == e.chunkSize {
+			if err := e.writeChunk(false); err != nil {
+				return n, err
+			}
+		}
+		size := e.chunkSize - len(e.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		e.buf = append(e.buf, p[:size]...)
+		p = p[size:]
+		n += size
+	}
+	return n, nil
+}
+
+func (e *Writer) writeChunk(final bool) error {
+	sealed := e.aead.Seal(nil, nonce(e.index), e.buf, additionalData(e.header, final))
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Close 写入最后一个分块，不会关闭底层的 writer
+func (e *Writer) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.writeChunk(true)
+}
+
+func NewReader(r io.ReadSeeker) (*Reader, error) {
+	if !Enabled() {
+		return nil, ErrNoKey
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	if !bytes.Equal(header[:magicSize], magic) {
+		return nil, ErrInvalidHeader
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[magicSize+saltSize:]))
+	if chunkSize <= 0 {
+		return nil, ErrInvalidHeader
+	}
+	gcm, err := fileAEAD(header)
+	if err != nil {
+		return nil, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	reader := Reader{
+		r:         r,
+		aead:      gcm,
+		header:    header,
+		chunkSize: chunkSize,
+		size:      end - headerSize,
+		chunk:     -1,
+	}
+	return &reader, nil
+}
+
+type Reader struct {
+	r         io.ReadSeeker
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+
+	// 密文的大小(不包括 header)
+	size int64
+	// 明文的偏移量
+	offset int64
+
+	chunk int64
+	plain []byte
+	final bool
+}
+
+func (d *Reader) sealedChunkSize() int64 {
+	return int64(d.chunkSize + d.aead.Overhead())
+}
+
+func (d *Reader) chunkCount() int64 {
+	sealed := d.sealedChunkSize()
+	return (d.size + sealed - 1) / sealed
+}
+
+// loadChunk 解密第 index 个分块，最后一个分块没有 final 标记说明文件被截断
+func (d *Reader) loadChunk(index int64) error {
+	if d.chunk == index {
+		return nil
+	}
+	sealedSize := d.sealedChunkSize()
+	start := index * sealedSize
+	if start >= d.size {
+		return io.EOF
+	}
+	length := sealedSize
+	if start+length > d.size {
+		length = d.size - start
+	}
+	buf := make([]byte, length)
+	if _, err := d.r.Seek(headerSize+start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return err
+	}
+	isLast := index == d.chunkCount()-1
+	n := nonce(uint64(index))
+	plain, err := d.aead.Open(nil, n, buf, additionalData(d.header, isLast))
+	final := isLast
+	if err != nil && isLast {
+		plain, err = d.aead.Open(nil, n, buf, additionalData(d.header, false))
+		final = false
+	}
+	if err != nil {
+		if isLast {
+			return ErrTruncated
+		}
+		return err
+	}
+	d.chunk = index
+	d.plain = plain
+	d.final = final
+	return nil
+}
+
+func (d *Reader) Read(p []byte) (int, error) {
+	index := d.offset / int64(d.chunkSize)
+	if err := d.loadChunk(index); err != nil {
+		if err == io.EOF && index > 0 {
+			// 上一个分块如果不是 final，说明文件被截断
+			if err1 := d.loadChunk(index - 1); err1 == nil && !d.final {
+				return 0, ErrTruncated
+			}
+		}
+		return 0, err
+	}
+	pos := int(d.offset - index*int64(d.chunkSize))
+	if pos >= len(d.plain) {
+		if d.final {
+			return 0, io.EOF
+		}
+		if len(d.plain) < d.chunkSize {
+			return 0, ErrTruncated
+		}
+		d.offset = (index + 1) * int64(d.chunkSize)
+		return d.Read(p)
+	}
+	n := copy(p, d.plain[pos:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+// Size 明文的大小
+func (d *Reader) Size() int64 {
+	return d.size - d.chunkCount()*int64(d.aead.Overhead())
+}
+
+func (d *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func IsEncrypted(r io.ReaderAt) bool {
+	header := make([]byte, len(magic))
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return false
+	}
+	return bytes.Equal(header, magic)
+}
+
+type readSeekCloser struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+// OpenFile 打开文件，如果是加密文件返回解密后的 reader
+func OpenFile(path string) (io.ReadSeekCloser, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(fd) {
+		return fd, nil
+	}
+	reader, err := NewReader(fd)
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	if _, err = reader.Seek(0, io.SeekStart); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return readSeekCloser{ReadSeeker: reader, Closer: fd}, nil
+}
+
+type writeCloser struct {
+	*Writer
+	fd *os.File
+}
+
+func (w writeCloser) Close() error {
+	err := w.Writer.Close()
+	if err1 := w.fd.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// CreateFile 创建文件，启用加密时返回加密的 writer
+func CreateFile(path string) (io.WriteCloser, error) {
+	fd, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if !Enabled() {
+		return fd, nil
+	}
+	writer, err := NewWriter(fd)
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return writeCloser{Writer: writer, fd: fd}, nil
+}
+
+// DecryptFile 将文件解密到 dst，未加密的文件直接复制，dst 只有当前用户可以读写
+func DecryptFile(src, dst string) error {
+	reader, err := OpenFile(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	fd, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, plainTempMode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(fd, reader); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// SetupTempDir 设置明文临时文件的目录，删除上次运行遗留的临时文件，目录只有当前用户可以访问
+func SetupTempDir(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, plainTempDirMode); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, plainTempDirMode); err != nil {
+		return err
+	}
+	tempLock.Lock()
+	defer tempLock.Unlock()
+	tempDir = dir
+	return nil
+}
+
+// IsPlainTemp 明文临时文件(目录)，扫描落盘文件时需要跳过
+func IsPlainTemp(name string) bool {
+	return strings.HasSuffix(name, PlainTempSuffix)
+}
+
+// MkdirPlainTemp 在临时目录下创建明文临时目录(0700)，没有设置临时目录时使用系统的临时目录
+func MkdirPlainTemp() (string, error) {
+	tempLock.RLock()
+	dir := tempDir
+	tempLock.RUnlock()
+	return os.MkdirTemp(dir, "*"+PlainTempSuffix)
+}
+
+// WithDecryptedFile 加密文件解密到临时目录后调用 fn，结束后删除临时目录；未加密的文件直接调用。
+// 存储的上传接口只接受文件路径，明文需要落盘，临时文件位于 SetupTempDir 设置的目录，不在录像和文件传输的目录中
+func WithDecryptedFile(path string, fn func(plainPath string) error) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	encrypted := IsEncrypted(fd)
+	_ = fd.Close()
+	if !encrypted {
+		return fn(path)
+	}
+	plainDir, err := MkdirPlainTemp()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(plainDir)
+	plainPath := filepath.Join(plainDir, filepath.Base(path))
+	if err = DecryptFile(path, plainPath); err != nil {
+		return err
+	}
+	return fn(plainPath)
+}
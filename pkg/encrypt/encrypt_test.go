@@ -0,0 +1,135 @@
+package encrypt
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptFile(t *testing.T) {
+	if err := SetKey("test-key"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetKey("")
+
+	plain := bytes.Repeat([]byte("0123456789abcdef"), defaultChunkSize/8+3)
+	path := filepath.Join(t.TempDir(), "test.part")
+	writer, err := CreateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write(plain[:100]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write(plain[100:]); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := os.ReadFile(path)
+	if bytes.Contains(sealed, plain[:16]) {
+		t.Fatal("file is not encrypted")
+	}
+
+	reader, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("decrypt got %d bytes, want %d", len(got), len(plain))
+	}
+	offset := int64(defaultChunkSize + 10)
+	if _, err = reader.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 32)
+	if _, err = io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, plain[offset:offset+32]) {
+		t.Fatal("seek read mismatch")
+	}
+	_ = reader.Close()
+
+	// 截断最后一个分块
+	if err = os.WriteFile(path, sealed[:len(sealed)-100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	got, err = io.ReadAll(reader)
+	if err != ErrTruncated {
+		t.Fatalf("truncated file err: %v", err)
+	}
+	if !bytes.Equal(got, plain[:len(got)]) {
+		t.Fatal("truncated file content mismatch")
+	}
+}
+
+func TestFileKeyAndPlainTemp(t *testing.T) {
+	if err := SetKey("test-key"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetKey("")
+	root := t.TempDir()
+	tempRoot := filepath.Join(root, "plain_tmp")
+	if err := SetupTempDir(tempRoot); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tempDir = "" }()
+
+	plain := []byte("same content")
+	var sealed [][]byte
+	for _, name := range []string{"a", "b"} {
+		path := filepath.Join(root, name)
+		writer, err := CreateFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = writer.Write(plain)
+		if err = writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := os.ReadFile(path)
+		sealed = append(sealed, buf)
+	}
+	// 每个文件的 salt 不同，相同的明文和分块序号得到不同的密文
+	if bytes.Equal(sealed[0][headerSize:], sealed[1][headerSize:]) {
+		t.Fatal("files share the same key")
+	}
+
+	err := WithDecryptedFile(filepath.Join(root, "a"), func(plainPath string) error {
+		if !strings.HasPrefix(plainPath, tempRoot+string(filepath.Separator)) {
+			t.Fatalf("plain file %s not in temp dir", plainPath)
+		}
+		info, err := os.Stat(filepath.Dir(plainPath))
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm() != plainTempDirMode {
+			t.Fatalf("plain temp dir mode %v", info.Mode().Perm())
+		}
+		got, err := os.ReadFile(plainPath)
+		if !bytes.Equal(got, plain) {
+			t.Fatal("plain file content mismatch")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(tempRoot); len(entries) != 0 {
+		t.Fatalf("plain temp not removed: %d entries", len(entries))
+	}
+}
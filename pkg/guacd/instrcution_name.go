@@ -15,6 +15,37 @@ const (
 	InstructionStreamingVideo     = "video"
 )
 
+// Drawing instructions
+const (
+	InstructionDrawingArc       = "arc"
+	InstructionDrawingCfill     = "cfill"
+	InstructionDrawingClip      = "clip"
+	InstructionDrawingClose     = "close"
+	InstructionDrawingCopy      = "copy"
+	InstructionDrawingCstroke   = "cstroke"
+	InstructionDrawingCursor    = "cursor"
+	InstructionDrawingCurve     = "curve"
+	InstructionDrawingDispose   = "dispose"
+	InstructionDrawingDistort   = "distort"
+	InstructionDrawingIdentity  = "identity"
+	InstructionDrawingJpeg      = "jpeg"
+	InstructionDrawingLfill     = "lfill"
+	InstructionDrawingLine      = "line"
+	InstructionDrawingLstroke   = "lstroke"
+	InstructionDrawingMove      = "move"
+	InstructionDrawingPng       = "png"
+	InstructionDrawingPop       = "pop"
+	InstructionDrawingPush      = "push"
+	InstructionDrawingRect      = "rect"
+	InstructionDrawingReset     = "reset"
+	InstructionDrawingSet       = "set"
+	InstructionDrawingShade     = "shade"
+	InstructionDrawingSize      = "size"
+	InstructionDrawingStart     = "start"
+	InstructionDrawingTransfer  = "transfer"
+	InstructionDrawingTransform = "transform"
+)
+
 // Object instructions
 const (
 	InstructionObjectBody       = "body"
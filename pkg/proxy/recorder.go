@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	"lion/pkg/config"
+	"lion/pkg/encrypt"
 	"lion/pkg/logger"
 
 	"github.com/jumpserver-dev/sdk-go/common"
@@ -69,13 +70,25 @@ func (r *FTPFileRecorder) CreateFTPFileInfo(logData *model.FTPLog) (info *FTPFil
 	storageTargetName := strings.Join([]string{FTPTargetPrefix, today, logData.ID}, "/")
 	info.absFilePath = absFilePath
 	info.Target = storageTargetName
-	fd, err := os.OpenFile(info.absFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if encrypt.Enabled() {
+		// 加密文件不能追加写入
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	fd, err := os.OpenFile(info.absFilePath, flag, 0644)
 	if err != nil {
 		logger.Errorf("Create FTP file %s error: %s\n", absFilePath, err)
 		return nil, err
 	}
 	logger.Debugf("Create or open FTP file %s", absFilePath)
 	info.fd = fd
+	if encrypt.Enabled() {
+		if info.encWriter, err = encrypt.NewWriter(fd); err != nil {
+			logger.Errorf("Create encrypted FTP file %s error: %s\n", absFilePath, err)
+			_ = fd.Close()
+			return nil, err
+		}
+	}
 	r.setFTPFile(logData.ID, info)
 	return info, nil
 }
@@ -136,7 +149,9 @@ func (r *FTPFileRecorder) UploadFile(maxRetry int, ftpLogId string) {
 
 	for i := 0; i <= maxRetry; i++ {
 		logger.Infof("Upload FTP file: %s, type: %s", info.absFilePath, r.storage.TypeName())
-		err := r.storage.Upload(info.absFilePath, info.Target)
+		err := encrypt.WithDecryptedFile(info.absFilePath, func(path string) error {
+			return r.storage.Upload(path, info.Target)
+		})
 		if err == nil {
 			_ = os.Remove(info.absFilePath)
 			if err := r.jmsService.FinishFTPFile(info.ftpLog.ID); err != nil {
@@ -226,6 +241,9 @@ type FTPFileInfo struct {
 	ftpLog *model.FTPLog
 	fd     *os.File
 
+	// 启用加密时写入 encWriter
+	encWriter *encrypt.Writer
+
 	absFilePath string
 	Target      string
 
@@ -233,8 +251,15 @@ type FTPFileInfo struct {
 	writtenBytes   int64
 }
 
+func (f *FTPFileInfo) writer() io.Writer {
+	if f.encWriter != nil {
+		return f.encWriter
+	}
+	return f.fd
+}
+
 func (f *FTPFileInfo) WriteChunk(p []byte) error {
-	nw, err := f.fd.Write(p)
+	nw, err := f.writer().Write(p)
 	if nw > 0 {
 		f.writtenBytes += int64(nw)
 	}
@@ -248,7 +273,7 @@ func (f *FTPFileInfo) WriteFromReader(r io.Reader) error {
 	for {
 		nr, er := r.Read(buf)
 		if nr > 0 {
-			nw, ew := f.fd.Write(buf[0:nr])
+			nw, ew := f.writer().Write(buf[0:nr])
 			if nw > 0 {
 				f.writtenBytes += int64(nw)
 				if f.isExceedWrittenSize() {
@@ -282,7 +307,14 @@ func (f *FTPFileInfo) isExceedWrittenSize() bool {
 
 func (f *FTPFileInfo) Close() error {
 	if f.fd != nil {
-		err := f.fd.Close()
+		var err error
+		if f.encWriter != nil {
+			err = f.encWriter.Close()
+			f.encWriter = nil
+		}
+		if err1 := f.fd.Close(); err == nil {
+			err = err1
+		}
 		f.fd = nil
 		return err
 	}
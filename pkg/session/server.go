@@ -426,6 +426,18 @@ func (s *Server) GenerateCommandItem(tunnel *TunnelSession, user, input, output
 	}
 }
 
+// AuditCommand 保存不经过命令解析的审计记录(例如会话聊天)，命令存储失败时提交到 core
+func (s *Server) AuditCommand(tunnel *TunnelSession, command *model.Command) error {
+	commands := []*model.Command{command}
+	cmdStorage := storage.NewCommandStorage(s.JmsService, tunnel.TerminalConfig)
+	err := cmdStorage.BulkSave(commands)
+	if err != nil && cmdStorage.TypeName() != "server" {
+		logger.Warnf("Session %s: Switch default command storage save.", tunnel.ID)
+		err = s.JmsService.PushSessionCommand(commands)
+	}
+	return err
+}
+
 func (s *Server) AuditFileOperation(fileLog model.FTPLog) {
 	if err := s.JmsService.CreateFileOperationLog(fileLog); err != nil {
 		logger.Errorf("Audit file operation err: %s", err)
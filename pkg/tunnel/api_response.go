@@ -4,7 +4,10 @@ import (
 	"errors"
 )
 
-var ErrNoAuthUser = errors.New("no auth user")
+var (
+	ErrNoAuthUser      = errors.New("no auth user")
+	ErrNotFoundSession = errors.New("not found session")
+)
 
 type APIResponse struct {
 	Success bool        `json:"success"`
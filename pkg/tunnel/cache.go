@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"sync"
+	"time"
 
 	"github.com/jumpserver-dev/sdk-go/common"
 
@@ -31,6 +32,12 @@ type GuaTunnelCache interface {
 	RecycleSessionEventChannel(sid string, eventChan *EventChan)
 
 	GetActiveConnections() []*Connection
+	GetSessionThumbnails() []SessionThumbnail
+
+	GetRewindBacklog(sid string) []RewindFrame
+
+	// HasSession 会话是否在本节点或者其他节点上
+	HasSession(sid string) bool
 }
 
 type SessionEvent interface {
@@ -48,10 +55,45 @@ type GuaTunnelCacheManager struct {
 	GuaTunnelCache
 }
 
+/*
+	会话事件
+
+	每个会话的事件带有递增的序号 Seq，本地缓存由 Room 分配，redis 缓存由 redis 分配(多个节点之间保持一致)。
+	Room 按照序号投递，乱序到达的事件等待缺失的序号，超过 roomGapTimeout 仍然缺失时跳过，
+	并通知订阅者 session_resync。每个订阅者有独立的队列，按照顺序投递给 eventCh，
+	积压超过 eventQueueMaxSize 时丢弃积压的事件，同样通知 session_resync。
+	订阅者收到 session_resync 后向主用户的 Connection 请求会话状态的快照(见 session_snapshot.go)。
+	没有序号的事件(如 redis 分配序号失败)直接投递。
+	高频且允许丢失的事件(光标移动、分享用户的输入)不分配序号，不会因为缺失或积压触发重新同步，
+	只有改变会话状态的事件需要按照顺序投递。
+*/
+
+const (
+	roomGapTimeout = 500 * time.Millisecond
+
+	// 每个订阅者最多积压的事件数
+	eventQueueMaxSize = 1024
+)
+
 type Room struct {
 	sid           string
 	eventChanMaps map[string]*EventChan
 	lock          sync.Mutex
+
+	// 本地缓存分配的最后一个序号
+	lastSeq uint64
+	// 下一个需要投递的序号，0 表示还没有收到有序号的事件
+	nextSeq  uint64
+	pending  map[uint64]*Event
+	gapTimer *time.Timer
+}
+
+func NewRoom(sid string) *Room {
+	return &Room{
+		sid:           sid,
+		eventChanMaps: make(map[string]*EventChan),
+		pending:       make(map[uint64]*Event),
+	}
 }
 
 func (r *Room) GetEventChannel(sid string) *EventChan {
@@ -67,20 +109,116 @@ func (r *Room) RecycleEventChannel(eventChan *EventChan) {
 	defer r.lock.Unlock()
 	delete(r.eventChanMaps, eventChan.id)
 	eventChan.Close()
+	if len(r.eventChanMaps) == 0 && r.gapTimer != nil {
+		r.gapTimer.Stop()
+		r.gapTimer = nil
+	}
+}
+
+// PublishEvent 本地缓存使用，分配序号后投递
+func (r *Room) PublishEvent(event *Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !isSequencedEvent(event.Type) {
+		r.deliver(event)
+		return
+	}
+	r.lastSeq = max(r.lastSeq+1, r.nextSeq)
+	event.Seq = r.lastSeq
+	r.dispatch(event)
 }
 
+// BroadcastEvent 投递已经分配序号的事件
 func (r *Room) BroadcastEvent(event *Event) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	r.dispatch(event)
+}
+
+func (r *Room) dispatch(event *Event) {
+	if event.Seq == 0 {
+		r.deliver(event)
+		return
+	}
+	if r.nextSeq == 0 {
+		r.nextSeq = event.Seq
+	}
+	if event.Seq < r.nextSeq {
+		logger.Debugf("Room %s drop late event %s seq %d", r.sid, event.Type, event.Seq)
+		return
+	}
+	r.pending[event.Seq] = event
+	r.flushPending()
+	if len(r.pending) > 0 && r.gapTimer == nil {
+		r.gapTimer = time.AfterFunc(roomGapTimeout, r.skipGap)
+	}
+}
+
+func (r *Room) flushPending() {
+	for {
+		event, ok := r.pending[r.nextSeq]
+		if !ok {
+			break
+		}
+		delete(r.pending, r.nextSeq)
+		r.nextSeq++
+		r.deliver(event)
+	}
+	if len(r.pending) == 0 && r.gapTimer != nil {
+		r.gapTimer.Stop()
+		r.gapTimer = nil
+	}
+}
+
+// skipGap 缺失的事件没有到达，跳到等待中最小的序号，订阅者需要重新同步
+func (r *Room) skipGap() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.gapTimer = nil
+	if len(r.pending) == 0 {
+		return
+	}
+	minSeq := uint64(0)
+	for seq := range r.pending {
+		if minSeq == 0 || seq < minSeq {
+			minSeq = seq
+		}
+	}
+	logger.Warnf("Room %s miss event seq %d-%d", r.sid, r.nextSeq, minSeq-1)
+	r.nextSeq = minSeq
+	r.deliver(&Event{Type: SessionResyncEvent})
+	r.flushPending()
+	if len(r.pending) > 0 {
+		r.gapTimer = time.AfterFunc(roomGapTimeout, r.skipGap)
+	}
+}
+
+// isSequencedEvent 高频且允许丢失的事件不需要序号
+func isSequencedEvent(eventType string) bool {
+	switch eventType {
+	case CursorMoveEvent, ShareInputEvent:
+		return false
+	}
+	return true
+}
+
+func (r *Room) deliver(event *Event) {
 	for _, eventChan := range r.eventChanMaps {
 		eventChan.SendEvent(event)
 	}
 }
 
+// EventChan 订阅者的事件队列，SendEvent 不会阻塞
 type EventChan struct {
 	id      string
 	sid     string
 	eventCh chan *Event
+
+	lock   sync.Mutex
+	queue  []*Event
+	notify chan struct{}
+	done   chan struct{}
+	closed bool
 }
 
 func (e *EventChan) GetEventChannel() chan *Event {
@@ -88,28 +226,77 @@ func (e *EventChan) GetEventChannel() chan *Event {
 }
 
 func (e *EventChan) SendEvent(event *Event) {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		return
+	}
+	if len(e.queue) >= eventQueueMaxSize {
+		logger.Errorf("EventChan %s for session %s is lagging, drop %d events", e.id, e.sid, len(e.queue))
+		clear(e.queue)
+		e.queue = append(e.queue[:0], &Event{Type: SessionResyncEvent})
+	}
+	e.queue = append(e.queue, event)
+	e.lock.Unlock()
 	select {
-	case e.eventCh <- event:
+	case e.notify <- struct{}{}:
 	default:
-		logger.Errorf("EventChan %s for session %s is full", e.id, e.sid)
+	}
+}
+
+func (e *EventChan) run() {
+	defer close(e.eventCh)
+	for {
+		e.lock.Lock()
+		if len(e.queue) == 0 {
+			e.lock.Unlock()
+			select {
+			case <-e.notify:
+				continue
+			case <-e.done:
+				return
+			}
+		}
+		event := e.queue[0]
+		e.queue[0] = nil
+		e.queue = e.queue[1:]
+		e.lock.Unlock()
+		select {
+		case e.eventCh <- event:
+		case <-e.done:
+			return
+		}
 	}
 }
 
 func (e *EventChan) Close() {
-	close(e.eventCh)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	e.queue = nil
+	close(e.done)
 }
 
 func NewEventChan(sid string) *EventChan {
-	return &EventChan{
+	e := &EventChan{
 		id:      common.UUID(),
 		sid:     sid,
-		eventCh: make(chan *Event, 5),
+		eventCh: make(chan *Event),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
 	}
+	go e.run()
+	return e
 }
 
 type Event struct {
 	Type string
 	Data []byte
+	// 会话内的序号，0 表示没有序号；redis 中使用 SessionRoomMessage.Seq 传递
+	Seq uint64 `json:"-"`
 }
 
 const (
@@ -123,4 +310,7 @@ const (
 
 	PermExpiredEvent = "perm_expired"
 	PermValidEvent   = "perm_valid"
+
+	// 本地生成，通知订阅者丢失了事件
+	SessionResyncEvent = "session_resync"
 )
@@ -95,15 +95,25 @@ func (g *GuaTunnelLocalCache) GetSessionEventChan(sid string) *EventChan {
 	defer g.roomLock.Unlock()
 	room := g.Rooms[sid]
 	if room == nil {
-		g.Rooms[sid] = &Room{
-			sid:           sid,
-			eventChanMaps: make(map[string]*EventChan),
-		}
+		g.Rooms[sid] = NewRoom(sid)
 	}
 	return g.Rooms[sid].GetEventChannel(sid)
 }
 
 func (g *GuaTunnelLocalCache) BroadcastSessionEvent(sid string, event *Event) {
+	g.roomLock.Lock()
+	defer g.roomLock.Unlock()
+	if room, ok := g.Rooms[sid]; ok {
+		room.PublishEvent(event)
+	}
+}
+
+func (g *GuaTunnelLocalCache) HasSession(sid string) bool {
+	return g.GetBySessionId(sid) != nil
+}
+
+// dispatchSessionEvent 投递 redis 分配序号的事件
+func (g *GuaTunnelLocalCache) dispatchSessionEvent(sid string, event *Event) {
 	g.roomLock.Lock()
 	defer g.roomLock.Unlock()
 	if room, ok := g.Rooms[sid]; ok {
@@ -131,3 +141,14 @@ func (g *GuaTunnelLocalCache) GetActiveConnections() []*Connection {
 	}
 	return ret
 }
+
+func (g *GuaTunnelLocalCache) GetSessionThumbnails() []SessionThumbnail {
+	return getLocalSessionThumbnails(g.GetActiveConnections())
+}
+
+func (g *GuaTunnelLocalCache) GetRewindBacklog(sid string) []RewindFrame {
+	if conn := g.GetBySessionId(sid); conn != nil {
+		return conn.RewindBacklog()
+	}
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 
 	"github.com/go-redis/redis/v8"
 
+	"lion/pkg/config"
 	"lion/pkg/guacd"
 	"lion/pkg/logger"
 
@@ -134,6 +135,9 @@ func NewGuaTunnelRedisCache(conf Config) *GuaTunnelRedisCache {
 		GuaTunnelLocalCache: NewLocalTunnelLocalCache(),
 	}
 	go cache.run()
+	if config.GlobalConfig.EnableSessionWall {
+		go cache.publishSessionThumbnails()
+	}
 	return &cache
 }
 
@@ -151,21 +155,122 @@ type GuaTunnelRedisCache struct {
 	redisConExitChan   chan string
 }
 
-func (r *GuaTunnelRedisCache) BroadcastSessionEvent(sid string, event *Event) {
-	r.GuaTunnelLocalCache.BroadcastSessionEvent(sid, event)
-	r.broadcastSessionEventToRemote(sid, event)
+/*
+	会话事件的序号: 使用 lua 脚本在 redis 中原子地分配序号并发布，所有节点收到的事件顺序和序号一致
+	key: sessionsChannelPrefix:SEQ:sessionId
+	不需要序号的事件(见 isSequencedEvent)直接发布，不执行 lua 脚本
+*/
+
+const sessionSeqExpire = 24 * time.Hour
+
+var publishSessionEventScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+redis.call('PUBLISH', ARGV[3], '{"seq":' .. seq .. ',' .. string.sub(ARGV[1], 2))
+return seq
+`)
+
+func (r *GuaTunnelRedisCache) sessionSeqKey(sid string) string {
+	return fmt.Sprintf("%s:SEQ:%s", sessionsChannelPrefix, sid)
 }
 
-func (r *GuaTunnelRedisCache) broadcastSessionEventToRemote(sid string, event *Event) {
+func (r *GuaTunnelRedisCache) BroadcastSessionEvent(sid string, event *Event) {
 	msg := SessionRoomMessage{
 		Id:        r.ID,
 		SessionId: sid,
 		Event:     event,
 	}
 	eventBody, _ := json.Marshal(msg)
-	if err := r.publishCommand(sessionEventsChannel, eventBody); err != nil {
-		logger.Errorf("Redis cache broadcast session event %s err: %s", sid, err)
+	if !isSequencedEvent(event.Type) {
+		if err := r.publishCommand(sessionEventsChannel, eventBody); err != nil {
+			logger.Errorf("Redis cache broadcast session event %s err: %s", sid, err)
+		}
+		event.Seq = 0
+		r.GuaTunnelLocalCache.dispatchSessionEvent(sid, event)
+		return
+	}
+	seq, err := publishSessionEventScript.Run(context.TODO(), r.rdb, []string{r.sessionSeqKey(sid)},
+		eventBody, int(sessionSeqExpire.Seconds()), sessionEventsChannel).Int64()
+	if err != nil {
+		// 分配序号失败时不带序号发布
+		logger.Errorf("Redis cache publish session event %s with seq err: %s", sid, err)
+		if err = r.publishCommand(sessionEventsChannel, eventBody); err != nil {
+			logger.Errorf("Redis cache broadcast session event %s err: %s", sid, err)
+		}
 	}
+	event.Seq = uint64(seq)
+	r.GuaTunnelLocalCache.dispatchSessionEvent(sid, event)
+}
+
+/*
+	会话墙缩略图: 每个节点定时将本地会话的缩略图写入 redis
+	key: sessionsChannelPrefix:WALL:nodeId:sessionId
+*/
+
+func (r *GuaTunnelRedisCache) sessionWallKey(nodeId, sid string) string {
+	return fmt.Sprintf("%s:WALL:%s:%s", sessionsChannelPrefix, nodeId, sid)
+}
+
+func (r *GuaTunnelRedisCache) publishSessionThumbnails() {
+	interval := getSessionWallInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		thumbnails := r.GuaTunnelLocalCache.GetSessionThumbnails()
+		if len(thumbnails) == 0 {
+			continue
+		}
+		pipe := r.rdb.Pipeline()
+		for i := range thumbnails {
+			body, _ := json.Marshal(thumbnails[i])
+			key := r.sessionWallKey(r.ID, thumbnails[i].SessionId)
+			pipe.Set(context.TODO(), key, body, 3*interval)
+		}
+		if _, err := pipe.Exec(context.TODO()); err != nil {
+			logger.Errorf("Redis cache publish session thumbnails err: %s", err)
+		}
+	}
+}
+
+func (r *GuaTunnelRedisCache) GetSessionThumbnails() []SessionThumbnail {
+	ret := r.GuaTunnelLocalCache.GetSessionThumbnails()
+	if !config.GlobalConfig.EnableSessionWall {
+		return ret
+	}
+	ctx := context.TODO()
+	localPrefix := r.sessionWallKey(r.ID, "")
+	keys := make([]string, 0)
+	iter := r.rdb.Scan(ctx, 0, r.sessionWallKey("*", "*"), 100).Iterator()
+	for iter.Next(ctx) {
+		if key := iter.Val(); !strings.HasPrefix(key, localPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		logger.Errorf("Redis cache scan session thumbnails err: %s", err)
+		return ret
+	}
+	if len(keys) == 0 {
+		return ret
+	}
+	values, err := r.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		logger.Errorf("Redis cache get session thumbnails err: %s", err)
+		return ret
+	}
+	for i := range values {
+		body, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		var thumbnail SessionThumbnail
+		if err1 := json.Unmarshal([]byte(body), &thumbnail); err1 != nil {
+			logger.Errorf("Redis cache unmarshal session thumbnail err: %s", err1)
+			continue
+		}
+		ret = append(ret, thumbnail)
+	}
+	return ret
 }
 
 func (r *GuaTunnelRedisCache) GetMonitorTunnelerBySessionId(sid string) Tunneler {
@@ -176,6 +281,68 @@ func (r *GuaTunnelRedisCache) GetMonitorTunnelerBySessionId(sid string) Tunneler
 	return r.requestRemoteTunnelerBySessionId(sid)
 }
 
+/*
+	会话不在本节点时，请求会话所在的节点将回看的指令写入 redis
+	key: reqId:REWIND
+*/
+
+func (r *GuaTunnelRedisCache) GetRewindBacklog(sid string) []RewindFrame {
+	if r.GuaTunnelLocalCache.GetBySessionId(sid) != nil {
+		return r.GuaTunnelLocalCache.GetRewindBacklog(sid)
+	}
+	req := r.createEventRequest(sid, channelEventRewind)
+	if _, err := r.sendRequest(&req); err != nil {
+		logger.Errorf("Redis cache request session %s rewind err: %s", sid, err)
+		return nil
+	}
+	ctx := context.TODO()
+	key := r.rewindKey(req.ReqId)
+	data, err := r.rdb.Get(ctx, key).Result()
+	if err != nil {
+		logger.Errorf("Redis cache get session %s rewind err: %s", sid, err)
+		return nil
+	}
+	r.rdb.Del(ctx, key)
+	return decodeRewindBacklog(data)
+}
+
+/*
+	会话不在本节点时，请求其他节点确认会话是否存在，只有会话所在的节点回复
+*/
+
+const sessionCheckTimeout = 3 * time.Second
+
+func (r *GuaTunnelRedisCache) HasSession(sid string) bool {
+	if r.GuaTunnelLocalCache.HasSession(sid) {
+		return true
+	}
+	req := r.createEventRequest(sid, channelEventCheck)
+	if _, err := r.sendRequestWithTimeout(&req, sessionCheckTimeout); err != nil {
+		logger.Infof("Redis cache check session %s not found: %s", sid, err)
+		return false
+	}
+	return true
+}
+
+func (r *GuaTunnelRedisCache) rewindKey(reqId string) string {
+	return fmt.Sprintf("%s:REWIND", reqId)
+}
+
+// replyRewindBacklog 生成关键帧需要编码图片，不能阻塞 redis 的消息循环
+func (r *GuaTunnelRedisCache) replyRewindBacklog(req subscribeRequest, conn *Connection) {
+	if frames := conn.RewindBacklog(); frames != nil {
+		err := r.rdb.Set(context.TODO(), r.rewindKey(req.ReqId), encodeRewindBacklog(frames), time.Minute).Err()
+		if err != nil {
+			logger.Errorf("Redis cache write rewind of request %s err: %s", req.ReqId, err)
+			return
+		}
+	}
+	successReq := r.createResultRequest(req.ReqId, req.SessionId, channelEventRewindSuccess)
+	if err := r.publishRequest(&successReq); err != nil {
+		logger.Errorf("Redis cache reply request %s rewind event err %s", req.ReqId, err)
+	}
+}
+
 func (r *GuaTunnelRedisCache) requestRemoteTunnelerBySessionId(sid string) Tunneler {
 	/*
 		1. 发布请求
@@ -191,7 +358,11 @@ func (r *GuaTunnelRedisCache) requestRemoteTunnelerBySessionId(sid string) Tunne
 }
 
 func (r *GuaTunnelRedisCache) sendRequest(req *subscribeRequest) (*subscribeResponse, error) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), 20*time.Second)
+	return r.sendRequestWithTimeout(req, 20*time.Second)
+}
+
+func (r *GuaTunnelRedisCache) sendRequestWithTimeout(req *subscribeRequest, timeout time.Duration) (*subscribeResponse, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
 	defer cancelFunc()
 	r.requestChan <- req
 	resultChan := <-r.responseChan
@@ -270,16 +441,18 @@ func (r *GuaTunnelRedisCache) proxyTunnel(tunnelProxy *RedisGuacProxy) {
 		_ = tunnelProxy.Close()
 	}()
 	logger.Infof("Redis guacd proxy %s tunnel start", tunnelProxy.reqId)
-	for {
-		ins, err := tunnelProxy.ReadInstruction()
-		if err != nil {
-			logger.Errorf("Redis guacd proxy %s tunnel read err: %s", tunnelProxy.reqId, err)
-			return
-		}
-		if err = r.publishCommand(tunnelProxy.writeChannelName, []byte(ins.String())); err != nil {
+	viewer := NewViewerStream(tunnelProxy.reqId, tunnelProxy.sessionId, r.ID, tunnelProxy,
+		func(ins *guacd.Instruction) error {
+			_, err := tunnelProxy.WriteAndFlush([]byte(ins.String()))
+			return err
+		})
+	err := viewer.Run(func(ins *guacd.Instruction) error {
+		if err := r.publishCommand(tunnelProxy.writeChannelName, []byte(ins.String())); err != nil {
 			logger.Errorf("Redis guacd proxy %s pubSub message err: %s", tunnelProxy.reqId, err)
 		}
-	}
+		return nil
+	})
+	logger.Errorf("Redis guacd proxy %s tunnel exit: %s", tunnelProxy.reqId, err)
 }
 
 func (r *GuaTunnelRedisCache) run() {
@@ -345,6 +518,19 @@ func (r *GuaTunnelRedisCache) run() {
 						go r.proxyTunnel(&proxyConn)
 					}
 
+				case channelEventRewind:
+					if conn := r.GuaTunnelLocalCache.GetBySessionId(req.SessionId); conn != nil {
+						go r.replyRewindBacklog(req, conn)
+					}
+
+				case channelEventCheck:
+					if r.GuaTunnelLocalCache.HasSession(req.SessionId) {
+						successReq := r.createResultRequest(req.ReqId, req.SessionId, channelEventCheckSuccess)
+						if err := r.publishRequest(&successReq); err != nil {
+							logger.Errorf("Redis cache reply request %s check event err %s", req.ReqId, err)
+						}
+					}
+
 				case channelEventExit:
 					successReq := r.createResultRequest(req.ReqId, req.SessionId,
 						channelEventExitSuccess)
@@ -396,7 +582,7 @@ func (r *GuaTunnelRedisCache) run() {
 					go conn.run()
 					responseChan <- &res
 					localConnMap[conn.reqId] = &conn
-				case channelEventExitSuccess:
+				case channelEventExitSuccess, channelEventRewindSuccess, channelEventCheckSuccess:
 					var res subscribeResponse
 					res.Req = &req
 					responseChan <- &res
@@ -414,9 +600,10 @@ func (r *GuaTunnelRedisCache) run() {
 				logger.Debugf("Redis cache ignore self session event %s", msg.Event.Type)
 				continue
 			}
-			logger.Infof("Redis channel %s recv session event %s",
-				redisSessionMsg.Channel, msg.Event.Type)
-			r.GuaTunnelLocalCache.BroadcastSessionEvent(msg.SessionId, msg.Event)
+			logger.Debugf("Redis channel %s recv session event %s seq %d",
+				redisSessionMsg.Channel, msg.Event.Type, msg.Seq)
+			msg.Event.Seq = msg.Seq
+			r.GuaTunnelLocalCache.dispatchSessionEvent(msg.SessionId, msg.Event)
 
 		case req := <-r.requestChan:
 			logger.Debugf("Redis cache publish request %s event %s", req.ReqId, req.Event)
@@ -553,6 +740,12 @@ const (
 	channelEventExit        = "Exit"
 	channelEventJoinSuccess = "JoinSuccess"
 	channelEventExitSuccess = "ExitSuccess"
+
+	channelEventRewind        = "Rewind"
+	channelEventRewindSuccess = "RewindSuccess"
+
+	channelEventCheck        = "Check"
+	channelEventCheckSuccess = "CheckSuccess"
 )
 
 type subscribeRequest struct {
@@ -570,6 +763,9 @@ type subscribeResponse struct {
 	conn *RedisConn
 }
 
+// 监控用户转发的 sync 指令
+const syncInstructionPrefix = "4.sync,"
+
 type RedisGuacProxy struct {
 	reqId     string
 	sessionId string
@@ -582,7 +778,8 @@ type RedisGuacProxy struct {
 
 	done chan struct{}
 
-	tunnel *guacd.Tunnel
+	tunnel    *guacd.Tunnel
+	writeLock sync.Mutex
 
 	once sync.Once
 }
@@ -591,6 +788,12 @@ func (r *RedisGuacProxy) UUID() string {
 	return r.tunnel.UUID()
 }
 
+func (r *RedisGuacProxy) WriteAndFlush(p []byte) (int, error) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	return r.tunnel.WriteAndFlush(p)
+}
+
 func (r *RedisGuacProxy) run() {
 	logger.Infof("Redis guacd proxy %s pubSub run", r.reqId)
 	redisMsgChan := r.pubSub.Channel()
@@ -601,7 +804,11 @@ func (r *RedisGuacProxy) run() {
 				logger.Infof("Redis guacd proxy %s pubSub exit", r.reqId)
 				return
 			}
-			if _, err := r.tunnel.WriteAndFlush([]byte(redisMsg.Payload)); err != nil {
+			// sync 由本节点的 ViewerStream 回复，忽略监控用户转发的 sync
+			if strings.HasPrefix(redisMsg.Payload, syncInstructionPrefix) {
+				continue
+			}
+			if _, err := r.WriteAndFlush([]byte(redisMsg.Payload)); err != nil {
 				logger.Errorf("Redis guacd proxy %s tunnel write err: %s", r.reqId, err)
 			}
 		case <-r.done:
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func receiveEvents(t *testing.T, eventChan *EventChan, count int) []*Event {
+	ret := make([]*Event, 0, count)
+	for len(ret) < count {
+		select {
+		case event := <-eventChan.eventCh:
+			ret = append(ret, event)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("receive %d events, want %d", len(ret), count)
+		}
+	}
+	return ret
+}
+
+func TestRoomOrderedDelivery(t *testing.T) {
+	room := NewRoom("sid")
+	eventChan := room.GetEventChannel("sid")
+	defer room.RecycleEventChannel(eventChan)
+
+	for _, seq := range []uint64{10, 12, 11, 13} {
+		room.BroadcastEvent(&Event{Type: strconv.FormatUint(seq, 10), Seq: seq})
+	}
+	for i, event := range receiveEvents(t, eventChan, 4) {
+		if want := uint64(10 + i); event.Seq != want {
+			t.Fatalf("event %d seq %d, want %d", i, event.Seq, want)
+		}
+	}
+
+	// 重复和迟到的事件丢弃
+	room.BroadcastEvent(&Event{Type: "late", Seq: 11})
+	room.PublishEvent(&Event{Type: "local"})
+	if event := receiveEvents(t, eventChan, 1)[0]; event.Type != "local" || event.Seq != 14 {
+		t.Fatalf("unexpected event %s seq %d", event.Type, event.Seq)
+	}
+}
+
+func TestRoomUnsequencedEvent(t *testing.T) {
+	room := NewRoom("sid")
+	eventChan := room.GetEventChannel("sid")
+	defer room.RecycleEventChannel(eventChan)
+
+	room.BroadcastEvent(&Event{Type: "a", Seq: 1})
+	// 光标事件不分配序号，不影响有序事件的投递
+	room.PublishEvent(&Event{Type: CursorMoveEvent})
+	room.BroadcastEvent(&Event{Type: "b", Seq: 2})
+	events := receiveEvents(t, eventChan, 3)
+	if events[1].Type != CursorMoveEvent || events[1].Seq != 0 {
+		t.Fatalf("unexpected event %s seq %d", events[1].Type, events[1].Seq)
+	}
+	room.PublishEvent(&Event{Type: "local"})
+	if event := receiveEvents(t, eventChan, 1)[0]; event.Seq != 3 {
+		t.Fatalf("local event seq %d, want 3", event.Seq)
+	}
+}
+
+func TestRoomSkipGap(t *testing.T) {
+	room := NewRoom("sid")
+	eventChan := room.GetEventChannel("sid")
+	defer room.RecycleEventChannel(eventChan)
+
+	room.BroadcastEvent(&Event{Type: "a", Seq: 1})
+	room.BroadcastEvent(&Event{Type: "c", Seq: 3})
+	events := receiveEvents(t, eventChan, 3)
+	want := []string{"a", SessionResyncEvent, "c"}
+	for i := range want {
+		if events[i].Type != want[i] {
+			t.Fatalf("event %d type %s, want %s", i, events[i].Type, want[i])
+		}
+	}
+}
+
+func TestEventChanLagging(t *testing.T) {
+	eventChan := NewEventChan("sid")
+	defer eventChan.Close()
+
+	// 积压超过上限后丢弃积压的事件，先投递 session_resync
+	total := eventQueueMaxSize + 2
+	for i := 0; i < total; i++ {
+		eventChan.SendEvent(&Event{Type: "event", Seq: uint64(i + 1)})
+	}
+	// run 可能已经取出第一个事件
+	event := receiveEvents(t, eventChan, 1)[0]
+	if event.Seq == 1 {
+		event = receiveEvents(t, eventChan, 1)[0]
+	}
+	if event.Type != SessionResyncEvent {
+		t.Fatalf("event type %s, want %s", event.Type, SessionResyncEvent)
+	}
+	// 只保留丢弃后收到的事件
+	for event.Seq != uint64(total) {
+		event = receiveEvents(t, eventChan, 1)[0]
+		if event.Seq < eventQueueMaxSize {
+			t.Fatalf("receive dropped event seq %d", event.Seq)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package tunnel
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
@@ -12,6 +14,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 
+	"lion/pkg/config"
+	"lion/pkg/display"
 	"lion/pkg/guacd"
 	"lion/pkg/logger"
 	"lion/pkg/session"
@@ -42,6 +46,15 @@ func (c Connections) Swap(i, j int) {
 	c[j], c[i] = c[i], c[j]
 }
 
+// ClientConn web client 与 lion 之间的传输通道，websocket 和 http tunnel 均实现该接口
+type ClientConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+var _ ClientConn = (*websocket.Conn)(nil)
+
 type Connection struct {
 	Sess        *session.TunnelSession
 	guacdTunnel *guacd.Tunnel
@@ -49,10 +62,19 @@ type Connection struct {
 
 	guacdAddr string
 
-	ws *websocket.Conn
+	ws ClientConn
 
 	wsLock    sync.Mutex
 	guacdLock sync.Mutex
+	wsBatch   *wsBatchWriter
+
+	// web client 重连后使用 join 的 tunnel 展示画面，原始的 guacdTunnel 由 lion 保活
+	attachLock    sync.RWMutex
+	displayTunnel *guacd.Tunnel
+	attachReq     *reattachRequest
+	reattachChan  chan *reattachRequest
+	resumeToken   string
+	clientClosed  atomic.Bool
 
 	outputFilter *OutputStreamInterceptingFilter
 
@@ -68,24 +90,130 @@ type Connection struct {
 
 	recordStatus atomic.Bool
 
+	// 强制录像模式下录像的状态，录像中断时锁定输入
+	recordBroken atomic.Bool
+	recordReady  chan struct{}
+	recordFailed chan error
+
+	// 录像中记录用户的输入
+	replayRecorder *ReplayRecorder
+	inputAnnotator *inputAnnotator
+
 	Cache GuaTunnelCache
 	meta  *MetaShareUserMessage
 
 	currentOnlineUsers map[string]MetaShareUserMessage
+	// 等待主用户同意加入的分享用户
+	knocks map[string]ShareKnock
+
+	// 控制权的持有者，为空时由主用户持有
+	controlLock   sync.Mutex
+	controlHolder MetaShareUserMessage
+	controlLost   atomic.Bool
+	// 参与者最近一次请求控制权的时间，限制 control_request 的广播频率
+	controlRequests map[string]time.Time
+
+	// 管理员接管会话，takeoverLocked 为接管前的锁定状态
+	takeoverLock   sync.Mutex
+	takeover       TakeoverState
+	takeoverLocked bool
+
+	// 会话聊天，主用户的 Connection 保存最近的消息
+	chatSender  chatSender
+	chatLock    sync.Mutex
+	chatHistory []ChatMessage
+
+	// 广播主用户的光标位置
+	cursor *cursorPresence
 
 	invalidPerm     atomic.Bool
 	invalidPermData []byte
 	invalidPermTime time.Time
+
+	// 会话墙使用，根据 guacd 的指令维护当前画面
+	screen       *display.Display
+	thumbLock    sync.Mutex
+	thumbVersion uint64
+	thumbnail    *SessionThumbnail
+
+	// 监控用户回看使用，保存最近的绘制指令
+	rewind *rewindBuffer
+}
+
+var (
+	ErrClientDetached = errors.New("web client detached")
+	ErrClientAttached = errors.New("web client already attached")
+	ErrSessionClosed  = errors.New("session closed")
+)
+
+const (
+	reasonClientDetached   = "Web client disconnected, wait for reattach"
+	reasonClientReattached = "Web client reattached"
+)
+
+type reattachRequest struct {
+	ws   ClientConn
+	info guacd.ClientInformation
+	done chan error
+}
+
+func (r *reattachRequest) finish(err error) {
+	select {
+	case r.done <- err:
+	default:
+	}
+}
+
+type reattachResult struct {
+	req    *reattachRequest
+	tunnel *guacd.Tunnel
+	err    error
+}
+
+// reattachGrace web client 断开后等待重连的计时，未启动时 C 为 nil
+type reattachGrace struct {
+	duration time.Duration
+	timer    *time.Timer
+	C        <-chan time.Time
+}
+
+// Start 返回 false 表示不等待重连
+func (g *reattachGrace) Start() bool {
+	if g.duration <= 0 {
+		return false
+	}
+	g.Stop()
+	g.timer = time.NewTimer(g.duration)
+	g.C = g.timer.C
+	return true
+}
+
+func (g *reattachGrace) Stop() {
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	g.C = nil
+}
+
+type clientDetach struct {
+	ws  ClientConn
+	err error
 }
 
 func (t *Connection) SendWsMessage(msg guacd.Instruction) error {
+	_ = t.wsBatch.Flush()
 	return t.writeWsMessage([]byte(msg.String()))
 }
 
 func (t *Connection) writeWsMessage(p []byte) error {
 	t.wsLock.Lock()
 	defer t.wsLock.Unlock()
-	return t.ws.WriteMessage(websocket.TextMessage, p)
+	ws := t.currentWs()
+	if ws == nil {
+		return ErrClientDetached
+	}
+	return ws.WriteMessage(websocket.TextMessage, p)
 }
 
 func (t *Connection) WriteTunnelMessage(msg guacd.Instruction) (err error) {
@@ -94,18 +222,26 @@ func (t *Connection) WriteTunnelMessage(msg guacd.Instruction) (err error) {
 }
 
 func (t *Connection) writeTunnelMessage(p []byte) (int, error) {
+	return t.writeTunnelTo(t.currentDisplayTunnel(), p)
+}
+
+func (t *Connection) writeTunnelTo(tunnel *guacd.Tunnel, p []byte) (int, error) {
 	t.guacdLock.Lock()
 	defer t.guacdLock.Unlock()
-	return t.guacdTunnel.WriteAndFlush(p)
+	return tunnel.WriteAndFlush(p)
 }
 
-func (t *Connection) readTunnelInstruction() (*guacd.Instruction, error) {
+func (t *Connection) readTunnelInstruction(tunnel *guacd.Tunnel) (*guacd.Instruction, error) {
 	for {
-		instruction, err := t.guacdTunnel.ReadInstruction()
+		instruction, err := tunnel.ReadInstruction()
 		if err != nil {
 			return nil, err
 		}
 		newInstruction := &instruction
+		// 只有展示给 web client 的 tunnel 才需要处理文件流
+		if tunnel != t.currentDisplayTunnel() {
+			return newInstruction, nil
+		}
 		if t.inputFilter != nil {
 			newInstruction = t.inputFilter.Filter(newInstruction)
 			if newInstruction == nil {
@@ -123,26 +259,160 @@ func (t *Connection) readTunnelInstruction() (*guacd.Instruction, error) {
 
 }
 
-func (t *Connection) Run(ctx *gin.Context) (err error) {
-	defer t.releaseMonitorTunnel()
+func (t *Connection) currentWs() ClientConn {
+	t.attachLock.RLock()
+	defer t.attachLock.RUnlock()
+	return t.ws
+}
+
+func (t *Connection) currentDisplayTunnel() *guacd.Tunnel {
+	t.attachLock.RLock()
+	defer t.attachLock.RUnlock()
+	if t.displayTunnel != nil {
+		return t.displayTunnel
+	}
+	return t.guacdTunnel
+}
+
+// isDisplayTunnel tunnel 的画面是否正在转发给 web client
+func (t *Connection) isDisplayTunnel(tunnel *guacd.Tunnel) bool {
+	t.attachLock.RLock()
+	defer t.attachLock.RUnlock()
+	if t.ws == nil {
+		return false
+	}
+	if t.displayTunnel != nil {
+		return t.displayTunnel == tunnel
+	}
+	return t.guacdTunnel == tunnel
+}
+
+// keepTunnelAlive 没有 web client 时，需要 lion 回复 sync，否则 guacd 会认为用户无响应
+func (t *Connection) keepTunnelAlive(tunnel *guacd.Tunnel, instruction *guacd.Instruction) {
+	if instruction.Opcode != guacd.InstructionClientSync {
+		return
+	}
+	if _, err := t.writeTunnelTo(tunnel, []byte(instruction.String())); err != nil {
+		logger.Debugf("Session[%s] keep guacamole tunnel alive err: %+v", t, err)
+	}
+}
+
+func (t *Connection) sendAttachedMessage(metaJsonStr string) error {
 	// 需要发送 uuid 返回给 guacamole tunnel
-	err = t.SendWsMessage(guacd.NewInstruction(
+	err := t.SendWsMessage(guacd.NewInstruction(
 		INTERNALDATAOPCODE, t.guacdTunnel.UUID()))
 	if err != nil {
-		logger.Errorf("Run err: %s", err)
 		return err
 	}
+	currentUserInst := NewJmsEventInstruction("current_user", metaJsonStr)
+	_ = t.SendWsMessage(currentUserInst)
+	if config.GlobalConfig.ReattachGraceTime > 0 && t.resumeToken != "" {
+		p, _ := json.Marshal(map[string]interface{}{
+			"token":      t.resumeToken,
+			"grace_time": config.GlobalConfig.ReattachGraceTime,
+		})
+		_ = t.SendWsMessage(NewJmsEventInstruction("resume_token", string(p)))
+	}
+	return nil
+}
+
+// dialDisplayTunnel 连接 guacd 可能需要数秒，在单独的 goroutine 中执行，结果交给 Run 的循环处理
+func (t *Connection) dialDisplayTunnel(req *reattachRequest, results chan<- reattachResult) {
+	conf := guacd.NewConfiguration()
+	conf.ConnectionID = t.guacdTunnel.UUID()
+	displayTunnel, err := guacd.NewTunnel(t.guacdAddr, conf, req.info)
+	select {
+	case results <- reattachResult{req: req, tunnel: displayTunnel, err: err}:
+	case <-t.done:
+		if displayTunnel != nil {
+			_ = displayTunnel.Close()
+		}
+		req.finish(ErrSessionClosed)
+	}
+}
+
+// attachClient 使用新的 join tunnel 展示画面，guacd 会给新加入的用户发送完整的画面
+func (t *Connection) attachClient(res reattachResult) error {
+	if res.err != nil {
+		return res.err
+	}
+	t.attachLock.Lock()
+	if t.ws != nil {
+		t.attachLock.Unlock()
+		_ = res.tunnel.Close()
+		return ErrClientAttached
+	}
+	t.ws = res.req.ws
+	t.displayTunnel = res.tunnel
+	t.attachReq = res.req
+	t.attachLock.Unlock()
+	return nil
+}
+
+// detachClient 移除当前的 web client，返回 false 表示 ws 已经不是当前的 web client
+func (t *Connection) detachClient(ws ClientConn) bool {
+	t.attachLock.Lock()
+	if ws == nil || t.ws != ws {
+		t.attachLock.Unlock()
+		return false
+	}
+	displayTunnel := t.displayTunnel
+	req := t.attachReq
+	t.ws = nil
+	t.displayTunnel = nil
+	t.attachReq = nil
+	t.attachLock.Unlock()
+	t.wsBatch.Reset()
+	_ = ws.Close()
+	if displayTunnel != nil {
+		_ = displayTunnel.Close()
+	}
+	if req != nil {
+		req.finish(nil)
+	}
+	return true
+}
+
+// Reattach 将新的 web client 接入到等待重连的会话，阻塞直到该 web client 断开或者会话结束
+func (t *Connection) Reattach(ctx context.Context, ws ClientConn, info guacd.ClientInformation) error {
+	req := reattachRequest{ws: ws, info: info, done: make(chan error, 1)}
+	select {
+	case t.reattachChan <- &req:
+	case <-t.done:
+		return ErrSessionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.done:
+		return err
+	case <-t.done:
+		return nil
+	}
+}
+
+func (t *Connection) Run(ctx *gin.Context) (err error) {
+	defer t.releaseMonitorTunnel()
+	defer t.wsBatch.Reset()
+	defer close(t.done)
+	defer t.detachClient(t.currentWs())
 	eventChan := t.Cache.GetSessionEventChan(t.Sess.ID)
+	defer t.Cache.RecycleSessionEventChannel(t.Sess.ID, eventChan)
+	go t.handleEvents(eventChan)
 	var jsonBuilder strings.Builder
 	_ = json.NewEncoder(&jsonBuilder).Encode(t.meta)
 	metaJsonStr := jsonBuilder.String()
-	currentUserInst := NewJmsEventInstruction("current_user", metaJsonStr)
-	_ = t.SendWsMessage(currentUserInst)
+	if err = t.sendAttachedMessage(metaJsonStr); err != nil {
+		logger.Errorf("Run err: %s", err)
+		return err
+	}
 	eventData := []byte(metaJsonStr)
 	t.Cache.BroadcastSessionEvent(t.Sess.ID, &Event{Type: ShareJoin, Data: eventData})
 	defer func() {
 		t.Cache.BroadcastSessionEvent(t.Sess.ID, &Event{Type: ShareExit, Data: eventData})
 	}()
+	t.cursor = newCursorPresence(t.meta, broadcastCursorFunc(t.Cache, t.Sess.ID))
+	defer t.cursor.Stop()
 
 	parser := t.Service.GetFilterParser(t.Sess)
 	userInputMessageChan := make(chan *session.Message, 1)
@@ -161,18 +431,39 @@ func (t *Connection) Run(ctx *gin.Context) (err error) {
 		Created: common.NewNowUTCTime().String(),
 	}
 	exit := make(chan error, 2)
+	detachChan := make(chan clientDetach, 2)
 	activeChan := make(chan struct{})
 	noNopTime := time.Now()
 	maxNopTimeout := time.Minute * 5
 	var requiredErr guacd.Instruction
+	var screenFeed *screenFeeder
+	if t.screen != nil {
+		screenFeed = newScreenFeeder(t.screen)
+	}
 	go func(t *Connection) {
+		if screenFeed != nil {
+			defer screenFeed.Close()
+		}
+		if t.rewind != nil {
+			defer t.rewind.Close()
+		}
 		for {
-			instruction, err := t.readTunnelInstruction()
+			instruction, err := t.readTunnelInstruction(t.guacdTunnel)
 			if err != nil {
 				logger.Errorf("Session[%s] guacamole server read err: %+v", t, err)
 				exit <- err
 				break
 			}
+			if screenFeed != nil {
+				screenFeed.Feed(instruction)
+			}
+			if t.rewind != nil {
+				t.rewind.Write(instruction)
+			}
+			if !t.isDisplayTunnel(t.guacdTunnel) {
+				t.keepTunnelAlive(t.guacdTunnel, instruction)
+				continue
+			}
 
 			switch instruction.Opcode {
 			case guacd.InstructionServerDisconnect,
@@ -192,7 +483,7 @@ func (t *Connection) Run(ctx *gin.Context) (err error) {
 					if requiredErr.Opcode != "" {
 						logger.Errorf("Session[%s] send guacamole server required err: %s", t,
 							requiredErr.String())
-						_ = t.writeWsMessage([]byte(requiredErr.String()))
+						_ = t.SendWsMessage(requiredErr)
 						requiredErr = guacd.Instruction{}
 						continue
 					}
@@ -204,31 +495,70 @@ func (t *Connection) Run(ctx *gin.Context) (err error) {
 				requiredErr = guacd.NewInstruction(guacd.InstructionServerError, msg)
 				logger.Errorf("Session[%s] send guacamole server required err: %s", t,
 					requiredErr.String())
-				_ = t.writeWsMessage([]byte(requiredErr.String()))
+				_ = t.SendWsMessage(requiredErr)
 				continue
 			default:
 				noNopTime = time.Now()
 			}
 
-			if err = t.writeWsMessage([]byte(instruction.String())); err != nil {
+			if err = t.wsBatch.WriteInstruction(instruction); err != nil {
 				logger.Errorf("Session[%s] send web client err: %+v", t, err)
-				exit <- err
-				break
+				if ws := t.currentWs(); ws != nil {
+					_ = ws.Close()
+				}
 			}
 		}
-		_ = t.ws.Close()
+		if ws := t.currentWs(); ws != nil {
+			_ = ws.Close()
+		}
 	}(t)
 
-	go func(t *Connection) {
+	relayDisplayTunnel := func(tunnel *guacd.Tunnel, ws ClientConn) {
+		for {
+			instruction, err1 := t.readTunnelInstruction(tunnel)
+			if err1 != nil {
+				logger.Errorf("Session[%s] guacamole display tunnel read err: %+v", t, err1)
+				select {
+				case detachChan <- clientDetach{ws: ws, err: err1}:
+				case <-t.done:
+				}
+				break
+			}
+			if !t.isDisplayTunnel(tunnel) {
+				t.keepTunnelAlive(tunnel, instruction)
+				continue
+			}
+			switch instruction.Opcode {
+			case guacd.InstructionServerDisconnect,
+				guacd.InstructionServerError:
+				logger.Infof("Session[%s] receive guacamole display tunnel disconnect: %s",
+					t, instruction.String())
+			case guacd.InstructionStreamingAck:
+				select {
+				case activeChan <- struct{}{}:
+				default:
+				}
+			}
+			if err1 = t.wsBatch.WriteInstruction(instruction); err1 != nil {
+				logger.Errorf("Session[%s] send web client err: %+v", t, err1)
+				_ = ws.Close()
+			}
+		}
+	}
+
+	readClient := func(ws ClientConn) {
 		for {
-			_, message, err1 := t.ws.ReadMessage()
+			_, message, err1 := ws.ReadMessage()
 			if err1 != nil {
 				if websocket.IsCloseError(err1, websocket.CloseNoStatusReceived) {
 					logger.Warnf("Session[%s] web client read err: %+v", t, err1)
 				} else {
 					logger.Errorf("Session[%s] web client read err: %+v", t, err1)
 				}
-				exit <- err1
+				select {
+				case detachChan <- clientDetach{ws: ws, err: err1}:
+				case <-t.done:
+				}
 				break
 			}
 
@@ -240,13 +570,24 @@ func (t *Connection) Run(ctx *gin.Context) (err error) {
 					}
 					continue
 				}
+				if ret.Opcode == InstructionControl {
+					t.handleControlInstruction(&ret)
+					continue
+				}
+				if ret.Opcode == InstructionChat {
+					t.sendChat(&ret)
+					continue
+				}
+				if ret.Opcode == InstructionKnock {
+					t.handleKnockInstruction(&ret)
+					continue
+				}
+				if ret.Opcode == guacd.InstructionMouse {
+					t.cursor.Move(&ret)
+				}
 
-				if t.lockedStatus.Load() {
-					switch ret.Opcode {
-					case guacd.InstructionClientSync,
-						guacd.InstructionClientNop,
-						guacd.InstructionStreamingAck:
-					default:
+				if t.isInputLocked() {
+					if !isPassiveInput(ret.Opcode) {
 						select {
 						case activeChan <- struct{}{}:
 						default:
@@ -258,12 +599,19 @@ func (t *Connection) Run(ctx *gin.Context) (err error) {
 					_, err4 := t.writeTunnelMessage(message)
 					if err4 != nil {
 						logger.Errorf("Session[%s] guacamole server write err: %+v", t, err2)
-						exit <- err4
+						select {
+						case exit <- err4:
+						case <-t.done:
+						}
 						break
 					}
 					logger.Debugf("Session[%s] send guacamole server message when locked status", t)
 					continue
 				}
+				if !t.controlAllowed(ret.Opcode) {
+					logger.Debugf("Session[%s] drop input without control opcode[%s]", t, ret.Opcode)
+					continue
+				}
 
 				switch ret.Opcode {
 				case guacd.InstructionKey:
@@ -286,23 +634,30 @@ func (t *Connection) Run(ctx *gin.Context) (err error) {
 					guacd.InstructionStreamingAck:
 				case guacd.InstructionClientDisconnect:
 					logger.Infof("Session[%s] receive web client disconnect opcode", t)
+					t.clientClosed.Store(true)
 				default:
 					select {
 					case activeChan <- struct{}{}:
 					default:
 					}
 				}
+				t.recordInput(&ret)
 			} else {
 				logger.Errorf("Session[%s] parse instruction err %s", t, err)
 			}
 			_, err = t.writeTunnelMessage(message)
 			if err != nil {
 				logger.Errorf("Session[%s] guacamole server write err: %+v", t, err)
-				exit <- err
+				select {
+				case exit <- err:
+				case <-t.done:
+				}
 				break
 			}
 		}
-	}(t)
+	}
+	go readClient(t.currentWs())
+
 	maxIndexTime := t.Sess.TerminalConfig.MaxIdleTime
 	maxSessionTimeInt := t.Sess.TerminalConfig.MaxSessionTime
 	maxSessionDuration := time.Duration(maxSessionTimeInt) * time.Hour
@@ -312,11 +667,14 @@ func (t *Connection) Run(ctx *gin.Context) (err error) {
 	defer activeDetectTicker.Stop()
 	latestActive := time.Now()
 
+	grace := reattachGrace{duration: time.Duration(config.GlobalConfig.ReattachGraceTime) * time.Second}
+	defer grace.Stop()
+	// 正在连接 guacd 的重连请求，连接期间继续计时，超时后会话结束
+	var dialing *reattachRequest
+	dialResults := make(chan reattachResult)
+
 	for {
 		select {
-		case event := <-eventChan.eventCh:
-			go t.handleEvent(event)
-			continue
 		case err = <-exit:
 			logger.Infof("Session[%s] Connection exit %+v", t, err)
 			if !t.recordStatus.Load() {
@@ -324,8 +682,72 @@ func (t *Connection) Run(ctx *gin.Context) (err error) {
 				t.Service.RecordLifecycleLog(t.Sess.ID, model.AssetConnectFinished, reason)
 			}
 			return err
+		case err = <-t.recordFailed:
+			t.terminateByRecorder(err)
+			return err
+		case detach := <-detachChan:
+			if !t.detachClient(detach.ws) {
+				continue
+			}
+			if t.clientClosed.Load() || t.recordStatus.Load() || !grace.Start() {
+				logger.Infof("Session[%s] Connection exit %+v", t, detach.err)
+				if !t.recordStatus.Load() {
+					reason := model.SessionLifecycleLog{Reason: string(model.ReasonErrConnectDisconnect)}
+					t.Service.RecordLifecycleLog(t.Sess.ID, model.AssetConnectFinished, reason)
+				}
+				return detach.err
+			}
+			logger.Warnf("Session[%s] web client detached: %+v, wait %s for reattach",
+				t, detach.err, grace.duration)
+			logObj := model.SessionLifecycleLog{User: t.Sess.User.String(), Reason: reasonClientDetached}
+			t.Service.RecordLifecycleLog(t.Sess.ID, model.UserLeaveSession, logObj)
+		case <-grace.C:
+			logger.Errorf("Session[%s] no web client reattach in %s", t, grace.duration)
+			reason := model.SessionLifecycleLog{Reason: string(model.ReasonErrConnectDisconnect)}
+			t.Service.RecordLifecycleLog(t.Sess.ID, model.AssetConnectFinished, reason)
+			return ErrClientDetached
+		case req := <-t.reattachChan:
+			if dialing != nil || t.currentWs() != nil {
+				req.finish(ErrClientAttached)
+				continue
+			}
+			dialing = req
+			go t.dialDisplayTunnel(req, dialResults)
+		case res := <-dialResults:
+			dialing = nil
+			req := res.req
+			if err1 := t.attachClient(res); err1 != nil {
+				logger.Errorf("Session[%s] web client reattach err: %+v", t, err1)
+				req.finish(err1)
+				continue
+			}
+			grace.Stop()
+			if err1 := t.sendAttachedMessage(metaJsonStr); err1 != nil {
+				logger.Errorf("Session[%s] send reattached message err: %+v", t, err1)
+			}
+			if t.lockedStatus.Load() {
+				p, _ := json.Marshal(map[string]interface{}{"user": t.operatorUser.Load()})
+				_ = t.SendWsMessage(NewJmsEventInstruction("session_pause", string(p)))
+			}
+			if t.recordBroken.Load() {
+				p, _ := json.Marshal(map[string]interface{}{"user": replayRecorderOperator})
+				_ = t.SendWsMessage(NewJmsEventInstruction("session_pause", string(p)))
+			}
+			_ = t.SendWsMessage(t.controlStateInstruction())
+			_ = t.SendWsMessage(t.takeoverStateInstruction())
+			_ = t.SendWsMessage(t.chatHistoryInstruction())
+			for _, inst := range t.pendingKnockInstructions() {
+				_ = t.SendWsMessage(inst)
+			}
+			logger.Infof("Session[%s] web client reattached", t)
+			logObj := model.SessionLifecycleLog{User: t.Sess.User.String(), Reason: reasonClientReattached}
+			t.Service.RecordLifecycleLog(t.Sess.ID, model.UserJoinSession, logObj)
+			go readClient(req.ws)
+			go relayDisplayTunnel(t.currentDisplayTunnel(), req.ws)
 		case <-ctx.Request.Context().Done():
-			_ = t.ws.Close()
+			if ws := t.currentWs(); ws != nil {
+				_ = ws.Close()
+			}
 			_ = t.guacdTunnel.Close()
 			reason := model.SessionLifecycleLog{Reason: string(model.ReasonErrConnectDisconnect)}
 			t.Service.RecordLifecycleLog(t.Sess.ID, model.AssetConnectFinished, reason)
@@ -367,8 +789,13 @@ func (t *Connection) Run(ctx *gin.Context) (err error) {
 func (t *Connection) HandleTask(task *model.TerminalTask) error {
 	switch task.Name {
 	case model.TaskUnlockSession:
+		if t.forceReleaseTakeover(task.Kwargs.CreatedByUser) {
+			logger.Infof("Session[%s] takeover released by unlock task", t)
+			break
+		}
 		t.lockedStatus.Store(false)
 		t.operatorUser.Store(task.Kwargs.CreatedByUser)
+		t.recordMarker(NewReplayMarker(MarkerSessionUnlock, task.Kwargs.CreatedByUser, ""))
 		data := map[string]interface{}{
 			"user": task.Kwargs.CreatedByUser,
 		}
@@ -377,8 +804,13 @@ func (t *Connection) HandleTask(task *model.TerminalTask) error {
 		_ = t.SendWsMessage(ins)
 		t.notifySessionAction(ShareSessionResume, task.Kwargs.CreatedByUser)
 	case model.TaskLockSession:
+		if t.setTakeoverLocked(true) {
+			logger.Infof("Session[%s] taken over, keep locked after release", t)
+			break
+		}
 		t.lockedStatus.Store(true)
 		t.operatorUser.Store(task.Kwargs.CreatedByUser)
+		t.recordMarker(NewReplayMarker(MarkerSessionLock, task.Kwargs.CreatedByUser, ""))
 		data := map[string]interface{}{
 			"user": task.Kwargs.CreatedByUser,
 		}
@@ -389,6 +821,7 @@ func (t *Connection) HandleTask(task *model.TerminalTask) error {
 	case model.TaskKillSession:
 		t.recordStatus.Store(true)
 		username := task.Kwargs.TerminatedBy
+		t.recordMarker(NewReplayMarker(MarkerSessionTerminate, username, ""))
 		ins := NewJMSGuacamoleError(1005, username)
 		_ = t.SendWsMessage(ins.Instruction())
 		reason := model.SessionLifecycleLog{Reason: string(model.ReasonErrAdminTerminate)}
@@ -470,6 +903,7 @@ func (t *Connection) recordCommand(cmdRecordChan chan *session.ExecutedCommand)
 		}
 		cmd := t.generateCommandResult(item)
 		cmdRecorder.Record(cmd)
+		t.recordMarker(NewReplayMarker(MarkerCommand, cmd.User, cmd.Input))
 	}
 	// 关闭命令记录
 	cmdRecorder.End()
@@ -491,6 +925,18 @@ func (t *Connection) generateCommandResult(item *session.ExecutedCommand) *model
 	return t.Service.GenerateCommandItem(t.Sess, user, input, output, item)
 }
 
+// handleEvents 按照会话事件的顺序处理，会话结束回收 eventChan 后退出
+func (t *Connection) handleEvents(eventChan *EventChan) {
+	for event := range eventChan.eventCh {
+		// 分享用户的输入需要按照顺序写入录像
+		if event.Type == ShareInputEvent {
+			t.recordShareInput(event)
+			continue
+		}
+		t.handleEvent(event)
+	}
+}
+
 func (t *Connection) handleEvent(eventMsg *Event) {
 	logger.Debugf("Session[%s] handle event: %s", t, eventMsg.Type)
 	switch eventMsg.Type {
@@ -505,10 +951,12 @@ func (t *Connection) handleEvent(eventMsg *Event) {
 		t.currentOnlineUsers[key] = meta
 		t.traceLock.Unlock()
 		defer t.notifyShareUsers()
+		defer t.notifyControl("", controlSync)
 		if t.meta.ShareId == meta.ShareId {
 			logger.Info("Ignore self join event")
 			return
 		}
+		t.recordMarker(NewReplayMarker(MarkerShareJoin, meta.User, ""))
 		if t.lockedStatus.Load() {
 			user := t.operatorUser.Load().(string)
 			defer t.notifySessionAction(ShareSessionPause, user)
@@ -524,7 +972,51 @@ func (t *Connection) handleEvent(eventMsg *Event) {
 		delete(t.currentOnlineUsers, key)
 		t.traceLock.Unlock()
 		defer t.notifyShareUsers()
+		if t.meta.ShareId != meta.ShareId {
+			t.recordMarker(NewReplayMarker(MarkerShareExit, meta.User, ""))
+			t.applyControl(ControlAction{Action: controlExit, Operator: meta})
+		}
 	case ShareUsers:
+	case ReplayMarkerEvent:
+		t.recordMarkerEvent(eventMsg)
+		return
+	case ControlActionEvent:
+		var action ControlAction
+		if err := json.Unmarshal(eventMsg.Data, &action); err != nil {
+			logger.Errorf("Session[%s] unmarshal control action err: %s", t, err)
+			return
+		}
+		t.applyControl(action)
+		return
+	case CursorMoveEvent:
+		if isSelfCursor(eventMsg, t.meta) {
+			return
+		}
+	case ChatMessageEvent:
+		t.recordChat(eventMsg)
+	case SessionTakeoverActionEvent:
+		t.handleTakeoverAction(eventMsg)
+		return
+	case ShareKnockEvent:
+		t.addKnock(eventMsg)
+	case ShareKnockReplyEvent:
+		t.removeKnock(eventMsg)
+	case SessionResyncEvent:
+		t.resyncPresence()
+		return
+	case SessionSnapshotRequestEvent:
+		t.replySnapshot(eventMsg)
+		return
+	case SharePresenceEvent:
+		t.handlePresence(eventMsg)
+		return
+	case SessionSnapshotEvent, SharePresenceRequestEvent:
+		return
+	case ChatHistoryRequestEvent:
+		t.replyChatHistory(eventMsg)
+		return
+	case ChatHistoryEvent:
+		return
 	case ShareRemoveUser,
 		ShareSessionPause,
 		ShareSessionResume:
@@ -559,6 +1051,7 @@ func (t *Connection) PermBecomeExpired(code, detail string) {
 	}
 	t.invalidPermTime = time.Now()
 	t.invalidPerm.Store(true)
+	t.recordMarker(NewReplayMarker(MarkerPermExpired, "", detail))
 	p, _ := json.Marshal(map[string]string{"code": code, "detail": detail})
 	t.invalidPermData = p
 	t.Cache.BroadcastSessionEvent(t.Sess.ID,
@@ -571,6 +1064,7 @@ func (t *Connection) PermBecomeValid(code, detail string) {
 	}
 	t.invalidPermTime = time.Now()
 	t.invalidPerm.Store(false)
+	t.recordMarker(NewReplayMarker(MarkerPermValid, "", detail))
 	p, _ := json.Marshal(map[string]string{"code": code, "detail": detail})
 	t.invalidPermData = p
 	t.Cache.BroadcastSessionEvent(t.Sess.ID,
@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"lion/pkg/guacd"
+)
+
+// startFakeGuacd 完成 guacd 的握手，依次返回 uuid-1、uuid-2 ... 作为连接 id
+func startFakeGuacd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for i := 1; ; i++ {
+			conn, err1 := ln.Accept()
+			if err1 != nil {
+				return
+			}
+			go fakeGuacdHandshake(conn, "uuid-"+strconv.Itoa(i))
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func fakeGuacdHandshake(conn net.Conn, uuid string) {
+	reader := bufio.NewReader(conn)
+	for {
+		inst, err := ReadInstruction(reader)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		var reply guacd.Instruction
+		switch inst.Opcode {
+		case "select":
+			reply = guacd.NewInstruction("args", guacd.Version)
+		case "connect":
+			reply = guacd.NewInstruction("ready", uuid)
+		default:
+			continue
+		}
+		if _, err = conn.Write([]byte(reply.String())); err != nil {
+			return
+		}
+	}
+}
+
+func newReattachConnection(t *testing.T) *Connection {
+	t.Helper()
+	addr := startFakeGuacd(t)
+	guacdTunnel, err := guacd.NewTunnel(addr, guacd.NewConfiguration(), guacd.ClientInformation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = guacdTunnel.Close() })
+	return &Connection{
+		guacdTunnel:  guacdTunnel,
+		guacdAddr:    addr,
+		wsBatch:      &wsBatchWriter{},
+		reattachChan: make(chan *reattachRequest),
+		done:         make(chan struct{}),
+	}
+}
+
+func TestConnectionReattach(t *testing.T) {
+	conn := newReattachConnection(t)
+	results := make(chan reattachResult)
+	ws := &recordWsConn{}
+	req := &reattachRequest{ws: ws, done: make(chan error, 1)}
+	go conn.dialDisplayTunnel(req, results)
+
+	var res reattachResult
+	select {
+	case res = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial display tunnel timeout")
+	}
+	if err := conn.attachClient(res); err != nil {
+		t.Fatal(err)
+	}
+	if conn.currentWs() != ws || conn.currentDisplayTunnel() != res.tunnel {
+		t.Fatal("web client not attached to the display tunnel")
+	}
+	if !conn.isDisplayTunnel(res.tunnel) || conn.isDisplayTunnel(conn.guacdTunnel) {
+		t.Fatal("unexpected display tunnel")
+	}
+
+	// 已经有 web client 时新的 tunnel 会被关闭
+	other := &reattachRequest{ws: &recordWsConn{}, done: make(chan error, 1)}
+	go conn.dialDisplayTunnel(other, results)
+	res2 := <-results
+	if err := conn.attachClient(res2); !errors.Is(err, ErrClientAttached) {
+		t.Fatalf("attach second client err %v, want %v", err, ErrClientAttached)
+	}
+	if res2.tunnel.IsOpen {
+		t.Fatal("rejected display tunnel not closed")
+	}
+
+	// 断开后恢复使用原始的 tunnel，Reattach 返回
+	if conn.detachClient(&recordWsConn{}) {
+		t.Fatal("detach unknown web client")
+	}
+	if !conn.detachClient(ws) {
+		t.Fatal("detach current web client failed")
+	}
+	if err := <-req.done; err != nil {
+		t.Fatalf("reattach finished with %v", err)
+	}
+	if conn.currentWs() != nil || conn.currentDisplayTunnel() != conn.guacdTunnel {
+		t.Fatal("display tunnel not released")
+	}
+	if res.tunnel.IsOpen {
+		t.Fatal("display tunnel not closed")
+	}
+}
+
+func TestConnectionReattachSessionClosed(t *testing.T) {
+	conn := newReattachConnection(t)
+	close(conn.done)
+
+	// 会话结束后完成的连接不再交给 Run 的循环
+	req := &reattachRequest{ws: &recordWsConn{}, done: make(chan error, 1)}
+	conn.dialDisplayTunnel(req, make(chan reattachResult))
+	if err := <-req.done; !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("dial after session closed err %v, want %v", err, ErrSessionClosed)
+	}
+
+	err := conn.Reattach(context.Background(), &recordWsConn{}, guacd.ClientInformation{})
+	if !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("Reattach err %v, want %v", err, ErrSessionClosed)
+	}
+}
+
+func TestReattachGrace(t *testing.T) {
+	disabled := reattachGrace{}
+	if disabled.Start() || disabled.C != nil {
+		t.Fatal("grace started without duration")
+	}
+
+	grace := reattachGrace{duration: 20 * time.Millisecond}
+	if !grace.Start() {
+		t.Fatal("grace not started")
+	}
+	select {
+	case <-grace.C:
+	case <-time.After(time.Second):
+		t.Fatal("grace timer not fired")
+	}
+
+	// 重连成功后停止计时
+	grace.Start()
+	grace.Stop()
+	if grace.C != nil {
+		t.Fatal("grace channel not cleared")
+	}
+	select {
+	case <-grace.C:
+		t.Fatal("stopped grace fired")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,226 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	远程控制权
+
+	同一时间只有一个参与者(主用户或可写的分享用户)持有控制权，默认由主用户持有。
+	没有控制权的参与者和锁定状态一样，只转发 sync、nop 和 ack(passiveInputOpcodes)，其他指令都丢弃。参与者使用 record_id 区分，主用户没有 record_id，使用 share_id。
+	web client 发送控制指令:
+		control,request             请求控制权，通知持有者和主用户
+		control,grant,<participant> 持有者或主用户将控制权交给其他可写的参与者
+		control,revoke              主用户收回控制权
+		control,release             持有者放弃控制权，交还给主用户
+	分享用户的指令通过会话事件转发给主用户的 Connection 处理，结果广播给所有参与者:
+		jms_event,control_request,{"holder":..,"user":..}
+		jms_event,control_changed,{"holder":..,"user":..,"operator":..,"action":..}
+	每次交接和会话聊天一样记录到会话的命令审计(用户为操作者)，同时记录录像标记，持有者退出会话时控制权交还给主用户:
+		# control: <action>: <holder> -> <next>
+	同一个参与者 controlRequestInterval 内只广播一次控制权请求。
+*/
+
+const (
+	InstructionControl = "control"
+
+	ControlActionEvent  = "control_action"
+	ControlRequestEvent = "control_request"
+	ControlChangedEvent = "control_changed"
+
+	ControlRequest = "request"
+	ControlGrant   = "grant"
+	ControlRevoke  = "revoke"
+	ControlRelease = "release"
+
+	// 持有者退出会话，以及新的参与者加入时同步当前的持有者
+	controlExit = "exit"
+	controlSync = "sync"
+)
+
+const (
+	controlCommandFormat = "# control: %s"
+
+	controlRequestInterval = 5 * time.Second
+)
+
+// 没有控制权(或写权限)时允许转发给 guacd 的指令，和锁定状态相同
+var passiveInputOpcodes = map[string]struct{}{
+	guacd.InstructionClientSync:   {},
+	guacd.InstructionClientNop:    {},
+	guacd.InstructionStreamingAck: {},
+}
+
+func isPassiveInput(opcode string) bool {
+	_, ok := passiveInputOpcodes[opcode]
+	return ok
+}
+
+// controlAllowed 主用户没有控制权时仍然可以断开会话，INPUT_ACTIVE 不转发给 guacd
+func (t *Connection) controlAllowed(opcode string) bool {
+	if !t.controlLost.Load() || isPassiveInput(opcode) {
+		return true
+	}
+	return opcode == guacd.InstructionClientDisconnect || opcode == "INPUT_ACTIVE"
+}
+
+type ControlAction struct {
+	Action   string               `json:"action"`
+	Target   string               `json:"target,omitempty"`
+	Operator MetaShareUserMessage `json:"operator"`
+}
+
+type ControlState struct {
+	Holder   string `json:"holder"`
+	User     string `json:"user"`
+	Operator string `json:"operator,omitempty"`
+	Action   string `json:"action,omitempty"`
+}
+
+func parseControlAction(inst *guacd.Instruction, operator MetaShareUserMessage) ControlAction {
+	action := ControlAction{Operator: operator}
+	if len(inst.Args) > 0 {
+		action.Action = inst.Args[0]
+	}
+	if len(inst.Args) > 1 {
+		action.Target = inst.Args[1]
+	}
+	return action
+}
+
+func (t *Connection) handleControlInstruction(inst *guacd.Instruction) {
+	t.applyControl(parseControlAction(inst, *t.meta))
+}
+
+// applyControl 只在主用户的 Connection 中处理，校验操作者的权限后更新持有者
+func (t *Connection) applyControl(action ControlAction) {
+	operator := action.Operator
+	t.controlLock.Lock()
+	holder := t.currentControlHolder()
+	isOwner := operator.ParticipantId() == t.meta.ParticipantId()
+	isHolder := operator.ParticipantId() == holder.ParticipantId()
+	var (
+		next MetaShareUserMessage
+		ok   bool
+	)
+	switch action.Action {
+	case ControlRequest:
+		limited := t.controlRequestLimited(operator.ParticipantId())
+		t.controlLock.Unlock()
+		if isHolder || !operator.Writable || limited {
+			logger.Infof("Session[%s] drop control request of %s", t, operator.User)
+			return
+		}
+		logger.Infof("Session[%s] user %s request control from %s", t, operator.User, holder.User)
+		p, _ := json.Marshal(ControlState{Holder: operator.ParticipantId(), User: operator.User})
+		t.Cache.BroadcastSessionEvent(t.Sess.ID, &Event{Type: ControlRequestEvent, Data: p})
+		return
+	case ControlGrant:
+		if isOwner || isHolder {
+			next, ok = t.findOnlineUser(action.Target)
+			ok = ok && next.Writable
+		}
+	case ControlRevoke:
+		next, ok = *t.meta, isOwner
+	case ControlRelease, controlExit:
+		next, ok = *t.meta, isHolder
+	}
+	if !ok || next.ParticipantId() == holder.ParticipantId() {
+		t.controlLock.Unlock()
+		if action.Action != controlExit {
+			logger.Infof("Session[%s] ignore control %s of %s, target: %s",
+				t, action.Action, operator.User, action.Target)
+		}
+		return
+	}
+	t.controlHolder = next
+	t.controlLost.Store(next.ParticipantId() != t.meta.ParticipantId())
+	t.controlLock.Unlock()
+
+	logger.Infof("Session[%s] control %s by %s: %s -> %s",
+		t, action.Action, operator.User, holder.User, next.User)
+	detail := fmt.Sprintf("%s: %s -> %s", action.Action, holder.User, next.User)
+	t.recordMarker(NewReplayMarker(MarkerControlHandoff, operator.User, detail))
+	t.auditSessionAction(operator.User, fmt.Sprintf(controlCommandFormat, detail))
+	t.notifyControl(operator.User, action.Action)
+}
+
+// controlRequestLimited 需要持有 controlLock，参与者在 controlRequestInterval 内重复请求时返回 true
+func (t *Connection) controlRequestLimited(participantId string) bool {
+	now := time.Now()
+	if last, ok := t.controlRequests[participantId]; ok && now.Sub(last) < controlRequestInterval {
+		return true
+	}
+	if t.controlRequests == nil {
+		t.controlRequests = make(map[string]time.Time)
+	}
+	for id, last := range t.controlRequests {
+		if now.Sub(last) >= controlRequestInterval {
+			delete(t.controlRequests, id)
+		}
+	}
+	t.controlRequests[participantId] = now
+	return false
+}
+
+// currentControlHolder 需要持有 controlLock
+func (t *Connection) currentControlHolder() MetaShareUserMessage {
+	if t.controlHolder.ParticipantId() == "" {
+		return *t.meta
+	}
+	return t.controlHolder
+}
+
+func (t *Connection) findOnlineUser(participantId string) (MetaShareUserMessage, bool) {
+	t.traceLock.Lock()
+	defer t.traceLock.Unlock()
+	for _, meta := range t.currentOnlineUsers {
+		if meta.ParticipantId() == participantId {
+			return meta, true
+		}
+	}
+	return MetaShareUserMessage{}, false
+}
+
+func (t *Connection) controlState(operator, action string) ControlState {
+	t.controlLock.Lock()
+	holder := t.currentControlHolder()
+	t.controlLock.Unlock()
+	return ControlState{
+		Holder:   holder.ParticipantId(),
+		User:     holder.User,
+		Operator: operator,
+		Action:   action,
+	}
+}
+
+func (t *Connection) notifyControl(operator, action string) {
+	p, _ := json.Marshal(t.controlState(operator, action))
+	t.Cache.BroadcastSessionEvent(t.Sess.ID, &Event{Type: ControlChangedEvent, Data: p})
+}
+
+func (t *Connection) controlStateInstruction() guacd.Instruction {
+	p, _ := json.Marshal(t.controlState("", controlSync))
+	return NewJmsEventInstruction(ControlChangedEvent, string(p))
+}
+
+// sendControlAction 分享用户的控制指令转发给主用户的 Connection
+func (m *MonitorCon) sendControlAction(inst *guacd.Instruction) {
+	p, _ := json.Marshal(parseControlAction(inst, *m.Meta))
+	m.Service.Cache.BroadcastSessionEvent(m.Id, &Event{Type: ControlActionEvent, Data: p})
+}
+
+func (m *MonitorCon) updateControl(eventMsg *Event) {
+	var state ControlState
+	if err := json.Unmarshal(eventMsg.Data, &state); err != nil {
+		logger.Errorf("Monitor[%s] invalid control event: %s", m.Id, eventMsg.Data)
+		return
+	}
+	m.hasControl.Store(state.Holder == m.Meta.ParticipantId())
+}
@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	协作光标
+
+	主用户和分享用户的 mouse 指令除了(持有控制权时)驱动远程鼠标，还会以会话事件广播光标位置，
+	每个参与者最多每 cursorMoveInterval 广播一次，停止移动后补发最后的位置:
+		jms_event,cursor_move,{"id":<participant>,"user":..,"x":..,"y":..}
+	参与者不会收到自己的光标事件，参与者退出(share_exit)后 web client 移除对应的光标。
+*/
+
+const (
+	CursorMoveEvent = "cursor_move"
+
+	cursorMoveInterval = 100 * time.Millisecond
+)
+
+type CursorPosition struct {
+	Id   string `json:"id"`
+	User string `json:"user"`
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+}
+
+type cursorPresence struct {
+	lock     sync.Mutex
+	pos      CursorPosition
+	lastSent time.Time
+	timer    *time.Timer
+	stopped  bool
+
+	send func(pos CursorPosition)
+}
+
+func newCursorPresence(meta *MetaShareUserMessage, send func(pos CursorPosition)) *cursorPresence {
+	return &cursorPresence{
+		pos:  CursorPosition{Id: meta.ParticipantId(), User: meta.User},
+		send: send,
+	}
+}
+
+// Move 记录 mouse 指令的位置，距离上次广播不足 cursorMoveInterval 时延迟发送
+func (c *cursorPresence) Move(inst *guacd.Instruction) {
+	if len(inst.Args) < 2 {
+		return
+	}
+	x, err1 := strconv.Atoi(inst.Args[0])
+	y, err2 := strconv.Atoi(inst.Args[1])
+	if err1 != nil || err2 != nil {
+		return
+	}
+	c.lock.Lock()
+	if c.stopped || (c.pos.X == x && c.pos.Y == y && !c.lastSent.IsZero()) {
+		c.lock.Unlock()
+		return
+	}
+	c.pos.X, c.pos.Y = x, y
+	if c.timer != nil {
+		c.lock.Unlock()
+		return
+	}
+	wait := cursorMoveInterval - time.Since(c.lastSent)
+	if wait > 0 {
+		c.timer = time.AfterFunc(wait, c.flush)
+		c.lock.Unlock()
+		return
+	}
+	c.lastSent = time.Now()
+	pos := c.pos
+	c.lock.Unlock()
+	c.send(pos)
+}
+
+func (c *cursorPresence) flush() {
+	c.lock.Lock()
+	c.timer = nil
+	if c.stopped {
+		c.lock.Unlock()
+		return
+	}
+	c.lastSent = time.Now()
+	pos := c.pos
+	c.lock.Unlock()
+	c.send(pos)
+}
+
+func (c *cursorPresence) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopped = true
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+func broadcastCursorFunc(cache GuaTunnelCache, sid string) func(pos CursorPosition) {
+	return func(pos CursorPosition) {
+		p, _ := json.Marshal(pos)
+		cache.BroadcastSessionEvent(sid, &Event{Type: CursorMoveEvent, Data: p})
+	}
+}
+
+// isSelfCursor 参与者自己的光标事件不需要发送给 web client
+func isSelfCursor(eventMsg *Event, meta *MetaShareUserMessage) bool {
+	var pos CursorPosition
+	if err := json.Unmarshal(eventMsg.Data, &pos); err != nil {
+		logger.Errorf("Invalid cursor event: %s", eventMsg.Data)
+		return true
+	}
+	return pos.Id == meta.ParticipantId()
+}
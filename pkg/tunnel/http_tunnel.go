@@ -0,0 +1,347 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/jumpserver-dev/sdk-go/common"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/config"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	Guacamole HTTP tunnel 协议
+	POST ?connect          body 为连接参数 (同 websocket 的 query)，返回 tunnel uuid
+	GET  ?read:UUID:N      持续返回 instruction，下一个 read 请求到达后以 "0.;" 结束
+	POST ?write:UUID       body 为若干 instruction
+*/
+
+const (
+	httpTunnelConnect     = "connect"
+	httpTunnelReadPrefix  = "read:"
+	httpTunnelWritePrefix = "write:"
+
+	httpTunnelTokenHeader   = "Guacamole-Tunnel-Token"
+	httpTunnelStatusHeader  = "Guacamole-Status-Code"
+	httpTunnelMessageHeader = "Guacamole-Error-Message"
+
+	httpTunnelEndInstruction = "0.;"
+)
+
+const (
+	httpTunnelMessageBufferSize = 1024
+
+	// 没有 read 请求的最长时间，超时认为 web client 已经断开
+	httpTunnelIdleTimeout = 15 * time.Second
+)
+
+var (
+	ErrHttpTunnelClosed   = errors.New("http tunnel closed")
+	ErrHttpTunnelOverflow = errors.New("http tunnel output buffer full")
+)
+
+var httpTunnels = httpTunnelManager{tunnels: make(map[string]*HttpTunnelConn)}
+
+type httpTunnelManager struct {
+	sync.Mutex
+	tunnels map[string]*HttpTunnelConn
+}
+
+func (m *httpTunnelManager) Add(t *HttpTunnelConn) {
+	m.Lock()
+	defer m.Unlock()
+	m.tunnels[t.uuid] = t
+}
+
+func (m *httpTunnelManager) Get(uuid string) *HttpTunnelConn {
+	m.Lock()
+	defer m.Unlock()
+	return m.tunnels[uuid]
+}
+
+func (m *httpTunnelManager) Delete(t *HttpTunnelConn) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.tunnels, t.uuid)
+}
+
+func NewHttpTunnelConn(userId string) *HttpTunnelConn {
+	conn := &HttpTunnelConn{
+		uuid:    common.UUID(),
+		token:   common.UUID(),
+		userId:  userId,
+		outChan: make(chan []byte, httpTunnelMessageBufferSize),
+		inChan:  make(chan []byte, httpTunnelMessageBufferSize),
+		done:    make(chan struct{}),
+	}
+	conn.lastActive.Store(time.Now().UnixNano())
+	return conn
+}
+
+// HttpTunnelConn 使用 http 长轮询实现的 ClientConn
+type HttpTunnelConn struct {
+	uuid   string
+	token  string
+	userId string
+
+	outChan chan []byte
+	inChan  chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	readLock   sync.Mutex
+	readerLock sync.Mutex
+	readerStop chan struct{}
+
+	streaming  atomic.Bool
+	lastActive atomic.Int64
+}
+
+func (h *HttpTunnelConn) String() string {
+	return h.uuid
+}
+
+func (h *HttpTunnelConn) ReadMessage() (messageType int, p []byte, err error) {
+	select {
+	case p = <-h.inChan:
+		return websocket.TextMessage, p, nil
+	case <-h.done:
+		return 0, nil, ErrHttpTunnelClosed
+	}
+}
+
+// WriteMessage 不阻塞会话的转发，web client 没有及时读取导致缓冲区满时关闭 tunnel，
+// 丢弃部分指令会破坏画面，不能只丢弃消息
+func (h *HttpTunnelConn) WriteMessage(messageType int, data []byte) error {
+	p := make([]byte, len(data))
+	copy(p, data)
+	select {
+	case <-h.done:
+		return ErrHttpTunnelClosed
+	default:
+	}
+	select {
+	case h.outChan <- p:
+		return nil
+	default:
+		logger.Errorf("Http tunnel %s output buffer full (%d messages), close it", h, cap(h.outChan))
+		_ = h.Close()
+		return ErrHttpTunnelOverflow
+	}
+}
+
+func (h *HttpTunnelConn) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.done)
+		httpTunnels.Delete(h)
+	})
+	return nil
+}
+
+func (h *HttpTunnelConn) active() {
+	h.lastActive.Store(time.Now().UnixNano())
+}
+
+func (h *HttpTunnelConn) isIdleTimeout(now time.Time) bool {
+	if h.streaming.Load() {
+		return false
+	}
+	return now.Sub(time.Unix(0, h.lastActive.Load())) > httpTunnelIdleTimeout
+}
+
+func (h *HttpTunnelConn) run() {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			if h.isIdleTimeout(now) {
+				logger.Errorf("Http tunnel %s no read request in %s, close it",
+					h, httpTunnelIdleTimeout)
+				_ = h.Close()
+				return
+			}
+		}
+	}
+}
+
+// nextReader 通知之前的 read 请求结束，返回当前 read 请求的结束信号
+func (h *HttpTunnelConn) nextReader() chan struct{} {
+	h.readerLock.Lock()
+	defer h.readerLock.Unlock()
+	if h.readerStop != nil {
+		close(h.readerStop)
+	}
+	stop := make(chan struct{})
+	h.readerStop = stop
+	return stop
+}
+
+func (h *HttpTunnelConn) stream(ctx *gin.Context) {
+	stop := h.nextReader()
+	h.readLock.Lock()
+	defer h.readLock.Unlock()
+	h.streaming.Store(true)
+	defer func() {
+		h.active()
+		h.streaming.Store(false)
+	}()
+	ctx.Header("Content-Type", "application/octet-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Status(http.StatusOK)
+	w := ctx.Writer
+	write := func(p []byte) bool {
+		if _, err := w.Write(p); err != nil {
+			logger.Errorf("Http tunnel %s write response err: %+v", h, err)
+			return false
+		}
+		if len(h.outChan) == 0 {
+			w.Flush()
+		}
+		return true
+	}
+	for {
+		select {
+		case p := <-h.outChan:
+			if !write(p) {
+				return
+			}
+		case <-stop:
+			_, _ = w.WriteString(httpTunnelEndInstruction)
+			w.Flush()
+			return
+		case <-h.done:
+			for {
+				select {
+				case p := <-h.outChan:
+					if !write(p) {
+						return
+					}
+				default:
+					w.Flush()
+					return
+				}
+			}
+		case <-ctx.Request.Context().Done():
+			return
+		}
+	}
+}
+
+func (h *HttpTunnelConn) receive(body io.Reader) error {
+	h.active()
+	reader := bufio.NewReader(body)
+	for {
+		instruction, err := ReadInstruction(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		select {
+		case h.inChan <- []byte(instruction.String()):
+		case <-h.done:
+			return ErrHttpTunnelClosed
+		}
+	}
+}
+
+func httpTunnelError(ctx *gin.Context, status guacd.GuacamoleStatus, msg string) {
+	ctx.Header(httpTunnelStatusHeader, strconv.Itoa(status.GuaCode))
+	ctx.Header(httpTunnelMessageHeader, msg)
+	ctx.AbortWithStatus(status.HttpCode)
+}
+
+func (g *GuacamoleTunnelServer) HttpTunnel(ctx *gin.Context) {
+	query := ctx.Request.URL.RawQuery
+	switch {
+	case query == httpTunnelConnect:
+		g.httpTunnelConnect(ctx)
+	case strings.HasPrefix(query, httpTunnelReadPrefix):
+		tid := strings.SplitN(strings.TrimPrefix(query, httpTunnelReadPrefix), ":", 2)[0]
+		if conn := g.getHttpTunnelConn(ctx, tid); conn != nil {
+			conn.stream(ctx)
+		}
+	case strings.HasPrefix(query, httpTunnelWritePrefix):
+		tid := strings.TrimPrefix(query, httpTunnelWritePrefix)
+		if conn := g.getHttpTunnelConn(ctx, tid); conn != nil {
+			if err := conn.receive(ctx.Request.Body); err != nil {
+				logger.Errorf("Http tunnel %s receive err: %+v", conn, err)
+				httpTunnelError(ctx, guacd.StatusResourceClosed, err.Error())
+				return
+			}
+			ctx.Status(http.StatusOK)
+		}
+	default:
+		httpTunnelError(ctx, guacd.StatusClientBadRequest, "Invalid tunnel operation")
+	}
+}
+
+func (g *GuacamoleTunnelServer) getHttpTunnelConn(ctx *gin.Context, tid string) *HttpTunnelConn {
+	conn := httpTunnels.Get(tid)
+	if conn == nil {
+		httpTunnelError(ctx, guacd.StatusResourceNotFound, "No such tunnel")
+		return nil
+	}
+	if token := ctx.GetHeader(httpTunnelTokenHeader); token != conn.token {
+		logger.Errorf("Http tunnel %s invalid tunnel token", conn)
+		httpTunnelError(ctx, guacd.StatusResourceNotFound, "No such tunnel")
+		return nil
+	}
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok || userItem.(*model.User).ID != conn.userId {
+		logger.Errorf("Http tunnel %s invalid auth user", conn)
+		httpTunnelError(ctx, guacd.StatusClientForbidden, "Not auth user")
+		return nil
+	}
+	return conn
+}
+
+func (g *GuacamoleTunnelServer) httpTunnelConnect(ctx *gin.Context) {
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok {
+		logger.Error("No auth user found")
+		httpTunnelError(ctx, guacd.StatusClientUnauthorized, "Not auth user")
+		return
+	}
+	user := userItem.(*model.User)
+	data, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		logger.Errorf("Http tunnel read connect data err: %+v", err)
+		httpTunnelError(ctx, guacd.StatusClientBadRequest, err.Error())
+		return
+	}
+	conn := NewHttpTunnelConn(user.ID)
+	httpTunnels.Add(conn)
+	go conn.run()
+
+	// 会话的生命周期与 connect 请求无关，连接参数与 websocket 的 query 一致
+	sessCtx := ctx.Copy()
+	sessCtx.Request = ctx.Request.Clone(context.Background())
+	sessCtx.Request.URL.RawQuery = string(data)
+	go func() {
+		defer conn.Close()
+		g.connect(sessCtx, conn)
+		logger.Infof("Http tunnel %s finished", conn)
+	}()
+	logger.Infof("User %s create http tunnel %s", user, conn)
+	ctx.Header(httpTunnelTokenHeader, conn.token)
+	ctx.String(http.StatusOK, conn.uuid)
+}
@@ -3,6 +3,7 @@ package tunnel
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -12,6 +13,7 @@ import (
 	"lion/pkg/guacd"
 	"lion/pkg/logger"
 
+	"github.com/jumpserver-dev/sdk-go/common"
 	"github.com/jumpserver-dev/sdk-go/model"
 )
 
@@ -19,19 +21,45 @@ type MonitorCon struct {
 	Id          string
 	guacdTunnel Tunneler
 
-	ws *websocket.Conn
+	ws ClientConn
 
 	wsLock    sync.Mutex
 	guacdLock sync.Mutex
+	wsBatch   *wsBatchWriter
 
 	Service *GuacamoleTunnelServer
 	User    *model.User
 	Meta    *MetaShareUserMessage
 
 	lockedStatus atomic.Bool
+
+	// 分享用户是否持有控制权
+	hasControl atomic.Bool
+
+	// 监控用户是否是接管会话的管理员，takeoverOwned 为在当前监控页面接管
+	takeoverHolder atomic.Bool
+	takeoverOwned  atomic.Bool
+
+	// 监控用户默认只读，接管期间统计管理员的输入
+	readOnlyNotified atomic.Bool
+	adminInputs      atomic.Int64
+
+	// 区分同一会话的不同订阅者，用于请求聊天历史消息和会话状态的快照
+	subscriberId string
+	chatSender   chatSender
+
+	// 分享用户广播光标位置
+	cursor *cursorPresence
+
+	// 可写的分享用户，输入记录到录像中
+	inputAnnotator *inputAnnotator
+
+	// 回看画面最后一帧的时间戳
+	rewindEndTime int64
 }
 
 func (m *MonitorCon) SendWsMessage(msg guacd.Instruction) error {
+	_ = m.wsBatch.Flush()
 	return m.writeWsMessage([]byte(msg.String()))
 }
 
@@ -51,16 +79,12 @@ func (m *MonitorCon) writeTunnelMessage(p []byte) (int, error) {
 	defer m.guacdLock.Unlock()
 	return m.guacdTunnel.WriteAndFlush(p)
 }
-func (m *MonitorCon) readTunnelInstruction() (*guacd.Instruction, error) {
-	instruction, err := m.guacdTunnel.ReadInstruction()
-	if err != nil {
-		return nil, err
-	}
-	return &instruction, nil
-}
 
 func (m *MonitorCon) Run(ctx context.Context) (err error) {
+	defer m.wsBatch.Reset()
 	retChan := m.Service.Cache.GetSessionEventChan(m.Id)
+	defer m.Service.Cache.RecycleSessionEventChannel(m.Id, retChan)
+	m.subscriberId = common.UUID()
 	if m.Meta != nil {
 		var jsonBuilder strings.Builder
 		_ = json.NewEncoder(&jsonBuilder).Encode(m.Meta)
@@ -72,24 +96,37 @@ func (m *MonitorCon) Run(ctx context.Context) (err error) {
 		defer func() {
 			m.Service.Cache.BroadcastSessionEvent(m.Id, &Event{Type: ShareExit, Data: eventData})
 		}()
+		m.cursor = newCursorPresence(m.Meta, broadcastCursorFunc(m.Service.Cache, m.Id))
+		defer m.cursor.Stop()
+	} else {
+		defer m.releaseTakeover()
 	}
+	m.requestSnapshot()
+	m.chatSender = chatSender{User: m.User.String(), UserId: m.User.ID, Role: ChatRoleMonitor}
+	if m.Meta != nil {
+		m.chatSender.Role = ChatRoleShare
+	}
+	m.requestChatHistory()
 
 	exit := make(chan error, 2)
+	// 会话在其他节点时，由 redis 代理所在节点的 ViewerStream 回复 guacd 的 sync
+	ackSync := func(ins *guacd.Instruction) error {
+		return m.WriteTunnelMessage(*ins)
+	}
+	if _, ok := m.guacdTunnel.(*RedisConn); ok {
+		ackSync = nil
+	}
+	viewer := NewViewerStream(common.UUID(), m.Id, m.User.String(), m.guacdTunnel, ackSync)
 	go func(t *MonitorCon) {
-		for {
-			instruction, err1 := t.readTunnelInstruction()
-			if err1 != nil {
-				_ = t.writeWsMessage([]byte(ErrDisconnect.String()))
-				logger.Infof("Monitor[%s] guacd tunnel read err: %+v", t.Id, err1)
-				exit <- err1
-				break
-			}
-			if err2 := t.writeWsMessage([]byte(instruction.String())); err2 != nil {
-				logger.Error(err2)
-				exit <- err2
-				break
-			}
+		err1 := viewer.Run(t.wsBatch.WriteInstruction)
+		if errors.Is(err1, ErrViewerQueueOverflow) {
+			logger.Errorf("Monitor[%s] viewer %s too slow and disconnect", t.Id, viewer)
+			_ = t.SendWsMessage(ErrViewerTooSlow.Instruction())
+		} else {
+			logger.Infof("Monitor[%s] viewer %s exit: %+v", t.Id, viewer, err1)
+			_ = t.SendWsMessage(ErrDisconnect.Instruction())
 		}
+		exit <- err1
 		_ = t.ws.Close()
 	}(m)
 
@@ -109,12 +146,31 @@ func (m *MonitorCon) Run(ctx context.Context) (err error) {
 					}
 					continue
 				}
+				if t.isRewindSync(&ret) {
+					continue
+				}
+				// guacd 的 sync 已经由 lion 回复
+				if ret.Opcode == guacd.InstructionClientSync {
+					viewer.ClientAck(&ret)
+					continue
+				}
+				if t.Meta != nil && ret.Opcode == InstructionControl {
+					t.sendControlAction(&ret)
+					continue
+				}
+				if t.Meta == nil && ret.Opcode == InstructionTakeover {
+					t.handleTakeoverInstruction(&ret)
+					continue
+				}
+				if ret.Opcode == InstructionChat {
+					t.sendChat(&ret)
+					continue
+				}
+				if t.cursor != nil && ret.Opcode == guacd.InstructionMouse {
+					t.cursor.Move(&ret)
+				}
 				if t.lockedStatus.Load() {
-					switch ret.Opcode {
-					case guacd.InstructionClientSync,
-						guacd.InstructionClientNop,
-						guacd.InstructionStreamingAck:
-					default:
+					if !isPassiveInput(ret.Opcode) {
 						logger.Infof("Session[%s] in locked status drop receive web client message opcode[%s]",
 							t.Id, ret.Opcode)
 						continue
@@ -128,6 +184,14 @@ func (m *MonitorCon) Run(ctx context.Context) (err error) {
 					logger.Debugf("Session[%s] send guacamole server message when locked status", t.Id)
 					continue
 				}
+				if t.Meta != nil && !t.hasControl.Load() && !isPassiveInput(ret.Opcode) {
+					logger.Debugf("Monitor[%s] drop input without control opcode[%s]", t.Id, ret.Opcode)
+					continue
+				}
+				if t.dropReadOnlyInput(&ret) {
+					continue
+				}
+				t.recordInput(&ret)
 			} else {
 				logger.Errorf("Monitor[%s] parse instruction err %s", t.Id, err2)
 			}
@@ -150,12 +214,12 @@ func (m *MonitorCon) Run(ctx context.Context) (err error) {
 			logger.Infof("Monitor[%s] done", m.Id)
 			return nil
 		case event := <-retChan.eventCh:
-			if m.Meta == nil {
+			if m.Meta == nil && !isMonitorEvent(event.Type) {
 				logger.Debugf("Monitor[%s] do not need to handle event", m.Id)
 				continue
 			}
-			go m.handleEvent(event)
-			logger.Debugf("Monitor[%s] handle event: %s", m.Id, event.Type)
+			// 按照会话事件的顺序处理
+			m.handleEvent(event)
 		}
 	}
 }
@@ -192,6 +256,39 @@ func (m *MonitorCon) handleEvent(eventMsg *Event) {
 		inst = NewJmsEventInstruction(eventMsg.Type, string(eventMsg.Data))
 		locked := eventMsg.Type == ShareSessionPause
 		m.lockedStatus.Store(locked)
+	case ControlChangedEvent:
+		m.updateControl(eventMsg)
+		inst = NewJmsEventInstruction(eventMsg.Type, string(eventMsg.Data))
+	case SessionTakeoverEvent:
+		var state TakeoverState
+		if err := json.Unmarshal(eventMsg.Data, &state); err != nil {
+			logger.Errorf("Monitor[%s] invalid takeover event: %s", m.Id, eventMsg.Data)
+			return
+		}
+		m.updateTakeover(state)
+		inst = NewJmsEventInstruction(eventMsg.Type, string(eventMsg.Data))
+	case ControlRequestEvent, ChatMessageEvent:
+		inst = NewJmsEventInstruction(eventMsg.Type, string(eventMsg.Data))
+	case CursorMoveEvent:
+		if isSelfCursor(eventMsg, m.Meta) {
+			return
+		}
+		inst = NewJmsEventInstruction(eventMsg.Type, string(eventMsg.Data))
+	case SessionResyncEvent:
+		logger.Warnf("Monitor[%s] lost session events, request snapshot", m.Id)
+		m.requestSnapshot()
+		return
+	case SessionSnapshotEvent:
+		m.applySnapshot(eventMsg)
+		return
+	case SharePresenceRequestEvent:
+		m.reportPresence()
+		return
+	case ChatHistoryEvent:
+		var ok bool
+		if inst, ok = m.chatHistoryInstruction(eventMsg); !ok {
+			return
+		}
 	default:
 		return
 	}
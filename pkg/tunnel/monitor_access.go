@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	监控用户默认只读
+
+	监控用户和锁定状态一样只转发 sync、nop 和 ack(passiveInputOpcodes)，其他指令在服务端丢弃，
+	第一次丢弃时通知 web client:
+		jms_event,monitor_read_only,{"user":..}
+	只有接管会话(session_takeover)的管理员可以输入，在监控页面或者 REST API 接管时
+	需要 core 的监控会话权限(见 session_permission.go)。
+	接管期间管理员的输入以管理员的 user id 写入录像(jms_input)，释放或退出时记录输入的数量。
+*/
+
+const (
+	MonitorReadOnlyEvent = "monitor_read_only"
+)
+
+// validateWritePermission 接管前向 core 校验监控会话的权限
+func (g *GuacamoleTunnelServer) validateWritePermission(userId, sessionId string) error {
+	result, err := g.JmsService.ValidateJoinSessionPermission(userId, sessionId)
+	if err != nil {
+		return err
+	}
+	if !result.Ok {
+		return errors.New(result.Msg)
+	}
+	return nil
+}
+
+// dropReadOnlyInput 没有接管会话的监控用户只转发 sync、nop 和 ack
+func (m *MonitorCon) dropReadOnlyInput(inst *guacd.Instruction) bool {
+	if m.Meta != nil || isPassiveInput(inst.Opcode) {
+		return false
+	}
+	if m.takeoverHolder.Load() {
+		m.adminInputs.Add(1)
+		return false
+	}
+	if m.readOnlyNotified.CompareAndSwap(false, true) {
+		logger.Infof("Monitor[%s] user %s is read only, drop input opcode[%s]", m.Id, m.User, inst.Opcode)
+		p, _ := json.Marshal(map[string]interface{}{"user": m.User.String()})
+		_ = m.SendWsMessage(NewJmsEventInstruction(MonitorReadOnlyEvent, string(p)))
+	}
+	logger.Debugf("Monitor[%s] drop read only input opcode[%s]", m.Id, inst.Opcode)
+	return true
+}
+
+// logAdminInputs 接管结束时记录管理员输入的数量
+func (m *MonitorCon) logAdminInputs() {
+	if count := m.adminInputs.Swap(0); count > 0 {
+		logger.Infof("Monitor[%s] admin %s sent %d inputs during takeover", m.Id, m.User, count)
+	}
+}
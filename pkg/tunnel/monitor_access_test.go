@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/guacd"
+)
+
+type recordWsConn struct {
+	messages []string
+}
+
+func (c *recordWsConn) ReadMessage() (int, []byte, error) {
+	return 0, nil, errors.New("closed")
+}
+
+func (c *recordWsConn) WriteMessage(_ int, data []byte) error {
+	c.messages = append(c.messages, string(data))
+	return nil
+}
+
+func (c *recordWsConn) Close() error {
+	return nil
+}
+
+func TestDropReadOnlyInput(t *testing.T) {
+	ws := &recordWsConn{}
+	m := &MonitorCon{
+		Id:      "e32248ce-2dc8-43c8-b37e-a61d5ee32176",
+		User:    &model.User{ID: "1", Name: "admin", Username: "admin"},
+		ws:      ws,
+		wsBatch: &wsBatchWriter{},
+	}
+	tests := []struct {
+		inst guacd.Instruction
+		drop bool
+	}{
+		{guacd.NewInstruction(guacd.InstructionKey, "97", "1"), true},
+		{guacd.NewInstruction(guacd.InstructionMouse, "10", "10", "1"), true},
+		{guacd.NewInstruction(guacd.InstructionSize, "1024", "768"), true},
+		{guacd.NewInstruction(guacd.InstructionStreamingClipboard, "1", "text/plain"), true},
+		{guacd.NewInstruction(guacd.InstructionClientSync, "1000"), false},
+		{guacd.NewInstruction(guacd.InstructionStreamingAck, "1", "OK", "0"), false},
+		{guacd.NewInstruction(guacd.InstructionClientNop), false},
+	}
+	for _, tt := range tests {
+		if got := m.dropReadOnlyInput(&tt.inst); got != tt.drop {
+			t.Errorf("dropReadOnlyInput(%s) = %t, want %t", tt.inst.Opcode, got, tt.drop)
+		}
+	}
+	// 只通知一次只读状态
+	if len(ws.messages) != 1 || !strings.Contains(ws.messages[0], MonitorReadOnlyEvent) {
+		t.Fatalf("unexpected ws messages %q", ws.messages)
+	}
+
+	// 接管会话的管理员可以输入
+	m.takeoverHolder.Store(true)
+	key := guacd.NewInstruction(guacd.InstructionKey, "97", "1")
+	if m.dropReadOnlyInput(&key) {
+		t.Fatal("takeover holder input dropped")
+	}
+	if m.adminInputs.Load() != 1 {
+		t.Fatalf("admin inputs %d, want 1", m.adminInputs.Load())
+	}
+}
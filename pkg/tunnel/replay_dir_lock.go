@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"lion/pkg/logger"
+)
+
+/*
+	会话目录的进程锁
+
+	lion 在录像和上传期间持有会话目录下的 {sid}.lock，内容为进程的 pid 和启动时间，
+	同一个进程内可以重复获取，最后一次释放时删除锁文件。
+	其他 lion 进程(离线的 upload 命令、启动时上传遗留录像)在锁被存活的进程持有时不处理该目录；
+	进程异常退出遗留的锁在 pid 不存在(或者是当前进程的 pid，但启动时间不同)时重新获取。
+*/
+
+const LockSuffix = ".lock"
+
+var ErrSessionDirLocked = errors.New("session dir is locked by another lion process")
+
+var processStartTime = time.Now().UnixNano()
+
+var sessionDirLocks = dirLockManager{refs: make(map[string]int)}
+
+type dirLockOwner struct {
+	Pid   int   `json:"pid"`
+	Start int64 `json:"start"`
+}
+
+func (o dirLockOwner) isSelf() bool {
+	return o.Pid == os.Getpid() && o.Start == processStartTime
+}
+
+// alive pid 存在的进程，当前进程的 pid 但启动时间不同说明是容器重启前遗留的锁
+func (o dirLockOwner) alive() bool {
+	if o.Pid == os.Getpid() {
+		return o.isSelf()
+	}
+	p, err := os.FindProcess(o.Pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || !(errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH))
+}
+
+type dirLockManager struct {
+	sync.Mutex
+	refs map[string]int
+}
+
+func sessionLockPath(rootPath, sessionId string) string {
+	return filepath.Join(rootPath, sessionId+LockSuffix)
+}
+
+// LockSessionDir 获取会话目录的锁，被其他存活的进程持有时返回 ErrSessionDirLocked
+func LockSessionDir(rootPath, sessionId string) error {
+	return sessionDirLocks.Acquire(sessionLockPath(rootPath, sessionId))
+}
+
+func UnlockSessionDir(rootPath, sessionId string) {
+	if rootPath == "" {
+		return
+	}
+	sessionDirLocks.Release(sessionLockPath(rootPath, sessionId))
+}
+
+func (m *dirLockManager) Acquire(path string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.refs[path] > 0 {
+		m.refs[path]++
+		return nil
+	}
+	owner := dirLockOwner{Pid: os.Getpid(), Start: processStartTime}
+	buf, _ := json.Marshal(owner)
+	for i := 0; i < 2; i++ {
+		fd, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = fd.Write(buf)
+			if err1 := fd.Close(); err == nil {
+				err = err1
+			}
+			if err != nil {
+				_ = os.Remove(path)
+				return err
+			}
+			m.refs[path] = 1
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		var holder dirLockOwner
+		if content, err1 := os.ReadFile(path); err1 == nil {
+			_ = json.Unmarshal(content, &holder)
+		}
+		if holder.Pid > 0 && holder.alive() {
+			return fmt.Errorf("%w: pid %d (%s)", ErrSessionDirLocked, holder.Pid, path)
+		}
+		logger.Warnf("Remove stale session dir lock %s of pid %d", path, holder.Pid)
+		_ = os.Remove(path)
+	}
+	return fmt.Errorf("%w: %s", ErrSessionDirLocked, path)
+}
+
+func (m *dirLockManager) Release(path string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.refs[path] == 0 {
+		return
+	}
+	if m.refs[path]--; m.refs[path] > 0 {
+		return
+	}
+	delete(m.refs, path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Remove session dir lock %s error: %v", path, err)
+	}
+}
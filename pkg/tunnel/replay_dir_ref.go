@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"os"
+	"sync"
+
+	"lion/pkg/logger"
+)
+
+/*
+	会话录像目录的引用
+
+	录像的导出和回放读取本地的 part 文件，上传完成后 PartUploader 会删除会话目录。
+	导出任务和回放在查找 part 文件前引用会话目录，目录被引用时删除延迟到最后一个引用释放。
+*/
+
+var sessionDirRefs = dirRefManager{
+	refs:    make(map[string]int),
+	pending: make(map[string]bool),
+}
+
+type dirRefManager struct {
+	sync.Mutex
+	refs map[string]int
+	// 被引用期间请求删除的目录
+	pending map[string]bool
+}
+
+func (m *dirRefManager) Acquire(dir string) {
+	m.Lock()
+	defer m.Unlock()
+	m.refs[dir]++
+}
+
+func (m *dirRefManager) Release(dir string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.refs[dir]--; m.refs[dir] > 0 {
+		return
+	}
+	delete(m.refs, dir)
+	if m.pending[dir] {
+		delete(m.pending, dir)
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Errorf("Remove released session dir %s error: %v", dir, err)
+			return
+		}
+		logger.Infof("Remove released session dir %s success", dir)
+	}
+}
+
+// RemoveAll 目录没有被引用时直接删除，否则在释放后删除
+func (m *dirRefManager) RemoveAll(dir string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.refs[dir] > 0 {
+		m.pending[dir] = true
+		logger.Infof("Session dir %s in use, remove after released", dir)
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
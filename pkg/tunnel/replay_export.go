@@ -0,0 +1,399 @@
+package tunnel
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"lion/pkg/display"
+	"lion/pkg/guacd"
+)
+
+/*
+	不依赖 guacenc 和视频转换服务，使用 display 按照录像的时间轴渲染画面，导出为:
+		png  每 1/FPS 秒一帧的 PNG 序列(目录或 zip)，画面没有变化的帧不重复保存，
+		     frames.txt 为 ffmpeg concat 格式的帧列表和每帧的持续时间，
+		     超过最大帧数时降低帧率，PNG 的总大小超过 pngMaxBytes 时导出失败
+		gif  动图，画面没有变化的帧合并为一帧，超过最大帧数时降低帧率；
+		     gif 只能一次性编码，所有帧的像素数超过 gifMaxPixels 时导出失败
+	宽高为最大值，等比缩小，不会放大。
+*/
+
+const (
+	ExportFormatPNG = "png"
+	ExportFormatGIF = "gif"
+
+	defaultExportFPS = 2
+	maxExportFPS     = 30
+
+	defaultGIFWidth     = 1024
+	defaultGIFMaxFrames = 600
+	defaultPNGMaxFrames = 7200
+
+	// 导出的 PNG 最多 1G
+	pngMaxBytes = 1 << 30
+
+	pngFrameListName = "frames.txt"
+
+	// 编码前保存的 gif 帧(每个像素一个字节)最多占用 128M 内存
+	gifMaxPixels = 128 << 20
+)
+
+var (
+	ErrExportFormat   = errors.New("unsupported export format")
+	ErrNoExportFrames = errors.New("no frame rendered")
+	ErrExportTooLarge = errors.New("export too large, reduce width, height or max_frames")
+)
+
+type ExportOptions struct {
+	Format string `json:"format"`
+	FPS    int    `json:"fps"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// 最大帧数，超过时降低帧率；png 默认 7200 帧，gif 默认 600 帧
+	MaxFrames int `json:"max_frames"`
+}
+
+func (o *ExportOptions) Normalize() error {
+	if o.Format == "" {
+		o.Format = ExportFormatPNG
+	}
+	switch o.Format {
+	case ExportFormatPNG, ExportFormatGIF:
+	default:
+		return fmt.Errorf("%w: %s", ErrExportFormat, o.Format)
+	}
+	if o.FPS <= 0 {
+		o.FPS = defaultExportFPS
+	}
+	if o.FPS > maxExportFPS {
+		o.FPS = maxExportFPS
+	}
+	if o.Format == ExportFormatGIF {
+		if o.Width <= 0 && o.Height <= 0 {
+			o.Width = defaultGIFWidth
+		}
+		if o.MaxFrames <= 0 {
+			o.MaxFrames = defaultGIFMaxFrames
+		}
+	}
+	if o.MaxFrames <= 0 {
+		o.MaxFrames = defaultPNGMaxFrames
+	}
+	return nil
+}
+
+func (o *ExportOptions) scale(img *image.RGBA) *image.RGBA {
+	width, height := o.Width, o.Height
+	if width <= 0 && height <= 0 {
+		return img
+	}
+	if width <= 0 {
+		width = math.MaxInt32
+	}
+	if height <= 0 {
+		height = math.MaxInt32
+	}
+	return display.Scale(img, width, height)
+}
+
+type ExportProgress struct {
+	// 已经渲染到的位置和总时长，单位毫秒
+	Position int64 `json:"position"`
+	Duration int64 `json:"duration"`
+	Frames   int   `json:"frames"`
+}
+
+func (p ExportProgress) Percent() int {
+	if p.Duration <= 0 {
+		return 0
+	}
+	percent := int(p.Position * 100 / p.Duration)
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+// ExportReplayToDir png 格式写入 output/frame_000001.png...，gif 格式写入 output 文件
+func ExportReplayToDir(ctx context.Context, files []string, opts ExportOptions, output string,
+	progress func(ExportProgress)) (ExportProgress, error) {
+	if err := opts.Normalize(); err != nil {
+		return ExportProgress{}, err
+	}
+	if opts.Format == ExportFormatGIF {
+		fd, err := os.Create(output)
+		if err != nil {
+			return ExportProgress{}, err
+		}
+		stat, err := exportReplay(ctx, files, opts, newGIFFrameSink(fd), progress)
+		if err1 := fd.Close(); err == nil {
+			err = err1
+		}
+		return stat, err
+	}
+	if err := os.MkdirAll(output, os.ModePerm); err != nil {
+		return ExportProgress{}, err
+	}
+	sink := pngFrameSink{maxBytes: pngMaxBytes, save: func(name string, data []byte) error {
+		return os.WriteFile(filepath.Join(output, name), data, os.ModePerm)
+	}}
+	return exportReplay(ctx, files, opts, &sink, progress)
+}
+
+// ExportReplayToWriter png 格式写入 zip，gif 格式直接写入 w
+func ExportReplayToWriter(ctx context.Context, files []string, opts ExportOptions, w io.Writer,
+	progress func(ExportProgress)) (ExportProgress, error) {
+	if err := opts.Normalize(); err != nil {
+		return ExportProgress{}, err
+	}
+	if opts.Format == ExportFormatGIF {
+		return exportReplay(ctx, files, opts, newGIFFrameSink(w), progress)
+	}
+	zipWriter := zip.NewWriter(w)
+	sink := pngFrameSink{
+		maxBytes: pngMaxBytes,
+		save: func(name string, data []byte) error {
+			fw, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+			if err != nil {
+				return err
+			}
+			_, err = fw.Write(data)
+			return err
+		},
+		close: zipWriter.Close,
+	}
+	return exportReplay(ctx, files, opts, &sink, progress)
+}
+
+type frameSink interface {
+	// WriteFrame changed 为 false 时画面和上一帧相同，duration 为该帧持续的毫秒数
+	WriteFrame(img *image.RGBA, changed bool, duration int64) error
+	Close() error
+}
+
+// exportReplay 按照 part 的顺序处理绘制指令，每遇到 sync 输出该时间点之前的所有帧
+func exportReplay(ctx context.Context, files []string, opts ExportOptions, sink frameSink,
+	progress func(ExportProgress)) (ExportProgress, error) {
+	startTime, endTime := replayTimeRange(files)
+	stat := ExportProgress{Duration: endTime - startTime}
+	interval := int64(1000 / opts.FPS)
+	if stat.Duration/interval >= int64(opts.MaxFrames) {
+		interval = stat.Duration/int64(opts.MaxFrames) + 1
+	}
+	d := display.New()
+	var (
+		nextFrame    int64
+		frame        *image.RGBA
+		frameVersion uint64
+	)
+	for _, file := range files {
+		reader, err := openPartFile(file)
+		if err != nil {
+			return stat, fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+		bufReader := bufio.NewReader(reader)
+		for {
+			inst, err1 := ReadInstruction(bufReader)
+			if err1 != nil {
+				// 中断的 part 最后一条指令可能不完整
+				break
+			}
+			if inst.Opcode != guacd.InstructionClientSync {
+				d.Process(&inst)
+				continue
+			}
+			if len(inst.Args) == 0 {
+				continue
+			}
+			syncTime := int64(atoi(inst.Args[0]))
+			if startTime == 0 {
+				startTime = syncTime
+			}
+			if nextFrame == 0 {
+				nextFrame = syncTime
+			}
+			for ; nextFrame <= syncTime; nextFrame += interval {
+				if width, height := d.Size(); width == 0 || height == 0 {
+					continue
+				}
+				changed := frame == nil || d.Version() != frameVersion
+				if changed {
+					frameVersion = d.Version()
+					frame = opts.scale(d.Snapshot())
+				}
+				if err = sink.WriteFrame(frame, changed, interval); err != nil {
+					_ = reader.Close()
+					return stat, err
+				}
+				stat.Frames++
+			}
+			stat.Position = syncTime - startTime
+			if progress != nil {
+				progress(stat)
+			}
+			if err = ctx.Err(); err != nil {
+				_ = reader.Close()
+				return stat, err
+			}
+		}
+		_ = reader.Close()
+	}
+	if stat.Frames == 0 {
+		return stat, ErrNoExportFrames
+	}
+	stat.Position = stat.Duration
+	return stat, sink.Close()
+}
+
+// replayTimeRange 从 part 的 meta 中获取录像的开始和结束时间
+func replayTimeRange(files []string) (startTime, endTime int64) {
+	for _, file := range files {
+		meta, err := readPartFileMeta(file)
+		if err != nil {
+			continue
+		}
+		if meta.StartTime != 0 && (startTime == 0 || meta.StartTime < startTime) {
+			startTime = meta.StartTime
+		}
+		if meta.EndTime > endTime {
+			endTime = meta.EndTime
+		}
+	}
+	return startTime, endTime
+}
+
+// readPartFileMeta 读取 part 的 meta 文件，不存在时(从 core 下载的 part)读取 part 文件
+func readPartFileMeta(file string) (PartMeta, error) {
+	name := partBaseName(file)
+	meta, err := readPartMetaFile(filepath.Join(filepath.Dir(file), name+MetaSuffix))
+	if err != nil {
+		return loadPartMeta(file)
+	}
+	return meta, nil
+}
+
+// pngFrameSink 只保存画面变化的帧，帧列表和持续时间在 Close 时写入 frames.txt
+type pngFrameSink struct {
+	save     func(name string, data []byte) error
+	close    func() error
+	maxBytes int64
+
+	index     int
+	written   int64
+	names     []string
+	durations []int64
+}
+
+func (s *pngFrameSink) WriteFrame(img *image.RGBA, changed bool, duration int64) error {
+	s.index++
+	if !changed && len(s.names) > 0 {
+		s.durations[len(s.durations)-1] += duration
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	if s.written+int64(buf.Len()) > s.maxBytes {
+		return fmt.Errorf("%w: more than %d bytes in %d frames", ErrExportTooLarge, s.maxBytes, len(s.names))
+	}
+	s.written += int64(buf.Len())
+	name := fmt.Sprintf("frame_%06d.png", s.index)
+	if err := s.save(name, buf.Bytes()); err != nil {
+		return err
+	}
+	s.names = append(s.names, name)
+	s.durations = append(s.durations, duration)
+	return nil
+}
+
+// Close ffmpeg -f concat -i frames.txt 可以将 PNG 序列转换为视频
+func (s *pngFrameSink) Close() error {
+	var buf bytes.Buffer
+	buf.WriteString("ffconcat version 1.0\n")
+	for i, name := range s.names {
+		fmt.Fprintf(&buf, "file '%s'\nduration %.3f\n", name, float64(s.durations[i])/1000)
+	}
+	// concat 格式最后一帧的 duration 需要重复最后一个文件才生效
+	if len(s.names) > 0 {
+		fmt.Fprintf(&buf, "file '%s'\n", s.names[len(s.names)-1])
+	}
+	if err := s.save(pngFrameListName, buf.Bytes()); err != nil {
+		return err
+	}
+	if s.close == nil {
+		return nil
+	}
+	return s.close()
+}
+
+// gifFrameSink gif 只能一次性编码，只保存画面变化的帧，总像素数不超过 maxPixels
+type gifFrameSink struct {
+	w         io.Writer
+	maxPixels int64
+
+	frames    []*image.Paletted
+	durations []int64
+	width     int
+	height    int
+	pixels    int64
+}
+
+func newGIFFrameSink(w io.Writer) *gifFrameSink {
+	return &gifFrameSink{w: w, maxPixels: gifMaxPixels}
+}
+
+func (s *gifFrameSink) WriteFrame(img *image.RGBA, changed bool, duration int64) error {
+	if !changed && len(s.frames) > 0 {
+		s.durations[len(s.durations)-1] += duration
+		return nil
+	}
+	bounds := img.Bounds()
+	pixels := int64(bounds.Dx()) * int64(bounds.Dy())
+	if s.pixels+pixels > s.maxPixels {
+		return fmt.Errorf("%w: more than %d pixels in %d frames", ErrExportTooLarge, s.maxPixels, len(s.frames))
+	}
+	s.pixels += pixels
+	paletted := image.NewPaletted(bounds, palette.Plan9)
+	draw.FloydSteinberg.Draw(paletted, bounds, img, bounds.Min)
+	s.frames = append(s.frames, paletted)
+	s.durations = append(s.durations, duration)
+	s.width = max(s.width, bounds.Dx())
+	s.height = max(s.height, bounds.Dy())
+	return nil
+}
+
+func (s *gifFrameSink) Close() error {
+	if len(s.frames) == 0 {
+		return ErrNoExportFrames
+	}
+	anim := gif.GIF{
+		Image: s.frames,
+		Delay: make([]int, len(s.frames)),
+		// 会话过程中分辨率可能变化，使用最大的宽高
+		Config: image.Config{
+			ColorModel: color.Palette(palette.Plan9),
+			Width:      s.width,
+			Height:     s.height,
+		},
+	}
+	for i, duration := range s.durations {
+		// gif 的延迟单位是 10 毫秒
+		anim.Delay[i] = max(int(duration/10), 1)
+	}
+	return gif.EncodeAll(s.w, &anim)
+}
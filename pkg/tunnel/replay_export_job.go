@@ -0,0 +1,334 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jumpserver-dev/sdk-go/common"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/config"
+	"lion/pkg/encrypt"
+	"lion/pkg/logger"
+)
+
+/*
+	已结束会话的录像导出任务，在后台渲染录像的 part 文件:
+		POST   /lion/api/sessions/:sid/replay/exports/   创建任务，参数为 ExportOptions
+		GET    /lion/api/replay/exports/:id/             查询任务状态和进度
+		GET    /lion/api/replay/exports/:id/download/    下载 gif 或 png 序列的 zip
+		DELETE /lion/api/replay/exports/:id/             取消任务并删除导出的文件
+	任务只保存在内存中，导出的文件保存在 data/exports 目录，任务结束一个小时后删除。
+	lion 节点上尚未上传(或上传失败)的录像直接读取会话目录，任务结束前引用会话目录，上传完成后会话目录在任务结束时才删除；
+	会话目录已经删除时，从 core 下载已经上传的 part 文件(见 replay_fetch.go)，任务结束时删除。
+	导出和查看录像一样需要 core 的录像(审计)权限。
+*/
+
+const (
+	ExportJobPending = "pending"
+	ExportJobRunning = "running"
+	ExportJobSuccess = "success"
+	ExportJobFailed  = "failed"
+
+	exportJobExpire  = time.Hour
+	exportMaxRunning = 2
+)
+
+var (
+	ErrExportSessionActive = errors.New("session is still active")
+	ErrExportJobNotFound   = errors.New("export job not found")
+	ErrExportJobNotReady   = errors.New("export job not finished")
+)
+
+type ExportJob struct {
+	Id           string         `json:"id"`
+	SessionId    string         `json:"session_id"`
+	Options      ExportOptions  `json:"options"`
+	Status       string         `json:"status"`
+	Progress     ExportProgress `json:"progress"`
+	Percent      int            `json:"percent"`
+	Error        string         `json:"error,omitempty"`
+	DateCreated  time.Time      `json:"date_created"`
+	DateFinished *time.Time     `json:"date_finished,omitempty"`
+
+	userId string
+	path   string
+	source exportSource
+	cancel context.CancelFunc
+}
+
+// exportSource 本地会话目录的 part 文件，或者从 core 下载的 part 文件
+type exportSource struct {
+	// 引用的会话目录，任务结束时释放
+	dir   string
+	files []string
+
+	fetch func(ctx context.Context, dst string) ([]string, error)
+}
+
+func (j *ExportJob) Filename() string {
+	if j.Options.Format == ExportFormatGIF {
+		return j.SessionId + ".gif"
+	}
+	return j.SessionId + ".frames.zip"
+}
+
+var exportJobs = exportManager{
+	jobs:  make(map[string]*ExportJob),
+	slots: make(chan struct{}, exportMaxRunning),
+}
+
+type exportManager struct {
+	sync.Mutex
+	jobs map[string]*ExportJob
+	// 限制同时渲染的任务数
+	slots chan struct{}
+}
+
+// Submit 调用前需要引用会话目录 source.dir，任务结束时释放
+func (m *exportManager) Submit(userId, sessionId string, source exportSource, opts ExportOptions) ExportJob {
+	m.cleanExpired()
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &ExportJob{
+		Id:          common.UUID(),
+		SessionId:   sessionId,
+		Options:     opts,
+		Status:      ExportJobPending,
+		DateCreated: time.Now(),
+		userId:      userId,
+		source:      source,
+		cancel:      cancel,
+	}
+	job.path = filepath.Join(config.GlobalConfig.ExportFolderPath, job.Id+filepath.Ext(job.Filename()))
+	m.Lock()
+	m.jobs[job.Id] = job
+	ret := *job
+	m.Unlock()
+	go m.run(ctx, job)
+	return ret
+}
+
+func (m *exportManager) run(ctx context.Context, job *ExportJob) {
+	if job.source.dir != "" {
+		defer sessionDirRefs.Release(job.source.dir)
+	}
+	defer job.cancel()
+	select {
+	case m.slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	defer func() { <-m.slots }()
+	m.update(job, func(job *ExportJob) { job.Status = ExportJobRunning })
+	logger.Infof("Replay export %s of session %s start: %+v", job.Id, job.SessionId, job.Options)
+	files := job.source.files
+	var err error
+	if job.source.fetch != nil {
+		fetchDir := job.path + ".parts"
+		defer os.RemoveAll(fetchDir)
+		files, err = job.source.fetch(ctx, fetchDir)
+	}
+	if err == nil {
+		err = m.render(ctx, job, files)
+	}
+	now := time.Now()
+	m.update(job, func(job *ExportJob) {
+		job.DateFinished = &now
+		if err != nil {
+			job.Status = ExportJobFailed
+			job.Error = err.Error()
+			return
+		}
+		job.Status = ExportJobSuccess
+		job.Percent = 100
+	})
+	if err != nil {
+		_ = os.Remove(job.path)
+		logger.Errorf("Replay export %s of session %s failed: %s", job.Id, job.SessionId, err)
+		return
+	}
+	logger.Infof("Replay export %s of session %s success", job.Id, job.SessionId)
+}
+
+func (m *exportManager) render(ctx context.Context, job *ExportJob, files []string) error {
+	fd, err := encrypt.CreateFile(job.path)
+	if err != nil {
+		return err
+	}
+	_, err = ExportReplayToWriter(ctx, files, job.Options, fd, func(progress ExportProgress) {
+		m.update(job, func(job *ExportJob) {
+			job.Progress = progress
+			job.Percent = progress.Percent()
+		})
+	})
+	if err1 := fd.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (m *exportManager) update(job *ExportJob, fn func(job *ExportJob)) {
+	m.Lock()
+	defer m.Unlock()
+	fn(job)
+}
+
+// Get 只返回用户自己创建的任务
+func (m *exportManager) Get(userId, id string) (ExportJob, bool) {
+	m.Lock()
+	defer m.Unlock()
+	job, ok := m.jobs[id]
+	if !ok || job.userId != userId {
+		return ExportJob{}, false
+	}
+	return *job, true
+}
+
+func (m *exportManager) Remove(userId, id string) bool {
+	m.Lock()
+	job, ok := m.jobs[id]
+	if ok && job.userId == userId {
+		delete(m.jobs, id)
+	}
+	m.Unlock()
+	if !ok || job.userId != userId {
+		return false
+	}
+	job.cancel()
+	_ = os.Remove(job.path)
+	return true
+}
+
+func (m *exportManager) cleanExpired() {
+	m.Lock()
+	defer m.Unlock()
+	for id, job := range m.jobs {
+		if job.DateFinished != nil && time.Since(*job.DateFinished) > exportJobExpire {
+			delete(m.jobs, id)
+			_ = os.Remove(job.path)
+		}
+	}
+}
+
+// CleanExportFolder 任务只保存在内存中，启动时删除上次运行遗留的导出文件
+func CleanExportFolder() {
+	exportDir := config.GlobalConfig.ExportFolderPath
+	entries, err := os.ReadDir(exportDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		_ = os.RemoveAll(filepath.Join(exportDir, entry.Name()))
+	}
+}
+
+func (g *GuacamoleTunnelServer) CreateReplayExport(ctx *gin.Context) {
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrNoAuthUser))
+		return
+	}
+	user := userItem.(*model.User)
+	sessionId := ctx.Param("sid")
+	if !common.IsUUID(sessionId) {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrNotFoundSession))
+		return
+	}
+	var opts ExportOptions
+	if err := ctx.ShouldBindJSON(&opts); err != nil && !errors.Is(err, io.EOF) {
+		logger.Errorf("Bind replay export params err: %s", err)
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(err))
+		return
+	}
+	if err := opts.Normalize(); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(err))
+		return
+	}
+	result, err := g.ValidateReplayPermission(ctx, sessionId)
+	if err != nil {
+		logger.Errorf("Validate replay session err: %s", err)
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse(err))
+		return
+	}
+	if !result.Ok {
+		logger.Errorf("Validate replay session failed : %s", result.Msg)
+		ctx.JSON(http.StatusForbidden, ErrorResponse(errors.New(result.Msg)))
+		return
+	}
+	if g.Cache.GetBySessionId(sessionId) != nil {
+		ctx.JSON(http.StatusConflict, ErrorResponse(ErrExportSessionActive))
+		return
+	}
+	dir := filepath.Join(config.GlobalConfig.SessionFolderPath, sessionId)
+	sessionDirRefs.Acquire(dir)
+	source := exportSource{dir: dir}
+	if source.files, err = SessionPartFiles(dir); err != nil || len(source.files) == 0 {
+		// 录像已经上传，从 core 下载
+		sessionDirRefs.Release(dir)
+		cookies := ctx.Request.Cookies()
+		source = exportSource{fetch: func(ctx context.Context, dst string) ([]string, error) {
+			return fetchReplayParts(ctx, cookies, sessionId, dst)
+		}}
+	}
+	job := exportJobs.Submit(user.ID, sessionId, source, opts)
+	logger.Infof("User %s create replay export %s of session %s", user, job.Id, sessionId)
+	ctx.JSON(http.StatusOK, SuccessResponse(job))
+}
+
+func (g *GuacamoleTunnelServer) getExportJob(ctx *gin.Context) (*model.User, ExportJob, bool) {
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrNoAuthUser))
+		return nil, ExportJob{}, false
+	}
+	user := userItem.(*model.User)
+	job, ok := exportJobs.Get(user.ID, ctx.Param("id"))
+	if !ok {
+		ctx.JSON(http.StatusNotFound, ErrorResponse(ErrExportJobNotFound))
+	}
+	return user, job, ok
+}
+
+func (g *GuacamoleTunnelServer) GetReplayExport(ctx *gin.Context) {
+	if _, job, ok := g.getExportJob(ctx); ok {
+		ctx.JSON(http.StatusOK, SuccessResponse(job))
+	}
+}
+
+func (g *GuacamoleTunnelServer) DownloadReplayExport(ctx *gin.Context) {
+	user, job, ok := g.getExportJob(ctx)
+	if !ok {
+		return
+	}
+	if job.Status != ExportJobSuccess {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrExportJobNotReady))
+		return
+	}
+	fd, err := encrypt.OpenFile(job.path)
+	if err != nil {
+		logger.Errorf("Open replay export %s err: %s", job.Id, err)
+		ctx.JSON(http.StatusNotFound, ErrorResponse(err))
+		return
+	}
+	defer fd.Close()
+	logger.Infof("User %s download replay export %s of session %s", user, job.Id, job.SessionId)
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job.Filename()))
+	http.ServeContent(ctx.Writer, ctx.Request, job.Filename(), *job.DateFinished, fd)
+}
+
+func (g *GuacamoleTunnelServer) DeleteReplayExport(ctx *gin.Context) {
+	user, job, ok := g.getExportJob(ctx)
+	if !ok {
+		return
+	}
+	exportJobs.Remove(user.ID, job.Id)
+	ctx.JSON(http.StatusOK, SuccessResponse(nil))
+}
@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lion/pkg/config"
+	"lion/pkg/encrypt"
+	"lion/pkg/logger"
+)
+
+/*
+	从 core 下载已经上传的录像
+
+	会话目录上传后已经删除时，导出任务以用户的 cookie 请求 core 的会话录像 API，
+	按文件名(part_filename)下载 {sid}.replay.json 和其中的 part.gz 文件，
+	校验 sha256 后保存到任务的临时目录(启用加密时加密保存)。
+	core 按照录像存储的配置(服务器、S3、OSS 等)返回文件，lion 不需要对接各种存储的下载接口，
+	也和查看录像一样由 core 校验用户的权限。
+*/
+
+const (
+	coreReplayFileURL = "/api/v1/terminal/sessions/%s/replay/?part_filename=%s"
+
+	// 单个文件的下载超时
+	replayFetchTimeout = 10 * time.Minute
+)
+
+var ErrReplayPartHash = errors.New("replay part sha256 mismatch")
+
+var replayFetchClient = &http.Client{}
+
+// fetchReplayParts 下载录像的 part 文件到 dst 目录，返回按照顺序排列的 part 文件
+func fetchReplayParts(ctx context.Context, cookies []*http.Cookie, sessionId, dst string) ([]string, error) {
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return nil, err
+	}
+	var buf strings.Builder
+	if err := downloadCoreFile(ctx, cookies, sessionId, sessionId+ReplayMetaSuffix, &buf); err != nil {
+		return nil, err
+	}
+	var replayMeta SessionReplayMeta
+	if err := json.Unmarshal([]byte(buf.String()), &replayMeta); err != nil {
+		return nil, fmt.Errorf("parse replay meta: %w", err)
+	}
+	if len(replayMeta.PartMetas) == 0 {
+		return nil, ErrNoReplayParts
+	}
+	for _, part := range replayMeta.PartMetas {
+		name := filepath.Base(part.Name)
+		if !strings.HasSuffix(name, PartSuffix+".gz") {
+			return nil, fmt.Errorf("invalid replay part name %q", part.Name)
+		}
+		if err := fetchReplayPart(ctx, cookies, sessionId, name, part.Hash, filepath.Join(dst, name)); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	logger.Infof("Fetch %d replay parts of session %s from core", len(replayMeta.PartMetas), sessionId)
+	return SessionPartFiles(dst)
+}
+
+func fetchReplayPart(ctx context.Context, cookies []*http.Cookie, sessionId, name, hash, path string) error {
+	writer, err := encrypt.CreateFile(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	err = downloadCoreFile(ctx, cookies, sessionId, name, io.MultiWriter(writer, h))
+	if err1 := writer.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if hash != "" && hex.EncodeToString(h.Sum(nil)) != hash {
+		return ErrReplayPartHash
+	}
+	return nil
+}
+
+// downloadCoreFile 以用户的 cookie 下载会话录像的文件
+func downloadCoreFile(ctx context.Context, cookies []*http.Cookie, sessionId, name string, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, replayFetchTimeout)
+	defer cancel()
+	reqURL := strings.TrimRight(config.GlobalConfig.CoreHost, "/") +
+		fmt.Sprintf(coreReplayFileURL, sessionId, url.QueryEscape(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return err
+	}
+	for i := range cookies {
+		req.AddCookie(cookies[i])
+	}
+	resp, err := replayFetchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNoReplayParts
+	default:
+		return fmt.Errorf("core session replay api status %d", resp.StatusCode)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"lion/pkg/logger"
+)
+
+/*
+	录像 join 连接异常断开后，使用新的 join 连接录制新的 part，
+	中断期间缺失的时间段记录在恢复后 part 的 meta 和 {sid}.gaps.json 中，
+	上传时汇总到 replay.json，会话结束时仍未恢复的中断也会记录。
+*/
+
+const GapsSuffix = ".gaps.json"
+
+// ReplayGap 录像缺失的时间段，时间为 guacd sync 的时间戳(毫秒)
+type ReplayGap struct {
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (g ReplayGap) Duration() int64 {
+	return g.End - g.Start
+}
+
+func (r *ReplayRecorder) addGap(gap ReplayGap) {
+	r.gaps = append(r.gaps, gap)
+	gapsPath := filepath.Join(r.RootPath, r.SessionId+GapsSuffix)
+	buf, _ := json.Marshal(r.gaps)
+	if err := os.WriteFile(gapsPath, buf, os.ModePerm); err != nil {
+		logger.Errorf("ReplayRecorder %s write gaps file failed: %v", r.SessionId, err)
+	}
+}
+
+func LoadReplayGaps(rootPath, sessionId string) []ReplayGap {
+	buf, err := os.ReadFile(filepath.Join(rootPath, sessionId+GapsSuffix))
+	if err != nil {
+		return nil
+	}
+	var gaps []ReplayGap
+	if err = json.Unmarshal(buf, &gaps); err != nil {
+		logger.Errorf("Load replay %s gaps failed: %v", sessionId, err)
+		return nil
+	}
+	return gaps
+}
@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+
+	"lion/pkg/encrypt"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	录像 part 文件的索引，录制时生成 {part}.index 文件，上传时写入 SessionReplayMeta
+
+	Points[i] 为时间 StartTime + i*Interval 之后的第一个 sync 指令，Offset 为该 sync 指令
+	结束的位置，播放器可以直接计算出下标。
+	单个绘制指令无法恢复所有图层和离屏缓冲区，part 的开始(guacd join 时发送完整的画面)和录制时生成的关键帧
+	(Keyframes，见 replay_keyframe.go)可以作为 seek 的起点，seek 时从最近的起点将指令处理到 display 中直到目标位置，
+	再发送 display 生成的关键帧。
+*/
+
+const (
+	IndexSuffix = ".index"
+
+	// 索引的时间间隔(毫秒)
+	replayIndexInterval = 1000
+)
+
+type PartIndex struct {
+	Interval  int64        `json:"interval"`
+	StartTime int64        `json:"start"`
+	Points    []IndexPoint `json:"points"`
+
+	Keyframes []KeyframePoint `json:"keyframes,omitempty"`
+}
+
+type IndexPoint struct {
+	Time   int64 `json:"t"`
+	Offset int64 `json:"o"`
+}
+
+// Lookup 返回时间 t 所在的索引点
+func (p *PartIndex) Lookup(t int64) (point IndexPoint, ok bool) {
+	if len(p.Points) == 0 || p.Interval <= 0 {
+		return point, false
+	}
+	i := int((t - p.StartTime) / p.Interval)
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(p.Points) {
+		i = len(p.Points) - 1
+	}
+	return p.Points[i], true
+}
+
+func newReplayIndexer() *replayIndexer {
+	return &replayIndexer{
+		index: PartIndex{
+			Interval: replayIndexInterval,
+			Points:   make([]IndexPoint, 0),
+		},
+	}
+}
+
+type replayIndexer struct {
+	index PartIndex
+}
+
+// Add offset 为指令在 part 文件中的开始位置，size 为指令的长度
+func (r *replayIndexer) Add(inst *guacd.Instruction, offset, size int64) {
+	if inst.Opcode != guacd.InstructionClientSync || len(inst.Args) < 1 {
+		return
+	}
+	syncTime, err := strconv.ParseInt(inst.Args[0], 10, 64)
+	if err != nil {
+		return
+	}
+	if r.index.StartTime == 0 {
+		r.index.StartTime = syncTime
+	}
+	for int64(len(r.index.Points))*r.index.Interval <= syncTime-r.index.StartTime {
+		r.index.Points = append(r.index.Points, IndexPoint{Time: syncTime, Offset: offset + size})
+	}
+}
+
+func (r *replayIndexer) Index() *PartIndex {
+	return &r.index
+}
+
+func atoi(s string) int {
+	v, _ := strconv.Atoi(s)
+	return v
+}
+
+func WritePartIndex(path string, index *PartIndex) error {
+	buf, _ := json.Marshal(index)
+	return os.WriteFile(path, buf, os.ModePerm)
+}
+
+func LoadPartIndex(path string) (*PartIndex, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var index PartIndex
+	if err = json.Unmarshal(buf, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// LoadPartIndexByFile 没有索引文件时(例如异常退出)，解析 part 文件生成索引
+func LoadPartIndexByFile(partFile string) (*PartIndex, error) {
+	fd, err := encrypt.OpenFile(partFile)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return buildPartIndex(fd)
+}
+
+func buildPartIndex(r io.Reader) (*PartIndex, error) {
+	indexer := newReplayIndexer()
+	reader := bufio.NewReader(r)
+	offset := int64(0)
+	for {
+		inst, err := ReadInstruction(reader)
+		if err != nil {
+			if err != io.EOF {
+				logger.Errorf("Build replay part index read err: %s", err)
+			}
+			break
+		}
+		size := int64(len(inst.String()))
+		indexer.Add(&inst, offset, size)
+		offset += size
+	}
+	return indexer.Index(), nil
+}
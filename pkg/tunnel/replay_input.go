@@ -0,0 +1,118 @@
+package tunnel
+
+import (
+	"strconv"
+	"time"
+
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	录像中记录用户的输入
+
+	主用户和分享用户的 key、mouse 指令以注释指令的形式写入录像:
+		jms_input,<时间戳(毫秒)>,<user id>,key,<keysym>,<pressed>
+		jms_input,<时间戳(毫秒)>,<user id>,mouse,<x>,<y>,<button mask>
+	mouse 只记录按键状态变化(点击)，不记录移动；
+	开启 REPLAY_INPUT_MASK 后可打印字符的 keysym 记录为 *，只保留功能键，避免记录密码等内容。
+	guacamole 的播放器会忽略未知的指令，播放时可以根据注释叠加显示按键和点击位置。
+	分享用户不一定连接在录像所在的节点，通过会话事件转发给主用户的 Connection 写入录像。
+	接管会话的管理员的输入总是记录，用于审计。
+*/
+
+const (
+	InstructionJmsInput = "jms_input"
+
+	ShareInputEvent = "share_input"
+
+	maskedKeysym = "*"
+)
+
+type inputAnnotator struct {
+	userId string
+	mask   bool
+
+	lastButtons string
+}
+
+func newInputAnnotator(userId string, mask bool) *inputAnnotator {
+	return &inputAnnotator{userId: userId, mask: mask}
+}
+
+// Annotate 生成用户输入的注释指令，不需要记录时返回 false
+func (a *inputAnnotator) Annotate(inst *guacd.Instruction, now int64) (guacd.Instruction, bool) {
+	args := make([]string, 0, len(inst.Args)+3)
+	args = append(args, strconv.FormatInt(now, 10), a.userId, inst.Opcode)
+	switch inst.Opcode {
+	case guacd.InstructionKey:
+		// key,keysym,pressed
+		if len(inst.Args) < 2 {
+			return guacd.Instruction{}, false
+		}
+		keysym := inst.Args[0]
+		if a.mask && isPrintableKeysym(keysym) {
+			keysym = maskedKeysym
+		}
+		args = append(args, keysym, inst.Args[1])
+	case guacd.InstructionMouse:
+		// mouse,x,y,mask
+		if len(inst.Args) < 3 || inst.Args[2] == a.lastButtons {
+			return guacd.Instruction{}, false
+		}
+		a.lastButtons = inst.Args[2]
+		args = append(args, inst.Args[:3]...)
+	default:
+		return guacd.Instruction{}, false
+	}
+	return guacd.NewInstruction(InstructionJmsInput, args...), true
+}
+
+// isPrintableKeysym Latin-1 字符、小键盘的数字符号和 Unicode 字符
+func isPrintableKeysym(keysym string) bool {
+	value, err := strconv.ParseInt(keysym, 10, 64)
+	if err != nil {
+		return false
+	}
+	switch {
+	case value >= 0x20 && value <= 0xff:
+		return true
+	case value >= 0xffaa && value <= 0xffb9:
+		return true
+	case value >= 0x1000000:
+		return true
+	}
+	return false
+}
+
+func (t *Connection) recordInput(inst *guacd.Instruction) {
+	if t.inputAnnotator == nil {
+		return
+	}
+	if annotation, ok := t.inputAnnotator.Annotate(inst, time.Now().UnixMilli()); ok {
+		t.replayRecorder.RecordInput(annotation)
+	}
+}
+
+// recordShareInput 接管会话的管理员的输入不受 REPLAY_RECORD_INPUT 限制
+func (t *Connection) recordShareInput(event *Event) {
+	annotation, err := guacd.ParseInstructionString(string(event.Data))
+	if err != nil || annotation.Opcode != InstructionJmsInput {
+		logger.Errorf("Session[%s] invalid share input event: %s", t, event.Data)
+		return
+	}
+	t.replayRecorder.RecordInput(annotation)
+}
+
+// recordInput 分享用户和接管会话的管理员的输入通过会话事件转发给主用户的 Connection
+func (m *MonitorCon) recordInput(inst *guacd.Instruction) {
+	if m.inputAnnotator == nil {
+		return
+	}
+	if annotation, ok := m.inputAnnotator.Annotate(inst, time.Now().UnixMilli()); ok {
+		m.Service.Cache.BroadcastSessionEvent(m.Id, &Event{
+			Type: ShareInputEvent,
+			Data: []byte(annotation.String()),
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package tunnel
+
+import (
+	"testing"
+
+	"lion/pkg/guacd"
+)
+
+func TestIsPrintableKeysym(t *testing.T) {
+	tests := []struct {
+		keysym    string
+		printable bool
+	}{
+		{"32", true},        // space
+		{"97", true},        // a
+		{"255", true},       // ÿ
+		{"65450", true},     // KP_Multiply
+		{"65465", true},     // KP_9
+		{"16777729", true},  // U+0201
+		{"16797735", true},  // U+5027
+		{"31", false},       // 控制字符
+		{"256", false},      // 超出 Latin-1
+		{"65293", false},    // Return
+		{"65289", false},    // Tab
+		{"65307", false},    // Escape
+		{"65470", false},    // F1
+		{"65505", false},    // Shift_L
+		{"65507", false},    // Control_L
+		{"65449", false},    // 小键盘之前
+		{"65466", false},    // 小键盘之后
+		{"", false},         // 非数字
+		{"abc", false},      // 非数字
+		{"0x61", false},     // 非十进制
+		{"-97", false},      // 负数
+		{"16777216", true},  // Unicode 起始
+		{"16777215", false}, // Unicode 之前
+	}
+	for _, tt := range tests {
+		if got := isPrintableKeysym(tt.keysym); got != tt.printable {
+			t.Errorf("isPrintableKeysym(%q) = %t, want %t", tt.keysym, got, tt.printable)
+		}
+	}
+}
+
+func TestInputAnnotatorAnnotate(t *testing.T) {
+	const now = 1700000000000
+	tests := []struct {
+		name string
+		mask bool
+		// 同一个 annotator 依次处理的指令，以及期望的注释(为空表示不记录)
+		inputs []guacd.Instruction
+		want   []string
+	}{
+		{
+			name: "masked latin1 key",
+			mask: true,
+			inputs: []guacd.Instruction{
+				guacd.NewInstruction(guacd.InstructionKey, "97", "1"),
+				guacd.NewInstruction(guacd.InstructionKey, "97", "0"),
+			},
+			want: []string{
+				"9.jms_input,13.1700000000000,2.u1,3.key,1.*,1.1;",
+				"9.jms_input,13.1700000000000,2.u1,3.key,1.*,1.0;",
+			},
+		},
+		{
+			name: "masked unicode and keypad keys",
+			mask: true,
+			inputs: []guacd.Instruction{
+				guacd.NewInstruction(guacd.InstructionKey, "16797735", "1"),
+				guacd.NewInstruction(guacd.InstructionKey, "65456", "1"),
+			},
+			want: []string{
+				"9.jms_input,13.1700000000000,2.u1,3.key,1.*,1.1;",
+				"9.jms_input,13.1700000000000,2.u1,3.key,1.*,1.1;",
+			},
+		},
+		{
+			name: "function keys not masked",
+			mask: true,
+			inputs: []guacd.Instruction{
+				guacd.NewInstruction(guacd.InstructionKey, "65293", "1"),
+				guacd.NewInstruction(guacd.InstructionKey, "65470", "1"),
+				guacd.NewInstruction(guacd.InstructionKey, "65507", "0"),
+			},
+			want: []string{
+				"9.jms_input,13.1700000000000,2.u1,3.key,5.65293,1.1;",
+				"9.jms_input,13.1700000000000,2.u1,3.key,5.65470,1.1;",
+				"9.jms_input,13.1700000000000,2.u1,3.key,5.65507,1.0;",
+			},
+		},
+		{
+			name: "unmasked printable key",
+			mask: false,
+			inputs: []guacd.Instruction{
+				guacd.NewInstruction(guacd.InstructionKey, "97", "1"),
+			},
+			want: []string{
+				"9.jms_input,13.1700000000000,2.u1,3.key,2.97,1.1;",
+			},
+		},
+		{
+			name: "invalid key",
+			mask: true,
+			inputs: []guacd.Instruction{
+				guacd.NewInstruction(guacd.InstructionKey, "97"),
+			},
+			want: []string{""},
+		},
+		{
+			name: "mouse clicks only",
+			mask: true,
+			inputs: []guacd.Instruction{
+				guacd.NewInstruction(guacd.InstructionMouse, "10", "20", "0"),
+				guacd.NewInstruction(guacd.InstructionMouse, "11", "21", "0"),
+				guacd.NewInstruction(guacd.InstructionMouse, "12", "22", "1"),
+				guacd.NewInstruction(guacd.InstructionMouse, "13", "23", "1"),
+				guacd.NewInstruction(guacd.InstructionMouse, "13", "23", "0"),
+				guacd.NewInstruction(guacd.InstructionMouse, "13"),
+			},
+			want: []string{
+				"9.jms_input,13.1700000000000,2.u1,5.mouse,2.10,2.20,1.0;",
+				"",
+				"9.jms_input,13.1700000000000,2.u1,5.mouse,2.12,2.22,1.1;",
+				"",
+				"9.jms_input,13.1700000000000,2.u1,5.mouse,2.13,2.23,1.0;",
+				"",
+			},
+		},
+		{
+			name: "other instructions",
+			mask: true,
+			inputs: []guacd.Instruction{
+				guacd.NewInstruction(guacd.InstructionSize, "1024", "768"),
+				guacd.NewInstruction(guacd.InstructionClientSync, "1000"),
+			},
+			want: []string{"", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotator := newInputAnnotator("u1", tt.mask)
+			for i := range tt.inputs {
+				got, ok := annotator.Annotate(&tt.inputs[i], now)
+				want := tt.want[i]
+				if ok != (want != "") {
+					t.Fatalf("input %d: Annotate recorded %t, want %q", i, ok, want)
+				}
+				if ok && got.String() != want {
+					t.Errorf("input %d: Annotate = %s, want %s", i, got.String(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"lion/pkg/display"
+	"lion/pkg/encrypt"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	录像的关键帧
+
+	录制时 PartRecorder 将指令交给 keyframeRecorder，在单独的 goroutine 中处理到 display，
+	每隔 REPLAY_KEYFRAME_INTERVAL 秒在 sync 之后将 display 的关键帧(display.Keyframe)追加到 {part}.keyframes，
+	位置记录在索引的 Keyframes 中。seek 时从目标位置之前最近的关键帧开始处理，
+	需要处理的指令不超过一个关键帧间隔，与 part 的大小无关。
+	队列满时不阻塞录像(录像的 sync 延迟会让 guacd 降低所有用户的帧率)，该 part 后续不再生成关键帧。
+	keyframes 文件只用于本地回放，不上传。
+*/
+
+const (
+	KeyframesSuffix = ".keyframes"
+
+	keyframeQueueSize = 4096
+)
+
+type KeyframePoint struct {
+	// sync 的时间和 sync 结束在 part 文件中的位置
+	Time   int64 `json:"t"`
+	Offset int64 `json:"o"`
+	// 关键帧指令在 keyframes 文件中的位置和大小
+	FrameOffset int64 `json:"fo"`
+	FrameSize   int64 `json:"fs"`
+}
+
+// LookupKeyframe 返回 part 文件中位置不超过 offset 的最后一个关键帧
+func (p *PartIndex) LookupKeyframe(offset int64) (KeyframePoint, bool) {
+	i := sort.Search(len(p.Keyframes), func(i int) bool {
+		return p.Keyframes[i].Offset > offset
+	})
+	if i == 0 {
+		return KeyframePoint{}, false
+	}
+	return p.Keyframes[i-1], true
+}
+
+type keyframeInput struct {
+	inst guacd.Instruction
+	// 指令结束在 part 文件中的位置
+	end int64
+}
+
+type keyframeRecorder struct {
+	path     string
+	interval int64
+
+	queue    chan keyframeInput
+	done     chan struct{}
+	stopOnce sync.Once
+	overflow bool
+
+	points []KeyframePoint
+}
+
+func newKeyframeRecorder(partPath string, interval int64) *keyframeRecorder {
+	r := keyframeRecorder{
+		path:     partPath + KeyframesSuffix,
+		interval: interval,
+		queue:    make(chan keyframeInput, keyframeQueueSize),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return &r
+}
+
+// Add 在录像的 goroutine 中调用，队列满时放弃该 part 后续的关键帧
+func (r *keyframeRecorder) Add(inst guacd.Instruction, end int64) {
+	if r.overflow {
+		return
+	}
+	select {
+	case r.queue <- keyframeInput{inst: inst, end: end}:
+	default:
+		r.overflow = true
+		close(r.queue)
+		logger.Warnf("Keyframe recorder %s queue full, stop recording keyframes", r.path)
+	}
+}
+
+// Stop 等待已经入队的指令处理完成，返回关键帧的位置
+func (r *keyframeRecorder) Stop() []KeyframePoint {
+	r.stopOnce.Do(func() {
+		if !r.overflow {
+			close(r.queue)
+		}
+	})
+	<-r.done
+	return r.points
+}
+
+func (r *keyframeRecorder) run() {
+	defer close(r.done)
+	var (
+		screen   = display.New()
+		writer   io.WriteCloser
+		written  int64
+		lastTime int64
+	)
+	defer func() {
+		if writer != nil {
+			_ = writer.Close()
+		}
+	}()
+	for input := range r.queue {
+		screen.Process(&input.inst)
+		if input.inst.Opcode != guacd.InstructionClientSync || len(input.inst.Args) < 1 {
+			continue
+		}
+		syncTime, err := strconv.ParseInt(input.inst.Args[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		// part 的开始是 guacd 发送的完整画面，不需要关键帧
+		if lastTime == 0 {
+			lastTime = syncTime
+			continue
+		}
+		if syncTime-lastTime < r.interval {
+			continue
+		}
+		lastTime = syncTime
+		if writer == nil {
+			if writer, err = encrypt.CreateFile(r.path); err != nil {
+				logger.Errorf("Keyframe recorder create %s failed: %v", r.path, err)
+				r.drain()
+				return
+			}
+		}
+		var buf bytes.Buffer
+		for _, inst := range screen.Keyframe(viewerBlobMaxLength) {
+			buf.WriteString(inst.String())
+		}
+		if _, err = writer.Write(buf.Bytes()); err != nil {
+			logger.Errorf("Keyframe recorder write %s failed: %v", r.path, err)
+			r.drain()
+			return
+		}
+		r.points = append(r.points, KeyframePoint{Time: syncTime, Offset: input.end,
+			FrameOffset: written, FrameSize: int64(buf.Len())})
+		written += int64(buf.Len())
+	}
+}
+
+// drain 写入失败后丢弃剩余的指令，避免 Add 阻塞
+func (r *keyframeRecorder) drain() {
+	r.points = nil
+	for range r.queue {
+	}
+}
+
+// loadKeyframe 将 keyframes 文件中的关键帧处理到 screen
+func loadKeyframe(partPath string, point KeyframePoint, screen *display.Display) error {
+	fd, err := encrypt.OpenFile(partPath + KeyframesSuffix)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if _, err = fd.Seek(point.FrameOffset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.LimitReader(fd, point.FrameSize))
+	for {
+		inst, err1 := ReadInstruction(reader)
+		if err1 != nil {
+			if err1 == io.EOF {
+				return nil
+			}
+			return err1
+		}
+		screen.Process(&inst)
+	}
+}
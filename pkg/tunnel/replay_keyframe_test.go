@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"path/filepath"
+	"testing"
+
+	"lion/pkg/display"
+	"lion/pkg/guacd"
+)
+
+func TestKeyframeRecorder(t *testing.T) {
+	partPath := filepath.Join(t.TempDir(), "sid.0.part")
+	recorder := newKeyframeRecorder(partPath, 1000)
+	instructions := []guacd.Instruction{
+		guacd.NewInstruction("size", "0", "20", "10"),
+		guacd.NewInstruction(guacd.InstructionClientSync, "1000"),
+		guacd.NewInstruction("rect", "0", "0", "0", "20", "10"),
+		guacd.NewInstruction("cfill", "14", "0", "255", "0", "0", "255"),
+		guacd.NewInstruction(guacd.InstructionClientSync, "1500"),
+		guacd.NewInstruction(guacd.InstructionClientSync, "2100"),
+		guacd.NewInstruction("rect", "0", "0", "0", "5", "5"),
+		guacd.NewInstruction("cfill", "14", "0", "0", "0", "255", "255"),
+		guacd.NewInstruction(guacd.InstructionClientSync, "2600"),
+	}
+	want := display.New()
+	offset := int64(0)
+	for i := range instructions {
+		offset += int64(len(instructions[i].String()))
+		recorder.Add(instructions[i], offset)
+		if i <= 5 {
+			want.Process(&instructions[i])
+		}
+	}
+	points := recorder.Stop()
+	// part 开始不生成关键帧，之后间隔 1000ms
+	if len(points) != 1 || points[0].Time != 2100 {
+		t.Fatalf("unexpected keyframes %+v", points)
+	}
+
+	index := PartIndex{Keyframes: points}
+	if _, ok := index.LookupKeyframe(points[0].Offset - 1); ok {
+		t.Fatal("keyframe found before its offset")
+	}
+	point, ok := index.LookupKeyframe(offset)
+	if !ok || point != points[0] {
+		t.Fatalf("lookup keyframe got %+v %t", point, ok)
+	}
+	screen := display.New()
+	if err := loadKeyframe(partPath, point, screen); err != nil {
+		t.Fatal(err)
+	}
+	got, expected := screen.Snapshot(), want.Snapshot()
+	if got.Rect != expected.Rect || string(got.Pix) != string(expected.Pix) {
+		t.Fatal("keyframe does not restore the display")
+	}
+}
@@ -0,0 +1,366 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jumpserver-dev/sdk-go/common"
+
+	"lion/pkg/config"
+	"lion/pkg/encrypt"
+	"lion/pkg/logger"
+)
+
+/*
+	录像的防篡改清单
+
+	每个上传的 part.gz 计算 sha256，并按照顺序计算链式摘要:
+		chain_0 = sha256(sessionId + name_0 + hash_0)
+		chain_i = sha256(chain_{i-1} + name_i + hash_i)
+	最后一个 chain 作为清单的摘要。签名的内容为清单(不含签名)和整个 replay.json(不含清单)
+	的规范化 JSON(对象的 key 排序)，使用节点的 ed25519 私钥签名。
+	缺失、替换、调整顺序或修改任意一个 part，以及修改会话信息、标记、缺失时间段和聊天
+	都会导致校验失败。
+
+	清单中的公钥可以和清单一起被替换，只用清单中的公钥校验通过的结果为 unverified；
+	需要使用节点的公钥(lion pubkey 输出，或启动日志中的 replay sign public key)校验，结果才是 verified。
+*/
+
+const (
+	manifestVersion   = "v1"
+	manifestAlgorithm = "sha256+ed25519"
+)
+
+const (
+	ManifestVerified   = "verified"
+	ManifestUnverified = "unverified"
+	ManifestFailed     = "failed"
+)
+
+var (
+	ErrSignKeyNotFound   = errors.New("replay sign key not found")
+	ErrManifestNotFound  = errors.New("replay manifest not found")
+	ErrManifestSignature = errors.New("replay manifest signature invalid")
+	ErrManifestDigest    = errors.New("replay manifest digest mismatch")
+	ErrManifestPublicKey = errors.New("replay manifest public key mismatch")
+)
+
+type ReplayManifest struct {
+	Version   string         `json:"version"`
+	Algorithm string         `json:"algorithm"`
+	Digest    string         `json:"digest"`
+	PartCount int            `json:"part_count"`
+	PublicKey string         `json:"public_key"`
+	Signature string         `json:"signature"`
+	SignedAt  common.UTCTime `json:"signed_at"`
+}
+
+func (m *ReplayManifest) signPayload(meta *SessionReplayMeta) ([]byte, error) {
+	manifest := *m
+	manifest.Signature = ""
+	manifestBuf, err := canonicalJSON(manifest)
+	if err != nil {
+		return nil, err
+	}
+	replayMeta := *meta
+	replayMeta.Manifest = nil
+	metaBuf, err := canonicalJSON(replayMeta)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join([][]byte{[]byte("lion-replay-manifest"), manifestBuf, metaBuf}, []byte("\n")), nil
+}
+
+// canonicalJSON 重新编码为 key 排序的 JSON，与结构体字段顺序无关，
+// 签名和校验(读取 replay.json 后)得到相同的内容
+func canonicalJSON(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	var value interface{}
+	if err = decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func chainDigest(prev, name, hash string) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write([]byte(name))
+	h.Write([]byte(hash))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ComputeChain 按照 part 的顺序计算链式摘要，并写入每个 part 的 Chain
+func ComputeChain(sessionId string, parts []PartFileMeta) string {
+	prev := sessionId
+	for i := range parts {
+		prev = chainDigest(prev, parts[i].Name, parts[i].Hash)
+		parts[i].Chain = prev
+	}
+	return prev
+}
+
+func SignReplayManifest(meta *SessionReplayMeta, key ed25519.PrivateKey) error {
+	manifest := ReplayManifest{
+		Version:   manifestVersion,
+		Algorithm: manifestAlgorithm,
+		Digest:    ComputeChain(meta.ID, meta.PartMetas),
+		PartCount: len(meta.PartMetas),
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		SignedAt:  common.NewNowUTCTime(),
+	}
+	payload, err := manifest.signPayload(meta)
+	if err != nil {
+		return err
+	}
+	manifest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	meta.Manifest = &manifest
+	return nil
+}
+
+type PartVerifyResult struct {
+	Name   string `json:"name"`
+	Hash   string `json:"sha256"`
+	Actual string `json:"actual,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ManifestVerifyResult struct {
+	SessionId string             `json:"session_id"`
+	Parts     []PartVerifyResult `json:"parts"`
+	Errors    []string           `json:"errors,omitempty"`
+	// 使用调用方提供的节点公钥校验签名
+	Trusted bool `json:"trusted"`
+}
+
+// Ok 清单一致，并且由可信的公钥签名
+func (r *ManifestVerifyResult) Ok() bool {
+	return r.Trusted && r.Consistent()
+}
+
+func (r *ManifestVerifyResult) Status() string {
+	switch {
+	case !r.Consistent():
+		return ManifestFailed
+	case !r.Trusted:
+		return ManifestUnverified
+	default:
+		return ManifestVerified
+	}
+}
+
+// Consistent part 文件、链式摘要和签名与清单一致，不代表签名的公钥可信
+func (r *ManifestVerifyResult) Consistent() bool {
+	if len(r.Errors) > 0 {
+		return false
+	}
+	for i := range r.Parts {
+		if r.Parts[i].Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyReplayManifest 校验目录中的 part 文件、链式摘要和签名，
+// pubKey 为空时使用清单中的公钥，只能证明清单自身一致，结果为 unverified
+func VerifyReplayManifest(meta *SessionReplayMeta, dir string, pubKey ed25519.PublicKey) *ManifestVerifyResult {
+	result := ManifestVerifyResult{SessionId: meta.ID}
+	manifest := meta.Manifest
+	if manifest == nil {
+		result.Errors = append(result.Errors, ErrManifestNotFound.Error())
+		return &result
+	}
+	for i := range meta.PartMetas {
+		part := meta.PartMetas[i]
+		partResult := PartVerifyResult{Name: part.Name, Hash: part.Hash}
+		actual, err := hashFile(filepath.Join(dir, part.Name))
+		switch {
+		case err != nil:
+			partResult.Error = err.Error()
+		case actual != part.Hash:
+			partResult.Actual = actual
+			partResult.Error = "hash mismatch"
+		}
+		result.Parts = append(result.Parts, partResult)
+	}
+	parts := make([]PartFileMeta, len(meta.PartMetas))
+	copy(parts, meta.PartMetas)
+	if len(parts) != manifest.PartCount || ComputeChain(meta.ID, parts) != manifest.Digest {
+		result.Errors = append(result.Errors, ErrManifestDigest.Error())
+	}
+	embeddedKey, err := base64.StdEncoding.DecodeString(manifest.PublicKey)
+	if err != nil || len(embeddedKey) != ed25519.PublicKeySize {
+		result.Errors = append(result.Errors, ErrManifestPublicKey.Error())
+		return &result
+	}
+	if pubKey == nil {
+		pubKey = embeddedKey
+	} else if !pubKey.Equal(ed25519.PublicKey(embeddedKey)) {
+		result.Errors = append(result.Errors, ErrManifestPublicKey.Error())
+	} else {
+		result.Trusted = true
+	}
+	payload, err := manifest.signPayload(meta)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return &result
+	}
+	signature, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil || !ed25519.Verify(pubKey, payload, signature) {
+		result.Errors = append(result.Errors, ErrManifestSignature.Error())
+	}
+	return &result
+}
+
+// hashFile 计算明文的 sha256，本地加密的文件会先解密
+func hashFile(path string) (string, error) {
+	fd, err := encrypt.OpenFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// LoadReplayMeta 读取目录中的 {sid}.replay.json
+func LoadReplayMeta(dir string) (*SessionReplayMeta, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+ReplayMetaSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, ErrManifestNotFound
+	}
+	buf, err := os.ReadFile(matches[0])
+	if err != nil {
+		return nil, err
+	}
+	var meta SessionReplayMeta
+	if err = json.Unmarshal(buf, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+var (
+	signKeyOnce sync.Once
+	signKey     ed25519.PrivateKey
+)
+
+// GetReplaySignKey 读取节点的签名私钥，不存在时生成
+func GetReplaySignKey() ed25519.PrivateKey {
+	signKeyOnce.Do(func() {
+		path := config.GlobalConfig.ReplaySignKeyPath
+		key, err := LoadOrCreateSignKey(path)
+		if err != nil {
+			logger.Errorf("Load replay sign key %s failed: %s", path, err)
+			return
+		}
+		signKey = key
+		logger.Infof("Replay sign public key: %s",
+			base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	})
+	return signKey
+}
+
+// LoadSignKey 读取节点的签名私钥，不存在时返回 ErrSignKeyNotFound
+func LoadSignKey(path string) (ed25519.PrivateKey, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrSignKeyNotFound, path)
+		}
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("invalid pem file")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not ed25519 private key")
+	}
+	return privateKey, nil
+}
+
+func LoadOrCreateSignKey(path string) (ed25519.PrivateKey, error) {
+	privateKey, err := LoadSignKey(path)
+	if !errors.Is(err, ErrSignKeyNotFound) {
+		return privateKey, err
+	}
+	_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	buf := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err = os.WriteFile(path, buf, 0600); err != nil {
+		return nil, err
+	}
+	logger.Infof("Create replay sign key %s", path)
+	return privateKey, nil
+}
+
+// EncodePublicKey PEM 格式的公钥，LoadPublicKey 可以读取
+func EncodePublicKey(key ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// LoadPublicKey 读取 PEM 格式的公钥或者 base64 编码的公钥
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(buf); block != nil {
+		key, err1 := x509.ParsePKIXPublicKey(block.Bytes)
+		if err1 != nil {
+			return nil, err1
+		}
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not ed25519 public key")
+		}
+		return publicKey, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+	return raw, nil
+}
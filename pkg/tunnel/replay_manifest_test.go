@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newSignedReplayMeta(t *testing.T, dir string, key ed25519.PrivateKey) *SessionReplayMeta {
+	var meta SessionReplayMeta
+	meta.ID = "e32248ce-2dc8-43c8-b37e-a61d5ee32176"
+	meta.ReplayType = ReplayType
+	for i, data := range []string{"4.sync,4.1000;", "4.sync,4.2000;", "4.sync,4.3000;"} {
+		name := meta.ID + "." + string(rune('0'+i)) + ".part.gz"
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta.PartMetas = append(meta.PartMetas, PartFileMeta{Name: name, Hash: hash})
+	}
+	meta.Markers = []ReplayMarker{{Time: 1500, Type: MarkerSessionTakeover, User: "admin"}}
+	if err := SignReplayManifest(&meta, key); err != nil {
+		t.Fatal(err)
+	}
+	// 校验时 replay.json 从存储中读取
+	buf, _ := json.Marshal(meta)
+	var loaded SessionReplayMeta
+	if err := json.Unmarshal(buf, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	return &loaded
+}
+
+func TestVerifyReplayManifest(t *testing.T) {
+	pubKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	meta := newSignedReplayMeta(t, dir, key)
+	if result := VerifyReplayManifest(meta, dir, pubKey); !result.Ok() {
+		t.Fatalf("verify signed replay failed: %+v", result)
+	}
+	// 只有清单中的公钥时不能证明签名者
+	if result := VerifyReplayManifest(meta, dir, nil); result.Ok() || result.Status() != ManifestUnverified {
+		t.Fatalf("verify with embedded key got %s", result.Status())
+	}
+
+	otherPubKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if result := VerifyReplayManifest(meta, dir, otherPubKey); result.Ok() {
+		t.Fatal("verify with other public key passed")
+	}
+
+	t.Run("tamper part", func(t *testing.T) {
+		dir := t.TempDir()
+		meta := newSignedReplayMeta(t, dir, key)
+		if err := os.WriteFile(filepath.Join(dir, meta.PartMetas[1].Name), []byte("4.sync,4.2001;"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		result := VerifyReplayManifest(meta, dir, pubKey)
+		if result.Ok() || result.Parts[1].Error == "" {
+			t.Fatalf("tampered part passed: %+v", result)
+		}
+	})
+
+	t.Run("reorder parts", func(t *testing.T) {
+		dir := t.TempDir()
+		meta := newSignedReplayMeta(t, dir, key)
+		meta.PartMetas[0], meta.PartMetas[1] = meta.PartMetas[1], meta.PartMetas[0]
+		result := VerifyReplayManifest(meta, dir, pubKey)
+		if result.Ok() || !containsString(result.Errors, ErrManifestDigest.Error()) {
+			t.Fatalf("reordered parts passed: %+v", result)
+		}
+	})
+
+	t.Run("edit marker", func(t *testing.T) {
+		dir := t.TempDir()
+		meta := newSignedReplayMeta(t, dir, key)
+		meta.Markers[0].User = "someone"
+		result := VerifyReplayManifest(meta, dir, pubKey)
+		if result.Ok() || !containsString(result.Errors, ErrManifestSignature.Error()) {
+			t.Fatalf("edited marker passed: %+v", result)
+		}
+	})
+
+	t.Run("edit gaps", func(t *testing.T) {
+		dir := t.TempDir()
+		meta := newSignedReplayMeta(t, dir, key)
+		meta.Gaps = append(meta.Gaps, ReplayGap{Start: 1000, End: 2000})
+		if result := VerifyReplayManifest(meta, dir, pubKey); result.Ok() {
+			t.Fatalf("edited gaps passed: %+v", result)
+		}
+	})
+}
+
+func containsString(values []string, s string) bool {
+	for i := range values {
+		if values[i] == s {
+			return true
+		}
+	}
+	return false
+}
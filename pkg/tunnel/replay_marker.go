@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	录像中的事件标记
+
+	会话过程中的锁定、分享用户加入退出、文件传输、权限过期、命令记录等事件，
+	以标记指令写入正在录制的 part:
+		jms_marker,<时间戳(毫秒)>,<type>,<marker json>
+	同时记录在 {sid}.markers.json，上传时汇总到 replay.json，播放时可以直接跳转到事件发生的位置。
+	监控用户可能连接在其他节点，通过会话事件转发给主用户的 Connection 记录。
+*/
+
+const (
+	InstructionJmsMarker = "jms_marker"
+
+	MarkersSuffix = ".markers.json"
+
+	ReplayMarkerEvent = "replay_marker"
+)
+
+const (
+	MarkerSessionLock      = "session_lock"
+	MarkerSessionUnlock    = "session_unlock"
+	MarkerSessionTerminate = "session_terminate"
+	MarkerShareJoin        = "share_join"
+	MarkerShareExit        = "share_exit"
+	MarkerMonitorJoin      = "monitor_join"
+	MarkerMonitorExit      = "monitor_exit"
+	MarkerFileUpload       = "file_upload"
+	MarkerFileDownload     = "file_download"
+	MarkerPermExpired      = "perm_expired"
+	MarkerPermValid        = "perm_valid"
+	MarkerCommand          = "command"
+	MarkerControlHandoff   = "control_handoff"
+	MarkerChat             = "chat"
+	MarkerSessionTakeover  = "session_takeover"
+	MarkerSessionRelease   = "session_release"
+)
+
+type ReplayMarker struct {
+	Time   int64  `json:"time"`
+	Type   string `json:"type"`
+	User   string `json:"user,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	Failed bool   `json:"failed,omitempty"`
+	// 标记所在 part 上传后的文件名
+	Part string `json:"part,omitempty"`
+}
+
+func NewReplayMarker(markerType, user, detail string) ReplayMarker {
+	return ReplayMarker{
+		Time:   time.Now().UnixMilli(),
+		Type:   markerType,
+		User:   user,
+		Detail: detail,
+	}
+}
+
+func (m ReplayMarker) Instruction() guacd.Instruction {
+	data, _ := json.Marshal(m)
+	return guacd.NewInstruction(InstructionJmsMarker,
+		strconv.FormatInt(m.Time, 10), m.Type, string(data))
+}
+
+// RecordMarker 将标记写入正在录制的 part，并追加到 {sid}.markers.json
+func (r *ReplayRecorder) RecordMarker(marker ReplayMarker) {
+	if r.RootPath == "" {
+		return
+	}
+	r.partLock.Lock()
+	part := r.currentPart
+	r.partLock.Unlock()
+	if part != nil {
+		marker.Part = part.PartFilename + ".gz"
+		part.WriteAnnotation(marker.Instruction())
+	}
+
+	r.markerLock.Lock()
+	defer r.markerLock.Unlock()
+	r.markers = append(r.markers, marker)
+	markersPath := filepath.Join(r.RootPath, r.SessionId+MarkersSuffix)
+	buf, _ := json.Marshal(r.markers)
+	if err := os.WriteFile(markersPath, buf, os.ModePerm); err != nil {
+		logger.Errorf("ReplayRecorder %s write markers file failed: %v", r.SessionId, err)
+	}
+}
+
+func LoadReplayMarkers(rootPath, sessionId string) []ReplayMarker {
+	buf, err := os.ReadFile(filepath.Join(rootPath, sessionId+MarkersSuffix))
+	if err != nil {
+		return nil
+	}
+	var markers []ReplayMarker
+	if err = json.Unmarshal(buf, &markers); err != nil {
+		logger.Errorf("Load replay %s markers failed: %v", sessionId, err)
+		return nil
+	}
+	return markers
+}
+
+func (t *Connection) recordMarker(marker ReplayMarker) {
+	if t.replayRecorder == nil {
+		return
+	}
+	t.replayRecorder.RecordMarker(marker)
+}
+
+func (t *Connection) recordMarkerEvent(event *Event) {
+	var marker ReplayMarker
+	if err := json.Unmarshal(event.Data, &marker); err != nil {
+		logger.Errorf("Session[%s] invalid replay marker event: %s", t, event.Data)
+		return
+	}
+	t.recordMarker(marker)
+}
+
+// BroadcastReplayMarker 不在主用户 Connection 中发生的事件，通过会话事件转发
+func BroadcastReplayMarker(cache GuaTunnelCache, sid string, marker ReplayMarker) {
+	data, _ := json.Marshal(marker)
+	cache.BroadcastSessionEvent(sid, &Event{Type: ReplayMarkerEvent, Data: data})
+}
+
+func (t *Connection) recordFileMarker(markerType, filename string, success bool) {
+	marker := NewReplayMarker(markerType, t.Sess.User.String(), filename)
+	marker.Failed = !success
+	t.recordMarker(marker)
+}
@@ -0,0 +1,168 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"lion/pkg/encrypt"
+	"lion/pkg/logger"
+)
+
+/*
+	会话过程中 part 切换后，在后台压缩并上传已经结束的 part，
+	已上传的 part 记录在 {sid}.upload.json，会话结束(或节点重启后补传)时跳过这些 part，
+	最后生成 replay.json 将所有的 part 关联起来。
+*/
+
+const UploadStateSuffix = ".upload.json"
+
+type uploadedPart struct {
+	PartFileMeta
+	UploadSize int64 `json:"upload_size"`
+}
+
+type partUploadState struct {
+	// key 为上传的 part.gz 文件名
+	Parts map[string]uploadedPart `json:"parts"`
+}
+
+// partFileIndex 从 {sid}.{index}.part 中解析 part 的序号
+func partFileIndex(name string) int {
+	name = strings.TrimSuffix(name, PartSuffix)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	index, _ := strconv.Atoi(name)
+	return index
+}
+
+func (p *PartUploader) uploadStatePath() string {
+	return filepath.Join(p.RootPath, p.SessionId+UploadStateSuffix)
+}
+
+func (p *PartUploader) loadUploadState() {
+	p.uploadState = partUploadState{Parts: make(map[string]uploadedPart)}
+	buf, err := os.ReadFile(p.uploadStatePath())
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(buf, &p.uploadState); err != nil {
+		logger.Errorf("PartUploader %s load upload state error: %v", p.SessionId, err)
+	}
+	if p.uploadState.Parts == nil {
+		p.uploadState.Parts = make(map[string]uploadedPart)
+	}
+}
+
+func (p *PartUploader) saveUploadState() {
+	buf, _ := json.Marshal(p.uploadState)
+	if err := os.WriteFile(p.uploadStatePath(), buf, os.ModePerm); err != nil {
+		logger.Errorf("PartUploader %s save upload state error: %v", p.SessionId, err)
+	}
+}
+
+// markUploaded 只记录 part 文件，replay.json 每次都需要重新上传
+func (p *PartUploader) markUploaded(name string, size int64) {
+	for i := range p.replayMeta.PartMetas {
+		if p.replayMeta.PartMetas[i].Name == name {
+			p.uploadState.Parts[name] = uploadedPart{
+				PartFileMeta: p.replayMeta.PartMetas[i],
+				UploadSize:   size,
+			}
+			p.saveUploadState()
+			return
+		}
+	}
+}
+
+func (p *PartUploader) targetName(filename string) string {
+	dateRoot := p.replayMeta.DateStart.Format(recordDirTimeFormat)
+	return strings.Join([]string{dateRoot, p.SessionId, filename}, "/")
+}
+
+// preparePart 压缩 part 文件到 upload 目录，并读取(或生成) meta 和索引
+func (p *PartUploader) preparePart(uploadPath, partName string) (PartFileMeta, error) {
+	partFilePath := filepath.Join(p.RootPath, partName)
+	partGzFilename := partName + ".gz"
+	uploadFilePath := filepath.Join(uploadPath, partGzFilename)
+
+	hash, truncated, err := compressPartFile(partFilePath, uploadFilePath)
+	if err != nil {
+		logger.Errorf("PartUploader %s compress part file %s error: %v", p.SessionId, partName, err)
+		return PartFileMeta{}, err
+	}
+
+	partFileMeta := PartFileMeta{Name: partGzFilename, Hash: hash, Truncated: truncated}
+	if truncated {
+		logger.Warnf("PartUploader %s part file %s truncated, upload the verified data only", p.SessionId, partName)
+	}
+	// 读取 {part}.meta 文件，截断的 part 根据通过校验的部分重新生成
+	if buf, err1 := os.ReadFile(partFilePath + MetaSuffix); err1 == nil && !truncated {
+		_ = json.Unmarshal(buf, &partFileMeta.PartMeta)
+	} else {
+		meta, err2 := LoadPartMetaByFile(partFilePath)
+		if err2 != nil {
+			logger.Errorf("PartUploader %s load part file %s meta error: %v", p.SessionId, partName, err2)
+			return PartFileMeta{}, err2
+		}
+		// 存储一份 meta 文件
+		metaBuf, _ := json.Marshal(meta)
+		_ = os.WriteFile(partFilePath+MetaSuffix, metaBuf, os.ModePerm)
+		partFileMeta.PartMeta = meta
+	}
+	// 读取 {part}.index 文件，截断的 part 索引可能超出通过校验的部分
+	partIndexPath := partFilePath + IndexSuffix
+	if index, err1 := LoadPartIndex(partIndexPath); err1 == nil && !truncated {
+		// 关键帧只用于本地回放，keyframes 文件不上传
+		index.Keyframes = nil
+		partFileMeta.Index = index
+	} else if index, err1 = LoadPartIndexByFile(partFilePath); err1 == nil {
+		_ = WritePartIndex(partIndexPath, index)
+		partFileMeta.Index = index
+	} else {
+		logger.Errorf("PartUploader %s load part file %s index error: %v", p.SessionId, partName, err1)
+	}
+	return partFileMeta, nil
+}
+
+// UploadPart 会话过程中上传一个已经结束的 part
+func (p *PartUploader) UploadPart(partName string) error {
+	if err := p.loadSessionMeta(); err != nil {
+		return err
+	}
+	uploadPath := filepath.Join(p.RootPath, "upload")
+	if err := os.MkdirAll(uploadPath, os.ModePerm); err != nil {
+		return err
+	}
+	p.loadUploadState()
+	if _, ok := p.uploadState.Parts[partName+".gz"]; ok {
+		return nil
+	}
+	partFileMeta, err := p.preparePart(uploadPath, partName)
+	if err != nil {
+		return err
+	}
+	uploadFilePath := filepath.Join(uploadPath, partFileMeta.Name)
+	fileInfo, err := os.Stat(uploadFilePath)
+	if err != nil {
+		return err
+	}
+	replayStorage := p.GetStorage()
+	targetFile := p.targetName(partFileMeta.Name)
+	err = encrypt.WithDecryptedFile(uploadFilePath, func(plainPath string) error {
+		return replayStorage.Upload(plainPath, targetFile)
+	})
+	if err != nil {
+		return err
+	}
+	p.uploadState.Parts[partFileMeta.Name] = uploadedPart{
+		PartFileMeta: partFileMeta,
+		UploadSize:   fileInfo.Size(),
+	}
+	p.saveUploadState()
+	logger.Infof("PartUploader %s upload part %s to %s success", p.SessionId, partName, replayStorage.TypeName())
+	return nil
+}
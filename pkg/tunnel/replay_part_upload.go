@@ -2,14 +2,21 @@ package tunnel
 
 import (
 	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"lion/pkg/config"
+	"lion/pkg/encrypt"
 	"lion/pkg/guacd"
 	"lion/pkg/logger"
 
@@ -26,6 +33,7 @@ import (
 data/sessions/e32248ce-2dc8-43c8-b37e-a61d5ee32176
 ├── e32248ce-2dc8-43c8-b37e-a61d5ee32176.0.part
 ├── e32248ce-2dc8-43c8-b37e-a61d5ee32176.0.part.meta
+├── e32248ce-2dc8-43c8-b37e-a61d5ee32176.0.part.index
 └── e32248ce-2dc8-43c8-b37e-a61d5ee32176.json
 
 upload
@@ -33,7 +41,11 @@ upload
 ├── e32248ce-2dc8-43c8-b37e-a61d5ee32176.0.part.gz
 */
 
-const ReplayType = "guacamole"
+const (
+	ReplayType = "guacamole"
+
+	ReplayMetaSuffix = ".replay.json"
+)
 
 type SessionReplayMeta struct {
 	model.Session
@@ -41,11 +53,29 @@ type SessionReplayMeta struct {
 	ReplayType string         `json:"type,omitempty"`
 
 	PartMetas []PartFileMeta `json:"files,omitempty"`
+	// 录像中断导致缺失的时间段
+	Gaps []ReplayGap `json:"gaps,omitempty"`
+	// 会话过程中的事件标记
+	Markers []ReplayMarker `json:"markers,omitempty"`
+	// 会话中的聊天消息
+	Chats []ChatMessage `json:"chats,omitempty"`
+
+	Manifest *ReplayManifest `json:"manifest,omitempty"`
 }
 
 type PartFileMeta struct {
 	Name string `json:"name"`
 	PartMeta
+
+	// 索引的 offset 为未压缩的 part 文件中的位置
+	Index *PartIndex `json:"index,omitempty"`
+
+	// 上传的 part.gz 文件的 sha256 和链式摘要
+	Hash  string `json:"sha256,omitempty"`
+	Chain string `json:"chain,omitempty"`
+
+	// 加密的 part 文件被截断(例如 lion 异常退出)，只上传通过校验的部分
+	Truncated bool `json:"truncated,omitempty"`
 }
 
 type PartUploader struct {
@@ -54,13 +84,14 @@ type PartUploader struct {
 	ApiClient *service.JMService
 	TermCfg   *model.TerminalConfig
 
-	replayMeta SessionReplayMeta
-	partFiles  []os.DirEntry
+	replayMeta  SessionReplayMeta
+	partFiles   []os.DirEntry
+	uploadState partUploadState
 
 	Info guacd.ClientInformation
 }
 
-func (p *PartUploader) preCheckSessionMeta() error {
+func (p *PartUploader) loadSessionMeta() error {
 	metaPath := filepath.Join(p.RootPath, p.SessionId+".json")
 	if _, err := os.Stat(metaPath); err != nil {
 		logger.Errorf("PartUploader %s get meta file error: %v", p.SessionId, err)
@@ -75,6 +106,23 @@ func (p *PartUploader) preCheckSessionMeta() error {
 		logger.Errorf("PartUploader %s unmarshal meta file error: %v", p.SessionId, err)
 		return err1
 	}
+	return nil
+}
+
+// SessionDirEnded 会话结束时录像的元数据写入结束时间，进行中或者异常退出的会话结束时间与开始时间相同
+func SessionDirEnded(rootPath, sessionId string) (bool, error) {
+	p := PartUploader{RootPath: rootPath, SessionId: sessionId}
+	if err := p.loadSessionMeta(); err != nil {
+		return false, err
+	}
+	return p.replayMeta.DateStart != p.replayMeta.DateEnd, nil
+}
+
+func (p *PartUploader) preCheckSessionMeta() error {
+	if err := p.loadSessionMeta(); err != nil {
+		return err
+	}
+	metaPath := filepath.Join(p.RootPath, p.SessionId+".json")
 	if p.replayMeta.DateStart == p.replayMeta.DateEnd {
 		// 未结束的录像, 计算结束时间，并上传到 core api 作为会话结束时间
 		endTime := GetMaxModTime(p.partFiles)
@@ -82,15 +130,18 @@ func (p *PartUploader) preCheckSessionMeta() error {
 		// api finish time
 		if _, err1 := p.ApiClient.SessionFinished(p.SessionId, p.replayMeta.DateEnd); err1 != nil {
 			logger.Errorf("PartUploader %s finish session error: %v", p.SessionId, err1)
-			return err
+			return err1
 		}
 		// write meta file
-		metaBuf, _ = json.Marshal(p.replayMeta)
+		metaBuf, _ := json.Marshal(p.replayMeta)
 		if err1 := os.WriteFile(metaPath, metaBuf, os.ModePerm); err1 != nil {
 			logger.Errorf("PartUploader %s write meta file error: %v", p.SessionId, err1)
 		}
 	}
 	p.replayMeta.ReplayType = ReplayType
+	p.replayMeta.Gaps = LoadReplayGaps(p.RootPath, p.SessionId)
+	p.replayMeta.Markers = LoadReplayMarkers(p.RootPath, p.SessionId)
+	p.replayMeta.Chats = LoadChatMessages(p.RootPath, p.SessionId)
 	return nil
 }
 
@@ -118,6 +169,12 @@ func (p *PartUploader) Start() {
 		3、生成新的 meta 文件
 		4、上传
 	*/
+	// 会话还在录像或者其他 lion 进程正在上传时不处理
+	if err := LockSessionDir(p.RootPath, p.SessionId); err != nil {
+		logger.Errorf("PartUploader %s lock session dir error: %v", p.SessionId, err)
+		return
+	}
+	defer UnlockSessionDir(p.RootPath, p.SessionId)
 	p.CollectionPartFiles()
 	if err := p.preCheckSessionMeta(); err != nil {
 		return
@@ -133,39 +190,36 @@ func (p *PartUploader) Start() {
 		return
 	}
 	// 2、将所有的 part 文件压缩移动到 upload 目录
+	p.loadUploadState()
 	for i := range p.partFiles {
-		partFile := p.partFiles[i]
-		partFilePath := filepath.Join(p.RootPath, partFile.Name())
-		partGzFilename := partFile.Name() + ".gz"
-		uploadFilePath := filepath.Join(uploadPath, partGzFilename)
-
-		if err := common.CompressToGzipFile(partFilePath, uploadFilePath); err != nil {
-			logger.Errorf("PartUploader %s compress part file %s error: %v", p.SessionId, partFile.Name(), err)
-			return
-		}
-
-		// 3、生成新的 meta 文件
-
-		partFileMeta := PartFileMeta{Name: partGzFilename}
-		// 读取 {part}.meta 文件
-		if buf, err := os.ReadFile(filepath.Join(p.RootPath, partFile.Name()+".meta")); err == nil {
-			_ = json.Unmarshal(buf, &partFileMeta.PartMeta)
-		} else {
-			meta, err1 := LoadPartMetaByFile(partFilePath)
-			if err1 != nil {
-				logger.Errorf("PartUploader %s load part file %s meta error: %v", p.SessionId, partFile.Name(), err1)
-				return
+		partName := p.partFiles[i].Name()
+		// 会话中已经上传的 part 不需要重新压缩
+		if uploaded, ok := p.uploadState.Parts[partName+".gz"]; ok {
+			if common.Have(filepath.Join(uploadPath, partName+".gz")) {
+				p.replayMeta.PartMetas = append(p.replayMeta.PartMetas, uploaded.PartFileMeta)
+				continue
 			}
-			// 存储一份 meta 文件
-			metaBuf, _ := json.Marshal(meta)
-			_ = os.WriteFile(filepath.Join(p.RootPath, partFile.Name()+".meta"), metaBuf, os.ModePerm)
-			partFileMeta.PartMeta = meta
+			delete(p.uploadState.Parts, partName+".gz")
+		}
+		partFileMeta, err := p.preparePart(uploadPath, partName)
+		if err != nil {
+			return
 		}
 		p.replayMeta.PartMetas = append(p.replayMeta.PartMetas, partFileMeta)
 	}
+	endTime := p.replayMeta.DateEnd.UnixMilli()
+	p.replayMeta.Gaps = append(p.replayMeta.Gaps, truncatedPartGaps(p.replayMeta.PartMetas, endTime)...)
+	// 签名防篡改清单
+	if key := GetReplaySignKey(); key != nil {
+		if err := SignReplayManifest(&p.replayMeta, key); err != nil {
+			logger.Errorf("PartUploader %s sign replay manifest error: %v", p.SessionId, err)
+		}
+	} else {
+		logger.Errorf("PartUploader %s no sign key, replay manifest not signed", p.SessionId)
+	}
 	// upload 写入 replayMeta json
 	replayMetaBuf, _ := json.Marshal(p.replayMeta)
-	if err := os.WriteFile(filepath.Join(uploadPath, p.SessionId+".replay.json"), replayMetaBuf, os.ModePerm); err != nil {
+	if err := os.WriteFile(filepath.Join(uploadPath, p.SessionId+ReplayMetaSuffix), replayMetaBuf, os.ModePerm); err != nil {
 		logger.Errorf("PartUploader %s write replay meta file error: %v", p.SessionId, err)
 		return
 	}
@@ -188,6 +242,10 @@ func (p *PartUploader) CollectionPartFiles() {
 			p.partFiles = append(p.partFiles, entry)
 		}
 	}
+	// 按照 part 的序号排序，避免 10 排在 2 之前
+	sort.Slice(p.partFiles, func(i, j int) bool {
+		return partFileIndex(p.partFiles[i].Name()) < partFileIndex(p.partFiles[j].Name())
+	})
 }
 
 func (p *PartUploader) GetStorage() storage.ReplayStorage {
@@ -196,6 +254,86 @@ func (p *PartUploader) GetStorage() storage.ReplayStorage {
 
 const recordDirTimeFormat = "2006-01-02"
 
+const gapReasonPartTruncated = "replay part truncated"
+
+// compressPartFile 启用加密时，part 文件和压缩后的文件都是加密的，返回压缩文件明文的 sha256；
+// part 文件被截断时只压缩通过校验的部分，truncated 为 true
+func compressPartFile(src, dst string) (hash string, truncated bool, err error) {
+	reader, err := encrypt.OpenFile(src)
+	if err != nil {
+		return "", false, err
+	}
+	defer reader.Close()
+	writer, err := encrypt.CreateFile(dst)
+	if err != nil {
+		return "", false, err
+	}
+	h := sha256.New()
+	gzWriter := gzip.NewWriter(io.MultiWriter(writer, h))
+	if _, err = io.Copy(gzWriter, reader); err != nil {
+		if !errors.Is(err, encrypt.ErrTruncated) {
+			_ = gzWriter.Close()
+			_ = writer.Close()
+			return "", false, err
+		}
+		truncated = true
+	}
+	if err = gzWriter.Close(); err != nil {
+		_ = writer.Close()
+		return "", false, err
+	}
+	if err = writer.Close(); err != nil {
+		return "", false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), truncated, nil
+}
+
+// truncatedPartGaps 截断的 part 缺失到下一个 part 开始(或者会话结束)的录像
+func truncatedPartGaps(parts []PartFileMeta, endTime int64) []ReplayGap {
+	var gaps []ReplayGap
+	for i := range parts {
+		if !parts[i].Truncated {
+			continue
+		}
+		gap := ReplayGap{Start: parts[i].EndTime, End: endTime, Reason: gapReasonPartTruncated}
+		if i+1 < len(parts) {
+			gap.End = parts[i+1].StartTime
+		}
+		if gap.End < gap.Start {
+			gap.End = gap.Start
+		}
+		gaps = append(gaps, gap)
+	}
+	return gaps
+}
+
+// decryptUploadDir 将加密的上传文件解密到明文临时目录(见 encrypt.MkdirPlainTemp)，返回需要上传的目录
+func (p *PartUploader) decryptUploadDir(uploadPath string) (string, error) {
+	if !encrypt.Enabled() {
+		return uploadPath, nil
+	}
+	plainPath, err := encrypt.MkdirPlainTemp()
+	if err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(uploadPath)
+	if err != nil {
+		_ = os.RemoveAll(plainPath)
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		src := filepath.Join(uploadPath, entry.Name())
+		if err = encrypt.DecryptFile(src, filepath.Join(plainPath, entry.Name())); err != nil {
+			_ = os.RemoveAll(plainPath)
+			return "", err
+		}
+	}
+	return plainPath, nil
+}
+
 func (p *PartUploader) uploadToStorage(uploadPath string) {
 	// check whether to use ENABLE_VIDEO_WORKER
 	if videoWorkerClient := NewWorkerClient(*config.GlobalConfig); videoWorkerClient != nil {
@@ -204,10 +342,18 @@ func (p *PartUploader) uploadToStorage(uploadPath string) {
 			Height:  p.Info.OptimalScreenHeight,
 			Bitrate: 1,
 		}
-		taskId, err := videoWorkerClient.CreateReplaySessionTask(p.SessionId, uploadPath, &taskCfg)
+		plainPath, err := p.decryptUploadDir(uploadPath)
+		if err != nil {
+			logger.Errorf("PartUploader %s decrypt upload dir %s error: %v", p.SessionId, uploadPath, err)
+			return
+		}
+		if plainPath != uploadPath {
+			defer os.RemoveAll(plainPath)
+		}
+		taskId, err := videoWorkerClient.CreateReplaySessionTask(p.SessionId, plainPath, &taskCfg)
 		if err == nil {
 			logger.Infof("Create replay session VideoWorker task success, task id: %s", taskId)
-			if err = os.RemoveAll(p.RootPath); err != nil {
+			if err = sessionDirRefs.RemoveAll(p.RootPath); err != nil {
 				logger.Errorf("PartUploader %s remove root path %s error: %v", p.SessionId, p.RootPath, err)
 			}
 			return
@@ -226,14 +372,17 @@ func (p *PartUploader) uploadToStorage(uploadPath string) {
 	p.RecordLifecycleLog(model.ReplayUploadStart, model.EmptyLifecycleLog)
 	replayStorage := p.GetStorage()
 	storageType := replayStorage.TypeName()
-	dateRoot := p.replayMeta.DateStart.Format(recordDirTimeFormat)
-	targetRoot := strings.Join([]string{dateRoot, p.SessionId}, "/")
 	logger.Infof("PartUploader %s upload replay files: %v, type: %s", p.SessionId, uploadFiles, storageType)
 	totalSize := int64(0)
 	for _, uploadFile := range uploadFiles {
 		if uploadFile.IsDir() {
 			continue
 		}
+		if uploaded, ok := p.uploadState.Parts[uploadFile.Name()]; ok {
+			totalSize += uploaded.UploadSize
+			logger.Debugf("PartUploader %s file %s already uploaded", p.SessionId, uploadFile.Name())
+			continue
+		}
 		fileInfo, err := uploadFile.Info()
 		if err != nil {
 			logger.Errorf("PartUploader %s get file info %s error: %v", p.SessionId, uploadFile.Name(), err)
@@ -241,14 +390,18 @@ func (p *PartUploader) uploadToStorage(uploadPath string) {
 		}
 		totalSize += fileInfo.Size()
 		uploadFilePath := filepath.Join(uploadPath, uploadFile.Name())
-		targetFile := strings.Join([]string{targetRoot, uploadFile.Name()}, "/")
-		if err1 := replayStorage.Upload(uploadFilePath, targetFile); err1 != nil {
+		targetFile := p.targetName(uploadFile.Name())
+		err1 := encrypt.WithDecryptedFile(uploadFilePath, func(plainPath string) error {
+			return replayStorage.Upload(plainPath, targetFile)
+		})
+		if err1 != nil {
 			logger.Errorf("PartUploader %s upload file %s error: %v", p.SessionId, uploadFilePath, err1)
 			reason := model.SessionLifecycleLog{Reason: err1.Error()}
 			p.RecordLifecycleLog(model.ReplayUploadFailure, reason)
 			return
 		}
 		logger.Debugf("PartUploader %s upload file %s success", p.SessionId, uploadFilePath)
+		p.markUploaded(uploadFile.Name(), fileInfo.Size())
 	}
 	if _, err = p.ApiClient.FinishReplyWithSize(p.SessionId, totalSize); err != nil {
 		logger.Errorf("PartUploader %s finish replay error: %v", p.SessionId, err)
@@ -257,7 +410,7 @@ func (p *PartUploader) uploadToStorage(uploadPath string) {
 
 	p.RecordLifecycleLog(model.ReplayUploadSuccess, model.EmptyLifecycleLog)
 	logger.Infof("PartUploader %s upload replay success", p.SessionId)
-	if err = os.RemoveAll(p.RootPath); err != nil {
+	if err = sessionDirRefs.RemoveAll(p.RootPath); err != nil {
 		logger.Errorf("PartUploader %s remove root path %s error: %v", p.SessionId, p.RootPath, err)
 		return
 	}
@@ -307,7 +460,7 @@ func LoadPartMetaByFile(partFile string) (PartMeta, error) {
 }
 
 func LoadPartReplayTime(partFile string) (startTime int64, endTime int64, err error) {
-	fd, err := os.Open(partFile)
+	fd, err := encrypt.OpenFile(partFile)
 	if err != nil {
 		return 0, 0, err
 	}
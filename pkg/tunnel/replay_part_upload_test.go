@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"lion/pkg/encrypt"
+	"lion/pkg/guacd"
+)
+
+func TestPreparePartTruncated(t *testing.T) {
+	if err := encrypt.SetKey("test-key"); err != nil {
+		t.Fatal(err)
+	}
+	defer encrypt.SetKey("")
+
+	root := t.TempDir()
+	partName := "sid.0.part"
+	fd, err := os.Create(filepath.Join(root, partName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := encrypt.NewWriter(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	for i := 0; plain.Len() < 100*1024; i++ {
+		inst := guacd.NewInstruction(guacd.InstructionClientSync, strconv.Itoa(1000+i*10))
+		plain.WriteString(inst.String())
+	}
+	if _, err = writer.Write(plain.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	// lion 异常退出，最后一个 chunk 没有写入
+	_ = fd.Close()
+
+	uploadPath := filepath.Join(root, "upload")
+	_ = os.MkdirAll(uploadPath, os.ModePerm)
+	uploader := PartUploader{SessionId: "sid", RootPath: root}
+	meta, err := uploader.preparePart(uploadPath, partName)
+	if err != nil {
+		t.Fatalf("prepare truncated part: %v", err)
+	}
+	if !meta.Truncated {
+		t.Fatal("part not marked truncated")
+	}
+
+	gzFd, err := encrypt.OpenFile(filepath.Join(uploadPath, meta.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gzFd.Close()
+	gzReader, err := gzip.NewReader(gzFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := io.ReadAll(gzReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploaded) == 0 || len(uploaded) >= plain.Len() || !bytes.HasPrefix(plain.Bytes(), uploaded) {
+		t.Fatalf("uploaded %d bytes, want verified prefix of %d bytes", len(uploaded), plain.Len())
+	}
+	if meta.StartTime != 1000 || meta.EndTime <= meta.StartTime {
+		t.Fatalf("unexpected part time %d-%d", meta.StartTime, meta.EndTime)
+	}
+	if meta.Index == nil || len(meta.Index.Points) == 0 {
+		t.Fatal("index not rebuilt from verified prefix")
+	}
+	last := meta.Index.Points[len(meta.Index.Points)-1]
+	if last.Offset >= int64(len(uploaded)) {
+		t.Fatalf("index offset %d beyond uploaded data %d", last.Offset, len(uploaded))
+	}
+
+	next := PartFileMeta{Name: "sid.1.part.gz"}
+	next.StartTime = meta.EndTime + 5000
+	gaps := truncatedPartGaps([]PartFileMeta{meta, next}, next.StartTime+1000)
+	if len(gaps) != 1 || gaps[0].Start != meta.EndTime || gaps[0].End != next.StartTime {
+		t.Fatalf("unexpected gaps %+v", gaps)
+	}
+	gaps = truncatedPartGaps([]PartFileMeta{next, meta}, meta.EndTime+3000)
+	if len(gaps) != 1 || gaps[0].End != meta.EndTime+3000 {
+		t.Fatalf("unexpected gaps %+v", gaps)
+	}
+}
+
+func TestSessionDirLock(t *testing.T) {
+	root := t.TempDir()
+	sid := "sid"
+	lockPath := sessionLockPath(root, sid)
+	writeOwner := func(owner dirLockOwner) {
+		buf, _ := json.Marshal(owner)
+		if err := os.WriteFile(lockPath, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 存活的其他进程持有
+	writeOwner(dirLockOwner{Pid: os.Getppid(), Start: 1})
+	if err := LockSessionDir(root, sid); !errors.Is(err, ErrSessionDirLocked) {
+		t.Fatalf("lock held by live process: %v", err)
+	}
+	// 当前进程的 pid，启动时间不同，是重启前遗留的锁
+	writeOwner(dirLockOwner{Pid: os.Getpid(), Start: processStartTime - 1})
+	if err := LockSessionDir(root, sid); err != nil {
+		t.Fatalf("stale lock: %v", err)
+	}
+	// 同一个进程可以重复获取，最后一次释放时删除锁文件
+	if err := LockSessionDir(root, sid); err != nil {
+		t.Fatal(err)
+	}
+	UnlockSessionDir(root, sid)
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Fatalf("lock removed before last release: %v", err)
+	}
+	UnlockSessionDir(root, sid)
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Fatalf("lock not removed: %v", err)
+	}
+	UnlockSessionDir(root, sid)
+}
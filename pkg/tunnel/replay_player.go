@@ -0,0 +1,570 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/config"
+	"lion/pkg/display"
+	"lion/pkg/encrypt"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	播放 lion 节点上尚未上传(或上传失败)的录像 part 文件
+
+	浏览器发送的控制指令:
+		6.replay,4.play;
+		6.replay,5.pause;
+		6.replay,5.speed,1.2;      倍速
+		6.replay,4.seek,5.60000;   跳转到相对开始时间的毫秒数
+	lion 通过 jms_event,replay_status 返回播放状态
+*/
+
+const (
+	InstructionReplayControl = "replay"
+
+	replayActionPlay  = "play"
+	replayActionPause = "pause"
+	replayActionSpeed = "speed"
+	replayActionSeek  = "seek"
+
+	replayStatusEvent = "replay_status"
+
+	replayMaxSpeed = 16
+)
+
+var ErrNoReplayParts = errors.New("no replay part files")
+
+type replayPart struct {
+	Name  string
+	Path  string
+	Meta  PartMeta
+	Index *PartIndex
+}
+
+// loadReplayParts 按照 part 的序号排序，并加载 meta 和索引
+func loadReplayParts(rootPath, sessionId string) ([]*replayPart, error) {
+	entries, err := os.ReadDir(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]*replayPart, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), PartSuffix) {
+			continue
+		}
+		partPath := filepath.Join(rootPath, entry.Name())
+		part := replayPart{Name: entry.Name(), Path: partPath}
+		if buf, err1 := os.ReadFile(partPath + MetaSuffix); err1 == nil {
+			_ = json.Unmarshal(buf, &part.Meta)
+		} else if part.Meta, err1 = LoadPartMetaByFile(partPath); err1 != nil {
+			logger.Errorf("Replay %s load part %s meta err: %s", sessionId, entry.Name(), err1)
+			continue
+		}
+		if part.Index, err = LoadPartIndex(partPath + IndexSuffix); err != nil {
+			if part.Index, err = LoadPartIndexByFile(partPath); err != nil {
+				logger.Errorf("Replay %s load part %s index err: %s", sessionId, entry.Name(), err)
+				continue
+			}
+		}
+		if part.Meta.StartTime == 0 {
+			continue
+		}
+		parts = append(parts, &part)
+	}
+	if len(parts) == 0 {
+		return nil, ErrNoReplayParts
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return partFileIndex(parts[i].Name) < partFileIndex(parts[j].Name)
+	})
+	return parts, nil
+}
+
+type replayControl struct {
+	action string
+	value  string
+}
+
+type ReplayStatus struct {
+	State    string  `json:"state"`
+	Position int64   `json:"position"`
+	Duration int64   `json:"duration"`
+	Speed    float64 `json:"speed"`
+}
+
+type ReplayPlayer struct {
+	SessionId string
+	User      *model.User
+
+	parts []*replayPart
+	ws    *websocket.Conn
+
+	wsLock  sync.Mutex
+	wsBatch *wsBatchWriter
+
+	ctrlChan chan replayControl
+
+	speed  float64
+	paused bool
+
+	// web client 上已经创建的图层和离屏缓冲区，seek 时需要先清除
+	clientLayers map[int]struct{}
+
+	current  int
+	fd       io.ReadSeekCloser
+	reader   *bufio.Reader
+	offset   int64
+	lastSync int64
+	position int64
+}
+
+func (p *ReplayPlayer) String() string {
+	return fmt.Sprintf("%s(%s)", p.SessionId, p.User)
+}
+
+func (p *ReplayPlayer) startTime() int64 {
+	return p.parts[0].Meta.StartTime
+}
+
+func (p *ReplayPlayer) duration() int64 {
+	return p.parts[len(p.parts)-1].Meta.EndTime - p.startTime()
+}
+
+func (p *ReplayPlayer) writeWsMessage(msg []byte) error {
+	p.wsLock.Lock()
+	defer p.wsLock.Unlock()
+	return p.ws.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (p *ReplayPlayer) sendInstruction(inst guacd.Instruction) error {
+	_ = p.wsBatch.Flush()
+	return p.writeWsMessage([]byte(inst.String()))
+}
+
+func (p *ReplayPlayer) sendStatus(state string) error {
+	status := ReplayStatus{
+		State:    state,
+		Position: p.position,
+		Duration: p.duration(),
+		Speed:    p.speed,
+	}
+	data, _ := json.Marshal(status)
+	return p.sendInstruction(NewJmsEventInstruction(replayStatusEvent, string(data)))
+}
+
+func (p *ReplayPlayer) state() string {
+	if p.paused {
+		return replayActionPause
+	}
+	return replayActionPlay
+}
+
+func (p *ReplayPlayer) closePart() {
+	if p.fd != nil {
+		_ = p.fd.Close()
+		p.fd = nil
+		p.reader = nil
+	}
+}
+
+func (p *ReplayPlayer) openPart(index int, offset int64) error {
+	p.closePart()
+	fd, err := encrypt.OpenFile(p.parts[index].Path)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Seek(offset, io.SeekStart); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	p.fd = fd
+	p.reader = bufio.NewReader(fd)
+	p.current = index
+	p.offset = offset
+	p.lastSync = 0
+	return nil
+}
+
+func (p *ReplayPlayer) readInstruction() (guacd.Instruction, error) {
+	inst, err := ReadInstruction(p.reader)
+	if err != nil {
+		return inst, err
+	}
+	p.offset += int64(len(inst.String()))
+	return inst, nil
+}
+
+// seek 跳转到相对开始时间 position 的位置，从最近的关键帧(或者 part 开始)将指令处理到 display 中，
+// 再发送重建画面的关键帧
+func (p *ReplayPlayer) seek(position int64) error {
+	if position < 0 {
+		position = 0
+	}
+	target := p.startTime() + position
+	index := 0
+	for i := range p.parts {
+		if p.parts[i].Meta.StartTime <= target {
+			index = i
+		}
+	}
+	part := p.parts[index]
+	point, ok := part.Index.Lookup(target)
+	ok = ok && point.Offset > 0
+	screen := display.New()
+	startOffset := int64(0)
+	if ok {
+		if keyframe, found := part.Index.LookupKeyframe(point.Offset); found {
+			if err := loadKeyframe(part.Path, keyframe, screen); err != nil {
+				logger.Errorf("Replay %s load keyframe of part %s err: %s", p.SessionId, part.Name, err)
+				screen = display.New()
+			} else {
+				startOffset = keyframe.Offset
+			}
+		}
+	}
+	if err := p.openPart(index, startOffset); err != nil {
+		return err
+	}
+	if err := p.resetClient(); err != nil {
+		return err
+	}
+	if ok {
+		for p.offset < point.Offset {
+			inst, err := p.readInstruction()
+			if err != nil {
+				break
+			}
+			screen.Process(&inst)
+		}
+		for _, inst := range viewerKeyframe(screen) {
+			if err := p.writeInstruction(&inst); err != nil {
+				return err
+			}
+		}
+		syncInst := guacd.NewInstruction(guacd.InstructionClientSync, strconv.FormatInt(point.Time, 10))
+		if err := p.writeInstruction(&syncInst); err != nil {
+			return err
+		}
+		p.lastSync = point.Time
+	}
+	p.position = position
+	if p.lastSync > 0 {
+		p.position = p.lastSync - p.startTime()
+	}
+	return p.wsBatch.Flush()
+}
+
+func (p *ReplayPlayer) writeInstruction(inst *guacd.Instruction) error {
+	trackClientLayers(p.clientLayers, inst)
+	return p.wsBatch.WriteInstruction(inst)
+}
+
+// resetClient 删除 web client 上的图层和离屏缓冲区，清空默认图层，避免向前跳转时残留之后的画面
+func (p *ReplayPlayer) resetClient() error {
+	for index := range p.clientLayers {
+		if index == 0 {
+			continue
+		}
+		inst := guacd.NewInstruction(guacd.InstructionDrawingDispose, strconv.Itoa(index))
+		if err := p.wsBatch.WriteInstruction(&inst); err != nil {
+			return err
+		}
+		delete(p.clientLayers, index)
+	}
+	inst := guacd.NewInstruction(guacd.InstructionDrawingSize, "0", "0", "0")
+	return p.wsBatch.WriteInstruction(&inst)
+}
+
+// 绘制指令中图层参数的位置
+var layerArgIndexes = map[string][]int{
+	guacd.InstructionDrawingArc:       {0},
+	guacd.InstructionDrawingCfill:     {1},
+	guacd.InstructionDrawingClip:      {0},
+	guacd.InstructionDrawingClose:     {0},
+	guacd.InstructionDrawingCopy:      {0, 6},
+	guacd.InstructionDrawingCstroke:   {1},
+	guacd.InstructionDrawingCursor:    {2},
+	guacd.InstructionDrawingCurve:     {0},
+	guacd.InstructionDrawingDistort:   {0},
+	guacd.InstructionDrawingIdentity:  {0},
+	guacd.InstructionDrawingJpeg:      {1},
+	guacd.InstructionDrawingLfill:     {1, 2},
+	guacd.InstructionDrawingLine:      {0},
+	guacd.InstructionDrawingLstroke:   {1, 5},
+	guacd.InstructionDrawingMove:      {0, 1},
+	guacd.InstructionDrawingPng:       {1},
+	guacd.InstructionDrawingPop:       {0},
+	guacd.InstructionDrawingPush:      {0},
+	guacd.InstructionDrawingRect:      {0},
+	guacd.InstructionDrawingReset:     {0},
+	guacd.InstructionDrawingSet:       {0},
+	guacd.InstructionDrawingShade:     {0},
+	guacd.InstructionDrawingSize:      {0},
+	guacd.InstructionDrawingStart:     {0},
+	guacd.InstructionDrawingTransfer:  {0, 6},
+	guacd.InstructionDrawingTransform: {0},
+	guacd.InstructionStreamingImg:     {2},
+}
+
+func trackClientLayers(layers map[int]struct{}, inst *guacd.Instruction) {
+	if inst.Opcode == guacd.InstructionDrawingDispose {
+		if len(inst.Args) > 0 {
+			delete(layers, atoi(inst.Args[0]))
+		}
+		return
+	}
+	for _, i := range layerArgIndexes[inst.Opcode] {
+		if i < len(inst.Args) {
+			layers[atoi(inst.Args[i])] = struct{}{}
+		}
+	}
+}
+
+// wait 按照倍速等待，期间处理控制指令，发生跳转时返回 true
+func (p *ReplayPlayer) wait(ctx context.Context, delay time.Duration) (bool, error) {
+	remain := time.Duration(float64(delay) / p.speed)
+	for {
+		var (
+			timer   *time.Timer
+			timerCh <-chan time.Time
+		)
+		start := time.Now()
+		if !p.paused {
+			if remain <= 0 {
+				return false, nil
+			}
+			timer = time.NewTimer(remain)
+			timerCh = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-timerCh:
+			return false, nil
+		case ctrl := <-p.ctrlChan:
+			if timer != nil {
+				timer.Stop()
+				remain -= time.Since(start)
+			}
+			speed := p.speed
+			seeked, err := p.handleControl(ctrl)
+			if err != nil || seeked {
+				return seeked, err
+			}
+			if speed != p.speed {
+				remain = time.Duration(float64(remain) * speed / p.speed)
+			}
+		}
+	}
+}
+
+func (p *ReplayPlayer) handleControl(ctrl replayControl) (bool, error) {
+	switch ctrl.action {
+	case INTERNALDATAOPCODE:
+		return false, p.sendInstruction(guacd.NewInstruction(INTERNALDATAOPCODE, PINGOPCODE))
+	case replayActionPlay:
+		p.paused = false
+	case replayActionPause:
+		p.paused = true
+	case replayActionSpeed:
+		speed, err := strconv.ParseFloat(ctrl.value, 64)
+		if err != nil || speed <= 0 || speed > replayMaxSpeed {
+			logger.Errorf("Replay %s invalid speed: %s", p, ctrl.value)
+			return false, nil
+		}
+		p.speed = speed
+	case replayActionSeek:
+		position, err := strconv.ParseInt(ctrl.value, 10, 64)
+		if err != nil {
+			logger.Errorf("Replay %s invalid seek position: %s", p, ctrl.value)
+			return false, nil
+		}
+		logger.Infof("Replay %s seek to %d", p, position)
+		if err = p.seek(position); err != nil {
+			return false, err
+		}
+		return true, p.sendStatus(p.state())
+	default:
+		return false, nil
+	}
+	return false, p.sendStatus(p.state())
+}
+
+func (p *ReplayPlayer) Run(ctx context.Context) error {
+	defer p.closePart()
+	defer p.wsBatch.Reset()
+	if err := p.seek(0); err != nil {
+		return err
+	}
+	if err := p.sendStatus(p.state()); err != nil {
+		return err
+	}
+	lastStatus := p.position
+	for {
+		if p.paused {
+			if _, err := p.wait(ctx, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		inst, err := p.readInstruction()
+		if err != nil {
+			if err != io.EOF {
+				logger.Errorf("Replay %s read part %s err: %s", p, p.parts[p.current].Name, err)
+			}
+			if p.current+1 < len(p.parts) {
+				if err = p.openPart(p.current+1, 0); err != nil {
+					return err
+				}
+				continue
+			}
+			// 播放结束后暂停，可以继续跳转
+			p.paused = true
+			p.position = p.duration()
+			if err = p.sendStatus("finished"); err != nil {
+				return err
+			}
+			continue
+		}
+		if inst.Opcode == guacd.InstructionClientSync && len(inst.Args) > 0 {
+			syncTime, _ := strconv.ParseInt(inst.Args[0], 10, 64)
+			if p.lastSync > 0 && syncTime > p.lastSync {
+				_ = p.wsBatch.Flush()
+				seeked, err1 := p.wait(ctx, time.Duration(syncTime-p.lastSync)*time.Millisecond)
+				if err1 != nil {
+					return err1
+				}
+				if seeked {
+					lastStatus = p.position
+					continue
+				}
+			}
+			p.lastSync = syncTime
+			p.position = syncTime - p.startTime()
+		}
+		if err = p.writeInstruction(&inst); err != nil {
+			return err
+		}
+		// 每秒通知一次播放进度
+		if p.position-lastStatus >= 1000 {
+			lastStatus = p.position
+			if err = p.sendStatus(p.state()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *ReplayPlayer) readClient(ctx context.Context, cancel context.CancelFunc) {
+	defer cancel()
+	for {
+		_, message, err := p.ws.ReadMessage()
+		if err != nil {
+			logger.Infof("Replay %s ws read err: %s", p, err)
+			return
+		}
+		inst, err := guacd.ParseInstructionString(string(message))
+		if err != nil {
+			continue
+		}
+		var ctrl replayControl
+		switch {
+		case inst.Opcode == INTERNALDATAOPCODE && len(inst.Args) >= 2 && inst.Args[0] == PINGOPCODE:
+			ctrl.action = INTERNALDATAOPCODE
+		case inst.Opcode == InstructionReplayControl && len(inst.Args) > 0:
+			ctrl.action = inst.Args[0]
+			if len(inst.Args) > 1 {
+				ctrl.value = inst.Args[1]
+			}
+		default:
+			continue
+		}
+		select {
+		case p.ctrlChan <- ctrl:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *GuacamoleTunnelServer) Replay(ctx *gin.Context) {
+	ws, err := getUpGrader().Upgrade(ctx.Writer, ctx.Request, ctx.Writer.Header())
+	if err != nil {
+		logger.Errorf("Websocket Upgrade err: %+v", err)
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	defer ws.Close()
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok {
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrAuthUser.String()))
+		return
+	}
+	user := userItem.(*model.User)
+	sessionId, ok := ctx.GetQuery("SESSION_ID")
+	if !ok || sessionId != filepath.Base(sessionId) {
+		logger.Error("No session param found")
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrBadParams.String()))
+		return
+	}
+	result, err := g.ValidateReplayPermission(ctx, sessionId)
+	if err != nil {
+		logger.Errorf("Validate replay session err: %s", err)
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrAPIFailed.String()))
+		return
+	}
+	if !result.Ok {
+		logger.Errorf("Validate replay session failed : %s", result.Msg)
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrPermission.String()))
+		return
+	}
+	rootPath := filepath.Join(config.GlobalConfig.SessionFolderPath, sessionId)
+	// 回放期间上传完成的会话目录在回放结束后删除
+	sessionDirRefs.Acquire(rootPath)
+	defer sessionDirRefs.Release(rootPath)
+	parts, err := loadReplayParts(rootPath, sessionId)
+	if err != nil {
+		logger.Errorf("Replay session %s load parts err: %s", sessionId, err)
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrNoSession.String()))
+		return
+	}
+	player := ReplayPlayer{
+		SessionId: sessionId,
+		User:      user,
+		parts:     parts,
+		ws:        ws,
+		ctrlChan:  make(chan replayControl),
+		speed:     1,
+
+		clientLayers: make(map[int]struct{}),
+	}
+	player.wsBatch = newWsBatchWriter(player.writeWsMessage)
+	logger.Infof("User %s start to replay session %s", user, sessionId)
+	defer logger.Infof("User %s stop to replay session %s", user, sessionId)
+
+	runCtx, cancel := context.WithCancel(ctx.Request.Context())
+	defer cancel()
+	go player.readClient(runCtx, cancel)
+	if err = player.Run(runCtx); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Errorf("Replay %s err: %s", &player, err)
+	}
+}
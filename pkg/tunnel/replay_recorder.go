@@ -4,18 +4,21 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/jumpserver-dev/sdk-go/common"
 	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver-dev/sdk-go/service"
 
 	"lion/pkg/config"
+	"lion/pkg/encrypt"
 	"lion/pkg/guacd"
 	"lion/pkg/logger"
 	"lion/pkg/session"
@@ -30,41 +33,201 @@ type ReplayRecorder struct {
 	newPartChan   chan struct{}
 	currentIndex  int
 	MaxSize       int
-	apiClient     *service.JMService
+	// part 的最长时间(毫秒)，0 表示不限制
+	MaxDuration int64
+	apiClient   *service.JMService
+
+	uploadLock sync.Mutex
+
+	// 强制录像模式，录像无法建立或者中断后 RecoverTimeout 内无法恢复，通知会话终止
+	Required       bool
+	RecoverTimeout time.Duration
+	OnStatus       func(status RecorderStatus, err error)
+
+	partStatusChan chan partStatus
+	gaps           []ReplayGap
+
+	// 正在录制的 part，用户输入的注释写入该 part
+	partLock    sync.Mutex
+	currentPart *PartRecorder
+
+	markerLock sync.Mutex
+	markers    []ReplayMarker
+
+	chatLock sync.Mutex
+	chats    []ChatMessage
 
 	RootPath string
 	wg       sync.WaitGroup
 }
 
+type RecorderStatus int
+
+const (
+	RecorderRecording RecorderStatus = iota + 1
+	RecorderBroken
+	RecorderFailed
+)
+
+var ErrReplayStorageNull = errors.New("replay storage is null")
+
+// 录像中断后重新 join 的间隔，非强制录像模式下逐渐增加到 recorderMaxRetryInterval
+const (
+	recorderRetryInterval    = time.Second
+	recorderMaxRetryInterval = 30 * time.Second
+)
+
+// partStatus part 开始录制(err 为 nil)或者异常结束，时间为 guacd sync 的时间戳(毫秒)
+type partStatus struct {
+	index     int
+	err       error
+	startTime int64
+	endTime   int64
+}
+
 func (r *ReplayRecorder) run(ctx context.Context) {
-	r.startRecordPartReplay(ctx)
+	defer r.wg.Done()
+	var (
+		recording     bool
+		lastErr       error
+		gap           *ReplayGap
+		retryInterval time.Duration
+		recoverTimer  *time.Timer
+		recoverChan   <-chan time.Time
+		retryChan     <-chan time.Time
+	)
+	if r.Required {
+		// 第一个 part 也需要在 RecoverTimeout 内建立
+		recoverTimer = time.NewTimer(r.RecoverTimeout)
+		recoverChan = recoverTimer.C
+	}
+	defer func() {
+		if recoverTimer != nil {
+			recoverTimer.Stop()
+		}
+	}()
+	r.startRecordPartReplay(ctx, nil)
 	for {
 		select {
 		case <-ctx.Done():
+			// 会话结束时仍未恢复，缺失到会话结束
+			if gap != nil {
+				gap.End = time.Now().UnixMilli()
+				r.addGap(*gap)
+			}
 			logger.Infof("ReplayRecorder %s done", r.SessionId)
 			return
 		case <-r.newPartChan:
 			r.currentIndex++
-			r.startRecordPartReplay(ctx)
+			r.startRecordPartReplay(ctx, nil)
+		case status := <-r.partStatusChan:
+			if status.err == nil {
+				if recoverTimer != nil {
+					recoverTimer.Stop()
+					recoverTimer = nil
+					recoverChan = nil
+				}
+				if gap != nil {
+					gap.End = status.startTime
+					r.addGap(*gap)
+					logger.Infof("ReplayRecorder %s recovered at part %d, missing %d ms",
+						r.SessionId, status.index, gap.Duration())
+					gap = nil
+				}
+				retryInterval = 0
+				if !recording {
+					recording = true
+					logger.Infof("ReplayRecorder %s part %d recording", r.SessionId, status.index)
+					r.notifyStatus(RecorderRecording, nil)
+				}
+				continue
+			}
+			logger.Errorf("ReplayRecorder %s part %d broken: %v", r.SessionId, status.index, status.err)
+			lastErr = status.err
+			if gap == nil {
+				start := status.endTime
+				if start == 0 {
+					start = time.Now().UnixMilli()
+				}
+				gap = &ReplayGap{Start: start, Reason: status.err.Error()}
+			}
+			if recording {
+				recording = false
+				r.notifyStatus(RecorderBroken, status.err)
+			}
+			switch {
+			case r.Required:
+				if recoverTimer == nil {
+					recoverTimer = time.NewTimer(r.RecoverTimeout)
+					recoverChan = recoverTimer.C
+				}
+				retryInterval = recorderRetryInterval
+			case retryInterval == 0:
+				retryInterval = recorderRetryInterval
+			default:
+				retryInterval = min(retryInterval*2, recorderMaxRetryInterval)
+			}
+			retryChan = time.After(retryInterval)
+		case <-retryChan:
+			retryChan = nil
+			r.currentIndex++
+			logger.Infof("ReplayRecorder %s retry record part %d", r.SessionId, r.currentIndex)
+			r.startRecordPartReplay(ctx, gap)
+		case <-recoverChan:
+			if lastErr == nil {
+				lastErr = fmt.Errorf("not recording in %s", r.RecoverTimeout)
+			}
+			logger.Errorf("ReplayRecorder %s not recover in %s: %v", r.SessionId, r.RecoverTimeout, lastErr)
+			if gap != nil {
+				gap.End = time.Now().UnixMilli()
+				r.addGap(*gap)
+			}
+			r.notifyStatus(RecorderFailed, lastErr)
+			return
 		}
 	}
 }
 
-func (r *ReplayRecorder) startRecordPartReplay(ctx context.Context) {
+func (r *ReplayRecorder) notifyStatus(status RecorderStatus, err error) {
+	if r.OnStatus != nil {
+		r.OnStatus(status, err)
+	}
+}
+
+func (r *ReplayRecorder) sendPartStatus(ctx context.Context, status partStatus) {
+	select {
+	case r.partStatusChan <- status:
+	case <-ctx.Done():
+	}
+}
+
+// startRecordPartReplay gap 不为空说明是录像中断后恢复的 part
+func (r *ReplayRecorder) startRecordPartReplay(ctx context.Context, gap *ReplayGap) {
 	r.wg.Add(1)
-	go r.recordReplay(ctx, &r.wg)
+	go r.recordReplay(ctx, &r.wg, r.currentIndex, gap)
 }
 
-func (r *ReplayRecorder) Start(ctx context.Context) {
+func (r *ReplayRecorder) Start(ctx context.Context) error {
 	if r.tunnelSession.TerminalConfig.ReplayStorage.TypeName == "null" {
+		if r.Required {
+			logger.Errorf("ReplayRecorder %s storage is null, but replay is required", r.SessionId)
+			return ErrReplayStorageNull
+		}
 		logger.Warnf("ReplayRecorder %s storage is null, not record", r.SessionId)
-		return
+		return nil
 	}
 	rootPath := filepath.Join(config.GlobalConfig.SessionFolderPath, r.SessionId)
 	_ = os.MkdirAll(rootPath, os.ModePerm)
 	r.RootPath = rootPath
+	// 录像和会话结束后的上传期间持有会话目录的锁，离线的 upload 命令不会处理进行中的会话
+	if err := LockSessionDir(rootPath, r.SessionId); err != nil {
+		logger.Errorf("ReplayRecorder %s lock session dir error: %v", r.SessionId, err)
+	}
 	r.WriteSessionMeta(r.tunnelSession.Created)
+	r.partStatusChan = make(chan partStatus)
+	r.wg.Add(1)
 	go r.run(ctx)
+	return nil
 }
 
 func (r *ReplayRecorder) WriteSessionMeta(t common.UTCTime) {
@@ -84,30 +247,36 @@ func (r *ReplayRecorder) WriteSessionMeta(t common.UTCTime) {
 	logger.Infof("ReplayRecorder(%s) Write session meta file %s success", r.SessionId, metaFilename)
 }
 
+// 小于 5KB 的 part 认为是连接失败的录像
+const partMinSize = int64(1024) * 5
+
 func (r *ReplayRecorder) IsConnectFailed() bool {
-	// 检测录像文件是否存在，且大小大于 5KB 只检测第一个录像文件大小
-	minSize := int64(1024) * 5
-	partFilename := r.GetPartFilenameByIndex(0)
-	partFilePath := filepath.Join(r.RootPath, partFilename)
-	fi, err := os.Stat(partFilePath)
-	if err != nil {
-		logger.Errorf("ReplayRecorder %s get part file %s error: %v", r.SessionId, partFilename, err)
-		return true
-	}
-	if fi.IsDir() {
-		logger.Warnf("ReplayRecorder %s part file %s is a directory, not connect failed", r.SessionId, partFilename)
-		return true
-	}
-	if fi.Size() <= minSize {
-		logger.Infof("ReplayRecorder %s part file %s size %d < 5KB, not connect failed", r.SessionId, partFilename, fi.Size())
-		return true
+	// 检测录像文件是否存在，且大小大于 5KB；第一个 part 录像中断时，检测之后恢复的 part
+	minSize := partMinSize
+	for i := 0; i <= r.currentIndex; i++ {
+		partFilename := r.GetPartFilenameByIndex(i)
+		partFilePath := filepath.Join(r.RootPath, partFilename)
+		fi, err := os.Stat(partFilePath)
+		if err != nil {
+			logger.Errorf("ReplayRecorder %s get part file %s error: %v", r.SessionId, partFilename, err)
+			continue
+		}
+		if fi.IsDir() {
+			logger.Warnf("ReplayRecorder %s part file %s is a directory, not connect failed", r.SessionId, partFilename)
+			continue
+		}
+		if fi.Size() <= minSize {
+			logger.Infof("ReplayRecorder %s part file %s size %d < 5KB, not connect failed", r.SessionId, partFilename, fi.Size())
+			continue
+		}
+		return false
 	}
-	return false
+	return true
 }
 
 func (r *ReplayRecorder) CleanFailedPartFileReplay() {
 	// 删除后续异常的文件
-	minSize := int64(1024) * 5
+	minSize := partMinSize
 	for i := 0; i < r.currentIndex; i++ {
 		partFilename := r.GetPartFilenameByIndex(i)
 		partFilePath := filepath.Join(r.RootPath, partFilename)
@@ -125,6 +294,8 @@ func (r *ReplayRecorder) CleanFailedPartFileReplay() {
 			partMeatFilePath := partFilePath + MetaSuffix
 			_ = os.Remove(partFilePath)
 			_ = os.Remove(partMeatFilePath)
+			_ = os.Remove(partFilePath + IndexSuffix)
+			_ = os.Remove(partFilePath + KeyframesSuffix)
 		}
 	}
 }
@@ -143,13 +314,17 @@ func (r *ReplayRecorder) Stop() {
 	// 检测会话文件大小是否满足录像要求，否则判断连接失败，不上传录像文件。
 	if r.IsConnectFailed() {
 		logger.Warnf("ReplayRecorder %s connect failed, not upload replay parts", r.SessionId)
-		if err := os.RemoveAll(r.RootPath); err != nil {
+		if err := sessionDirRefs.RemoveAll(r.RootPath); err != nil {
 			logger.Errorf("ReplayRecorder %s remove root path %s error: %v", r.SessionId, r.RootPath, err)
 		}
+		UnlockSessionDir(r.RootPath, r.SessionId)
 		return
 	}
 	r.CleanFailedPartFileReplay()
-	go uploader.Start()
+	go func() {
+		defer UnlockSessionDir(r.RootPath, r.SessionId)
+		uploader.Start()
+	}()
 	logger.Infof("Replay recorder %s stop and uploading replay parts", r.SessionId)
 }
 
@@ -166,6 +341,8 @@ type PartMeta struct {
 	EndTime   int64 `json:"end,omitempty"`
 	Duration  int64 `json:"duration,omitempty"`
 	Size      int64 `json:"size,omitempty"`
+
+	Gap *ReplayGap `json:"gap,omitempty"`
 }
 
 const (
@@ -173,15 +350,19 @@ const (
 	MetaSuffix = ".meta"
 )
 
-func (r *ReplayRecorder) recordReplay(ctx context.Context, wg *sync.WaitGroup) {
+func (r *ReplayRecorder) recordReplay(ctx context.Context, wg *sync.WaitGroup, index int, gap *ReplayGap) {
 	defer wg.Done()
+	// 每次都使用新的 join 连接，中断后恢复也是如此
 	joinTunnel, err1 := guacd.NewTunnel(r.guacdAddr, r.conf, r.info)
 	if err1 != nil {
 		logger.Errorf("Join replay tunnel %s failed: %v", r.SessionId, err1)
+		if ctx.Err() == nil {
+			r.sendPartStatus(ctx, partStatus{index: index, err: err1})
+		}
 		return
 	}
 	defer joinTunnel.Close()
-	partFilename := r.GetPartFilename()
+	partFilename := r.GetPartFilenameByIndex(index)
 	partMetaFilename := partFilename + MetaSuffix
 	partFilePath := filepath.Join(r.RootPath, partFilename)
 	partMetaFilePath := filepath.Join(r.RootPath, partMetaFilename)
@@ -192,12 +373,82 @@ func (r *ReplayRecorder) recordReplay(ctx context.Context, wg *sync.WaitGroup) {
 		PartFilename: partFilename,
 		PartFilePath: partFilePath,
 		MaxSize:      r.MaxSize,
-		currentIndex: r.currentIndex,
+		MaxDuration:  r.MaxDuration,
+		currentIndex: index,
+
+		KeyframeInterval: int64(config.GlobalConfig.ReplayKeyframeInterval) * 1000,
 		ExitSignal: func() {
 			r.newPartChan <- struct{}{}
 		},
+		OnReady: func(startTime int64) {
+			r.sendPartStatus(ctx, partStatus{index: index, startTime: startTime})
+		},
+	}
+	if gap != nil {
+		partRecorder.Gap = &ReplayGap{Start: gap.Start, Reason: gap.Reason}
+	}
+	r.setCurrentPart(&partRecorder)
+	err := partRecorder.Start(ctx, joinTunnel)
+	r.clearCurrentPart(&partRecorder)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		r.sendPartStatus(ctx, partStatus{index: index, err: err, endTime: partRecorder.EndTime})
+	}
+	// 会话未结束说明是切换了新的 part 或者录像中断，在后台上传已经结束的 part
+	wg.Add(1)
+	go r.uploadPart(partFilename, wg)
+}
+
+func (r *ReplayRecorder) setCurrentPart(part *PartRecorder) {
+	r.partLock.Lock()
+	defer r.partLock.Unlock()
+	r.currentPart = part
+}
+
+// clearCurrentPart 切换 part 时新的 part 已经设置为当前 part，不需要清理
+func (r *ReplayRecorder) clearCurrentPart(part *PartRecorder) {
+	r.partLock.Lock()
+	defer r.partLock.Unlock()
+	if r.currentPart == part {
+		r.currentPart = nil
+	}
+}
+
+// RecordInput 将用户输入的注释指令写入正在录制的 part
+func (r *ReplayRecorder) RecordInput(inst guacd.Instruction) {
+	r.partLock.Lock()
+	part := r.currentPart
+	r.partLock.Unlock()
+	if part != nil {
+		part.WriteAnnotation(inst)
+	}
+}
+
+func (r *ReplayRecorder) uploadPart(partFilename string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	// video worker 需要完整的 upload 目录，只在会话结束时上传
+	if config.GlobalConfig.EnableVideoWorker {
+		return
+	}
+	partFilePath := filepath.Join(r.RootPath, partFilename)
+	if fi, err := os.Stat(partFilePath); err != nil || fi.Size() <= partMinSize {
+		return
+	}
+	r.uploadLock.Lock()
+	defer r.uploadLock.Unlock()
+	uploader := PartUploader{
+		RootPath:  r.RootPath,
+		SessionId: r.SessionId,
+		ApiClient: r.apiClient,
+		TermCfg:   r.tunnelSession.TerminalConfig,
+		Info:      r.info,
+	}
+	if err := uploader.UploadPart(partFilename); err != nil {
+		logger.Errorf("ReplayRecorder %s upload part %s failed, retry when session finished: %v",
+			r.SessionId, partFilename, err)
 	}
-	partRecorder.Start(ctx, joinTunnel)
 }
 
 func NewReplayConfiguration(conf *guacd.Configuration, connectionId string) guacd.Configuration {
@@ -215,31 +466,53 @@ type PartRecorder struct {
 	PartFilename string
 	PartFilePath string
 
-	MaxSize      int
-	currentIndex int
-	ExitSignal   func()
+	MaxSize     int
+	MaxDuration int64
+	// 关键帧的间隔(毫秒)，0 不生成关键帧
+	KeyframeInterval int64
+	currentIndex     int
+	ExitSignal       func()
+	// 收到第一个 sync 时调用
+	OnReady func(startTime int64)
+	// 录像中断后恢复的 part，记录和之前录像之间缺失的时间段
+	Gap *ReplayGap
 
 	StartTime int64
 	EndTime   int64
+
+	// 录像中穿插用户输入的注释指令，写入需要加锁
+	writeLock sync.Mutex
+	writer    *bufio.Writer
+	written   int
+	indexer   *replayIndexer
+	keyframes *keyframeRecorder
+	closed    bool
 }
 
 func (p *PartRecorder) String() string {
 	return fmt.Sprintf("%s, part %d", p.Id, p.currentIndex)
 }
 
-func (p *PartRecorder) Start(ctx context.Context, joinTunnel *guacd.Tunnel) {
-	fd, err := os.Create(p.PartFilePath)
+// Start 录制 part 直到切换 part、会话结束或者 guacd 断开，其他原因导致的中断返回 error
+func (p *PartRecorder) Start(ctx context.Context, joinTunnel *guacd.Tunnel) error {
+	fd, err := encrypt.CreateFile(p.PartFilePath)
 	if err != nil {
 		logger.Errorf("PartRecorder create replay file %s failed: %v", p.PartFilePath, err)
-		return
+		return err
 	}
 	defer fd.Close()
-	writer := bufio.NewWriter(fd)
-	defer writer.Flush()
-	totalWrittenSize := 0
+	p.writeLock.Lock()
+	p.writer = bufio.NewWriter(fd)
+	p.indexer = newReplayIndexer()
+	if p.KeyframeInterval > 0 {
+		p.keyframes = newKeyframeRecorder(p.PartFilePath, p.KeyframeInterval)
+	}
+	p.writeLock.Unlock()
+	defer p.close()
 	disconnectInst := guacd.NewInstruction(guacd.InstructionClientDisconnect)
 	var (
-		waitExit bool
+		waitExit  bool
+		recordErr error
 	)
 	for {
 		inst, err2 := joinTunnel.ReadInstruction()
@@ -249,6 +522,9 @@ func (p *PartRecorder) Start(ctx context.Context, joinTunnel *guacd.Tunnel) {
 				break
 			}
 			logger.Warnf("PartRecorder(%s) read failed: %v", p, err2)
+			if !waitExit {
+				recordErr = err2
+			}
 			break
 		}
 		if inst.Opcode == INTERNALDATAOPCODE && len(inst.Args) >= 2 && inst.Args[0] == PINGOPCODE {
@@ -276,6 +552,12 @@ func (p *PartRecorder) Start(ctx context.Context, joinTunnel *guacd.Tunnel) {
 				p.EndTime = syncTime
 				if p.StartTime == 0 {
 					p.StartTime = syncTime
+					if p.Gap != nil {
+						p.Gap.End = syncTime
+					}
+					if p.OnReady != nil {
+						p.OnReady(syncTime)
+					}
 				}
 			}
 		case guacd.InstructionClientNop:
@@ -284,12 +566,13 @@ func (p *PartRecorder) Start(ctx context.Context, joinTunnel *guacd.Tunnel) {
 			continue
 		default:
 		}
-		wr, err3 := writer.WriteString(inst.String())
+		totalWrittenSize, err3 := p.writeInstruction(&inst)
 		if err3 != nil {
 			logger.Errorf("PartRecorder(%s) write failed: %v", p, err3)
+			recordErr = err3
+			break
 		}
-		totalWrittenSize += wr
-		if totalWrittenSize > p.MaxSize && !waitExit {
+		if (totalWrittenSize > p.MaxSize || p.exceedMaxDuration()) && !waitExit {
 			_ = joinTunnel.WriteInstructionAndFlush(disconnectInst)
 			waitExit = true
 			logger.Infof("PartRecorder(%s) finish, start new part", p)
@@ -302,7 +585,55 @@ func (p *PartRecorder) Start(ctx context.Context, joinTunnel *guacd.Tunnel) {
 			break
 		}
 	}
-	p.WritePartMeta(totalWrittenSize)
+	return recordErr
+}
+
+func (p *PartRecorder) writeInstruction(inst *guacd.Instruction) (int, error) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	return p.write(inst)
+}
+
+func (p *PartRecorder) write(inst *guacd.Instruction) (int, error) {
+	wr, err := p.writer.WriteString(inst.String())
+	if err != nil {
+		return p.written, err
+	}
+	p.indexer.Add(inst, int64(p.written), int64(wr))
+	p.written += wr
+	if p.keyframes != nil {
+		p.keyframes.Add(*inst, int64(p.written))
+	}
+	return p.written, nil
+}
+
+// WriteAnnotation 写入用户输入的注释指令，part 未开始或者已经结束时丢弃
+func (p *PartRecorder) WriteAnnotation(inst guacd.Instruction) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	if p.writer == nil || p.closed {
+		return
+	}
+	if _, err := p.write(&inst); err != nil {
+		logger.Errorf("PartRecorder(%s) write annotation failed: %v", p, err)
+	}
+}
+
+func (p *PartRecorder) close() {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	p.closed = true
+	_ = p.writer.Flush()
+	p.WritePartMeta(p.written)
+	index := p.indexer.Index()
+	if p.keyframes != nil {
+		index.Keyframes = p.keyframes.Stop()
+	}
+	p.WritePartIndex(index)
+}
+
+func (p *PartRecorder) exceedMaxDuration() bool {
+	return p.MaxDuration > 0 && p.StartTime > 0 && p.EndTime-p.StartTime >= p.MaxDuration
 }
 
 func (p *PartRecorder) WritePartMeta(size int) {
@@ -312,8 +643,18 @@ func (p *PartRecorder) WritePartMeta(size int) {
 		Duration:  p.EndTime - p.StartTime,
 		Size:      int64(size),
 	}
+	if p.Gap != nil && p.Gap.End > 0 {
+		meta.Gap = p.Gap
+	}
 	metaBuf, _ := json.Marshal(meta)
 	if err := os.WriteFile(p.MetaFilePath, metaBuf, os.ModePerm); err != nil {
 		logger.Errorf("Write replay meta file %s failed: %v", p.MetaFilename, err)
 	}
 }
+
+func (p *PartRecorder) WritePartIndex(index *PartIndex) {
+	indexPath := p.PartFilePath + IndexSuffix
+	if err := WritePartIndex(indexPath, index); err != nil {
+		logger.Errorf("Write replay index file %s failed: %v", indexPath, err)
+	}
+}
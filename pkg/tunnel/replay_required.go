@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/logger"
+)
+
+/*
+	强制录像模式
+
+	录像在 REPLAY_RECOVER_TIMEOUT 内开始写入之后，才开始转发用户的输入；
+	会话过程中录像中断时锁定输入(和管理员锁定会话一样只转发 sync 等指令)，录像恢复后解锁，
+	超时未恢复则终止会话，并记录生命周期日志。
+*/
+
+const (
+	replayRecorderOperator   = "Replay recorder"
+	reasonReplayRecordFailed = "Replay recording failed"
+)
+
+// requireRecorder 开启强制录像，需要在录像 Start 之前调用
+func (t *Connection) requireRecorder(recorder *ReplayRecorder) {
+	t.recordReady = make(chan struct{}, 1)
+	t.recordFailed = make(chan error, 1)
+	recorder.Required = true
+	recorder.OnStatus = t.handleRecorderStatus
+}
+
+func (t *Connection) handleRecorderStatus(status RecorderStatus, err error) {
+	switch status {
+	case RecorderRecording:
+		select {
+		case t.recordReady <- struct{}{}:
+		default:
+		}
+		if t.recordBroken.CompareAndSwap(true, false) {
+			logger.Infof("Session[%s] replay recorder recovered, resume input", t)
+			t.notifyRecorderPause(false, "")
+		}
+	case RecorderBroken:
+		t.recordBroken.Store(true)
+		logger.Errorf("Session[%s] replay recorder broken, lock input: %v", t, err)
+		t.notifyRecorderPause(true, err.Error())
+	case RecorderFailed:
+		t.recordBroken.Store(true)
+		select {
+		case t.recordFailed <- err:
+		default:
+		}
+	}
+}
+
+// notifyRecorderPause 通知 web client 和分享、监控的用户，管理员锁定的会话不会因为录像恢复而解锁
+func (t *Connection) notifyRecorderPause(pause bool, reason string) {
+	event, action := "session_resume", ShareSessionResume
+	if pause {
+		event, action = "session_pause", ShareSessionPause
+	}
+	p, _ := json.Marshal(map[string]interface{}{
+		"user":   replayRecorderOperator,
+		"reason": reason,
+	})
+	_ = t.SendWsMessage(NewJmsEventInstruction(event, string(p)))
+	if !pause && t.lockedStatus.Load() {
+		return
+	}
+	t.notifySessionAction(action, replayRecorderOperator)
+}
+
+// isInputLocked 管理员锁定了会话，或者强制录像模式下录像中断
+func (t *Connection) isInputLocked() bool {
+	return t.lockedStatus.Load() || t.recordBroken.Load()
+}
+
+// waitRecorder 等待录像开始写入，录像无法建立时返回 error
+func (t *Connection) waitRecorder(ctx context.Context) error {
+	select {
+	case <-t.recordReady:
+		return nil
+	case err := <-t.recordFailed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Connection) terminateByRecorder(err error) {
+	_ = t.SendWsMessage(ErrReplayRecordFailed.Instruction())
+	logger.Errorf("Session[%s] terminated by replay recording failed: %v", t, err)
+	reason := model.SessionLifecycleLog{Reason: fmt.Sprintf("%s: %s", reasonReplayRecordFailed, err)}
+	t.Service.RecordLifecycleLog(t.Sess.ID, model.AssetConnectFinished, reason)
+}
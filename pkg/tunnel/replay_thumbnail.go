@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jumpserver-dev/sdk-go/common"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/config"
+	"lion/pkg/display"
+	"lion/pkg/encrypt"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	录像的缩略图
+
+		GET /lion/api/sessions/:sid/replay/thumbnail/?position=<毫秒>&width=320&height=180
+	在录像开始后 position 毫秒(默认为录像的中间)处渲染画面，等比缩小后返回 PNG。
+	每个 part 的开始是 guacd 发送的完整画面，只需要处理 position 所在的 part；
+	本地的 part 有关键帧时从之前最近的关键帧开始处理。
+	会话目录已经删除时和导出一样从 core 下载 part 文件，需要 core 的录像(审计)权限。
+*/
+
+const (
+	defaultThumbnailWidth  = 320
+	defaultThumbnailHeight = 180
+	maxThumbnailSize       = 1920
+)
+
+var ErrThumbnailPosition = errors.New("invalid thumbnail position")
+
+// RenderReplayThumbnail position 小于 0 时使用录像的中间
+func RenderReplayThumbnail(ctx context.Context, files []string, position int64, width, height int) (*image.RGBA, error) {
+	startTime, endTime := replayTimeRange(files)
+	if position < 0 {
+		position = (endTime - startTime) / 2
+	}
+	target := startTime + position
+	file := ""
+	for i := range files {
+		meta, err := readPartFileMeta(files[i])
+		if err != nil {
+			continue
+		}
+		if file == "" || meta.StartTime <= target {
+			file = files[i]
+		}
+	}
+	if file == "" {
+		return nil, ErrNoReplayParts
+	}
+	screen, reader, err := openThumbnailPart(file, target)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	bufReader := bufio.NewReader(reader)
+	for {
+		inst, err1 := ReadInstruction(bufReader)
+		if err1 != nil {
+			break
+		}
+		if inst.Opcode != guacd.InstructionClientSync {
+			screen.Process(&inst)
+			continue
+		}
+		if w, h := screen.Size(); w > 0 && h > 0 && len(inst.Args) > 0 && int64(atoi(inst.Args[0])) >= target {
+			break
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if w, h := screen.Size(); w == 0 || h == 0 {
+		return nil, ErrNoExportFrames
+	}
+	return screen.Thumbnail(width, height), nil
+}
+
+// openThumbnailPart 本地的 part 从 target 之前最近的关键帧开始读取
+func openThumbnailPart(file string, target int64) (*display.Display, io.ReadCloser, error) {
+	screen := display.New()
+	if !strings.HasSuffix(file, PartSuffix) {
+		reader, err := openPartFile(file)
+		return screen, reader, err
+	}
+	var keyframe KeyframePoint
+	if index, err := LoadPartIndex(file + IndexSuffix); err == nil {
+		if point, ok := index.Lookup(target); ok {
+			if keyframe, ok = index.LookupKeyframe(point.Offset); ok {
+				if err = loadKeyframe(file, keyframe, screen); err != nil {
+					logger.Errorf("Thumbnail load keyframe of %s err: %s", file, err)
+					screen, keyframe = display.New(), KeyframePoint{}
+				}
+			}
+		}
+	}
+	fd, err := encrypt.OpenFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = fd.Seek(keyframe.Offset, io.SeekStart); err != nil {
+		_ = fd.Close()
+		return nil, nil, err
+	}
+	return screen, fd, nil
+}
+
+func thumbnailQuerySize(ctx *gin.Context, key string, value int) int {
+	if v, err := strconv.Atoi(ctx.Query(key)); err == nil && v > 0 {
+		value = v
+	}
+	return min(value, maxThumbnailSize)
+}
+
+func (g *GuacamoleTunnelServer) ReplayThumbnail(ctx *gin.Context) {
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrNoAuthUser))
+		return
+	}
+	user := userItem.(*model.User)
+	sessionId := ctx.Param("sid")
+	if !common.IsUUID(sessionId) {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrNotFoundSession))
+		return
+	}
+	position := int64(-1)
+	if value := ctx.Query("position"); value != "" {
+		var err error
+		if position, err = strconv.ParseInt(value, 10, 64); err != nil || position < 0 {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrThumbnailPosition))
+			return
+		}
+	}
+	width := thumbnailQuerySize(ctx, "width", defaultThumbnailWidth)
+	height := thumbnailQuerySize(ctx, "height", defaultThumbnailHeight)
+	result, err := g.ValidateReplayPermission(ctx, sessionId)
+	if err != nil {
+		logger.Errorf("Validate replay session err: %s", err)
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse(err))
+		return
+	}
+	if !result.Ok {
+		logger.Errorf("Validate replay session failed : %s", result.Msg)
+		ctx.JSON(http.StatusForbidden, ErrorResponse(errors.New(result.Msg)))
+		return
+	}
+	dir := filepath.Join(config.GlobalConfig.SessionFolderPath, sessionId)
+	sessionDirRefs.Acquire(dir)
+	defer sessionDirRefs.Release(dir)
+	files, err := SessionPartFiles(dir)
+	if err != nil || len(files) == 0 {
+		// 录像已经上传，从 core 下载
+		fetchDir := filepath.Join(config.GlobalConfig.ExportFolderPath, common.UUID()+".thumbnail")
+		defer os.RemoveAll(fetchDir)
+		if files, err = fetchReplayParts(ctx.Request.Context(), ctx.Request.Cookies(), sessionId, fetchDir); err != nil {
+			logger.Errorf("Fetch replay parts of session %s err: %s", sessionId, err)
+			ctx.JSON(http.StatusNotFound, ErrorResponse(err))
+			return
+		}
+	}
+	img, err := RenderReplayThumbnail(ctx.Request.Context(), files, position, width, height)
+	if err != nil {
+		logger.Errorf("Render replay thumbnail of session %s err: %s", sessionId, err)
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse(err))
+		return
+	}
+	logger.Debugf("User %s get replay thumbnail of session %s", user, sessionId)
+	ctx.Header("Content-Type", "image/png")
+	ctx.Status(http.StatusOK)
+	if err = png.Encode(ctx.Writer, img); err != nil {
+		logger.Errorf("Encode replay thumbnail of session %s err: %s", sessionId, err)
+	}
+}
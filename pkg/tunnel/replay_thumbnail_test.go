@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lion/pkg/guacd"
+)
+
+func TestRenderReplayThumbnail(t *testing.T) {
+	partPath := filepath.Join(t.TempDir(), "sid.0"+PartSuffix)
+	instructions := []guacd.Instruction{
+		guacd.NewInstruction("size", "0", "40", "20"),
+		guacd.NewInstruction("rect", "0", "0", "0", "40", "20"),
+		guacd.NewInstruction("cfill", "14", "0", "255", "0", "0", "255"),
+		guacd.NewInstruction(guacd.InstructionClientSync, "1000"),
+		guacd.NewInstruction("rect", "0", "0", "0", "40", "20"),
+		guacd.NewInstruction("cfill", "14", "0", "0", "0", "255", "255"),
+		guacd.NewInstruction(guacd.InstructionClientSync, "3000"),
+	}
+	var buf strings.Builder
+	for i := range instructions {
+		buf.WriteString(instructions[i].String())
+	}
+	if err := os.WriteFile(partPath, []byte(buf.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		position int64
+		want     color.RGBA
+	}{
+		{0, color.RGBA{R: 255, A: 255}},
+		{1500, color.RGBA{B: 255, A: 255}},
+	}
+	for _, tt := range tests {
+		img, err := RenderReplayThumbnail(context.Background(), []string{partPath}, tt.position, 20, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Rect.Dx() != 20 || img.Rect.Dy() != 10 {
+			t.Fatalf("thumbnail size %v", img.Rect)
+		}
+		if got := img.RGBAAt(5, 5); got != tt.want {
+			t.Errorf("position %d: pixel %v, want %v", tt.position, got, tt.want)
+		}
+	}
+}
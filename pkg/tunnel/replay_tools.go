@@ -0,0 +1,294 @@
+package tunnel
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jumpserver-dev/sdk-go/common"
+
+	"lion/pkg/encrypt"
+	"lion/pkg/guacd"
+)
+
+/*
+	离线的录像工具，供 lion 的子命令使用:
+		inspect  查看会话目录中的 part、时长、大小、缺失的时间段和上传状态
+		merge    将 part 合并成一个 .guac 文件
+		validate 校验 part 文件的指令格式
+*/
+
+// SessionPartFiles 会话目录中的 part 文件，按照序号排序；没有 .part 文件时查找 upload 目录中的 .part.gz
+func SessionPartFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+PartSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		for _, pattern := range []string{
+			filepath.Join(dir, "*"+PartSuffix+".gz"),
+			filepath.Join(dir, "upload", "*"+PartSuffix+".gz"),
+		} {
+			if files, err = filepath.Glob(pattern); err != nil || len(files) > 0 {
+				break
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return partFileIndex(partBaseName(files[i])) < partFileIndex(partBaseName(files[j]))
+	})
+	return files, err
+}
+
+func partBaseName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".gz")
+}
+
+// openPartFile 打开 part 文件，加密的文件解密，.gz 文件解压
+func openPartFile(path string) (io.ReadCloser, error) {
+	fd, err := encrypt.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return fd, nil
+	}
+	gzReader, err := gzip.NewReader(fd)
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return gzipReadCloser{Reader: gzReader, fd: fd}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	fd io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	_ = g.Reader.Close()
+	return g.fd.Close()
+}
+
+type PartInspect struct {
+	Name string `json:"name"`
+	PartMeta
+	// 是否已经在会话过程中上传
+	Uploaded bool   `json:"uploaded"`
+	Error    string `json:"error,omitempty"`
+}
+
+type SessionInspect struct {
+	SessionId string         `json:"session_id"`
+	HasMeta   bool           `json:"has_meta"`
+	Parts     []PartInspect  `json:"parts"`
+	Gaps      []ReplayGap    `json:"gaps,omitempty"`
+	Markers   []ReplayMarker `json:"markers,omitempty"`
+	Chats     []ChatMessage  `json:"chats,omitempty"`
+	Duration  int64          `json:"duration"`
+	Size      int64          `json:"size"`
+}
+
+// InspectSession 读取会话目录中的 part 信息，优先使用 {part}.meta，不存在时解析 part 文件
+func InspectSession(dir string) (*SessionInspect, error) {
+	sessionId := filepath.Base(filepath.Clean(dir))
+	files, err := SessionPartFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := SessionInspect{
+		SessionId: sessionId,
+		HasMeta:   common.Have(filepath.Join(dir, sessionId+".json")),
+		Gaps:      LoadReplayGaps(dir, sessionId),
+		Markers:   LoadReplayMarkers(dir, sessionId),
+		Chats:     LoadChatMessages(dir, sessionId),
+	}
+	uploader := PartUploader{RootPath: dir, SessionId: sessionId}
+	uploader.loadUploadState()
+	for _, file := range files {
+		name := partBaseName(file)
+		part := PartInspect{Name: name}
+		_, part.Uploaded = uploader.uploadState.Parts[name+".gz"]
+		meta, err1 := readPartMetaFile(filepath.Join(dir, name+MetaSuffix))
+		if err1 != nil {
+			meta, err1 = loadPartMeta(file)
+		}
+		if err1 != nil {
+			part.Error = err1.Error()
+		}
+		part.PartMeta = meta
+		result.Duration += part.Duration
+		result.Size += part.Size
+		result.Parts = append(result.Parts, part)
+	}
+	return &result, nil
+}
+
+// loadPartMeta .part 文件使用 LoadPartMetaByFile，.gz 文件解压后计算
+func loadPartMeta(path string) (PartMeta, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return LoadPartMetaByFile(path)
+	}
+	var meta PartMeta
+	reader, err := openPartFile(path)
+	if err != nil {
+		return meta, err
+	}
+	defer reader.Close()
+	bufReader := bufio.NewReader(reader)
+	for {
+		inst, err1 := ReadInstruction(bufReader)
+		if err1 != nil {
+			break
+		}
+		meta.Size += int64(len(inst.String()))
+		if inst.Opcode != guacd.InstructionClientSync || len(inst.Args) == 0 {
+			continue
+		}
+		syncTime := int64(atoi(inst.Args[0]))
+		meta.EndTime = syncTime
+		if meta.StartTime == 0 {
+			meta.StartTime = syncTime
+		}
+	}
+	meta.Duration = meta.EndTime - meta.StartTime
+	return meta, nil
+}
+
+func readPartMetaFile(path string) (PartMeta, error) {
+	var meta PartMeta
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(buf, &meta)
+	return meta, err
+}
+
+// MergeParts 按照顺序将 part 的明文写入 w，返回写入的大小
+func MergeParts(files []string, w io.Writer) (int64, error) {
+	var total int64
+	for _, file := range files {
+		reader, err := openPartFile(file)
+		if err != nil {
+			return total, err
+		}
+		n, err := io.Copy(w, reader)
+		_ = reader.Close()
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+	}
+	return total, nil
+}
+
+var ErrInstructionTruncated = errors.New("instruction truncated")
+
+type PartValidateResult struct {
+	Name         string `json:"name"`
+	Instructions int    `json:"instructions"`
+	Size         int64  `json:"size"`
+	// 第一个错误指令的位置
+	Offset int64  `json:"offset,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ValidatePartFile 严格按照 LENGTH.VALUE 的格式校验 part 文件中的每一条指令
+func ValidatePartFile(path string) PartValidateResult {
+	result := PartValidateResult{Name: filepath.Base(path)}
+	reader, err := openPartFile(path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer reader.Close()
+	scanner := instructionScanner{r: bufio.NewReader(reader)}
+	for {
+		start := scanner.offset
+		err = scanner.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			result.Offset = start
+			result.Error = err.Error()
+			break
+		}
+		result.Instructions++
+	}
+	result.Size = scanner.offset
+	return result
+}
+
+type instructionScanner struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (s *instructionScanner) readRune() (rune, error) {
+	ch, size, err := s.r.ReadRune()
+	s.offset += int64(size)
+	return ch, err
+}
+
+// next 读取一条完整的指令，文件正常结束返回 io.EOF
+func (s *instructionScanner) next() error {
+	for elements := 0; ; elements++ {
+		length := 0
+		digits := 0
+		for {
+			ch, err := s.readRune()
+			if err != nil {
+				if err == io.EOF && elements == 0 && digits == 0 {
+					return io.EOF
+				}
+				if err == io.EOF {
+					return ErrInstructionTruncated
+				}
+				return err
+			}
+			if ch == guacd.ByteDotDelimiter {
+				break
+			}
+			if ch < '0' || ch > '9' || digits >= 9 {
+				return guacd.ErrInstructionBadDigit
+			}
+			length = length*10 + int(ch-'0')
+			digits++
+		}
+		if digits == 0 {
+			return guacd.ErrInstructionBadDigit
+		}
+		for i := 0; i < length; i++ {
+			if _, err := s.readRune(); err != nil {
+				if err == io.EOF {
+					return ErrInstructionTruncated
+				}
+				return err
+			}
+		}
+		ch, err := s.readRune()
+		if err != nil {
+			if err == io.EOF {
+				return ErrInstructionTruncated
+			}
+			return err
+		}
+		switch ch {
+		case guacd.ByteCommaDelimiter:
+		case guacd.ByteSemicolonDelimiter:
+			return nil
+		default:
+			return guacd.ErrInstructionBadContent
+		}
+	}
+}
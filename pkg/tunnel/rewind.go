@@ -0,0 +1,367 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lion/pkg/display"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	监控回看
+
+	开启 REWIND_MAX_DURATION 后，每个会话在内存中保留最近一段时间(不超过 REWIND_MAX_SIZE 字节)的绘制指令，
+	按照 sync 分帧，超出范围的帧在单独的协程中处理到 base 画面，转发 guacd 指令的协程不解码图片；
+	base 处理不过来(等待处理的帧超过 REWIND_MAX_SIZE)时丢弃这些帧，回看的起始画面可能不完整。
+	监控用户使用 REWIND=<秒数>&REWIND_SPEED=<倍速> 加入时，先发送 base 画面的关键帧，
+	快速发送回看范围之前的帧，再按照倍速回放，结束后才加入会话显示实时画面:
+		jms_event,rewind_start,{"duration":..,"speed":..}
+		jms_event,rewind_end,{}
+	会话在其他节点时，通过 redis 请求会话所在的节点生成回看的指令。
+*/
+
+const (
+	rewindStartEvent = "rewind_start"
+	rewindEndEvent   = "rewind_end"
+
+	rewindDefaultSpeed = 4
+
+	// 回放时两帧之间最长的等待时间，跳过长时间没有变化的画面
+	rewindMaxFrameDelay = time.Second
+)
+
+// 回看保存的绘制指令，img 流的 blob 和 end 单独判断
+var rewindOpcodes = map[string]struct{}{
+	guacd.InstructionDrawingArc:       {},
+	guacd.InstructionDrawingCfill:     {},
+	guacd.InstructionDrawingClip:      {},
+	guacd.InstructionDrawingClose:     {},
+	guacd.InstructionDrawingCopy:      {},
+	guacd.InstructionDrawingCstroke:   {},
+	guacd.InstructionDrawingCursor:    {},
+	guacd.InstructionDrawingCurve:     {},
+	guacd.InstructionDrawingDispose:   {},
+	guacd.InstructionDrawingDistort:   {},
+	guacd.InstructionDrawingIdentity:  {},
+	guacd.InstructionDrawingJpeg:      {},
+	guacd.InstructionDrawingLfill:     {},
+	guacd.InstructionDrawingLine:      {},
+	guacd.InstructionDrawingLstroke:   {},
+	guacd.InstructionDrawingMove:      {},
+	guacd.InstructionDrawingPng:       {},
+	guacd.InstructionDrawingPop:       {},
+	guacd.InstructionDrawingPush:      {},
+	guacd.InstructionDrawingRect:      {},
+	guacd.InstructionDrawingReset:     {},
+	guacd.InstructionDrawingSet:       {},
+	guacd.InstructionDrawingShade:     {},
+	guacd.InstructionDrawingSize:      {},
+	guacd.InstructionDrawingStart:     {},
+	guacd.InstructionDrawingTransfer:  {},
+	guacd.InstructionDrawingTransform: {},
+	guacd.InstructionStreamingImg:     {},
+}
+
+// RewindFrame 两个 sync 之间的绘制指令，Time 为 sync 的时间戳(毫秒)
+type RewindFrame struct {
+	Time         int64
+	Instructions []guacd.Instruction
+
+	size int
+}
+
+type rewindBuffer struct {
+	maxDuration int64
+	maxSize     int
+
+	lock sync.Mutex
+	// base 画面对应的时间，第一个 sync 之前为 0
+	baseTime int64
+	frames   []RewindFrame
+	size     int
+	// 超出范围、等待处理到 base 画面的帧
+	evicted     []RewindFrame
+	evictedSize int
+	evictedLost bool
+	notify      chan struct{}
+	done        chan struct{}
+	running     bool
+	closed      bool
+
+	// 处理和复制 base 画面时持有，需要在 lock 之前获取
+	baseLock sync.Mutex
+	base     *display.Display
+
+	// 只在读取 guacd 指令的协程中使用
+	pending    RewindFrame
+	imgStreams map[string]struct{}
+}
+
+func newRewindBuffer(maxDuration time.Duration, maxSize int) *rewindBuffer {
+	return &rewindBuffer{
+		maxDuration: maxDuration.Milliseconds(),
+		maxSize:     maxSize,
+		base:        display.New(),
+		imgStreams:  make(map[string]struct{}),
+		notify:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+func (b *rewindBuffer) Write(inst *guacd.Instruction) {
+	switch inst.Opcode {
+	case guacd.InstructionClientSync:
+		if len(inst.Args) > 0 {
+			b.commit(int64(atoi(inst.Args[0])))
+		}
+		return
+	case guacd.InstructionStreamingImg:
+		if len(inst.Args) > 0 {
+			b.imgStreams[inst.Args[0]] = struct{}{}
+		}
+	case guacd.InstructionStreamingBlob, guacd.InstructionStreamingEnd:
+		if len(inst.Args) == 0 {
+			return
+		}
+		if _, ok := b.imgStreams[inst.Args[0]]; !ok {
+			return
+		}
+		if inst.Opcode == guacd.InstructionStreamingEnd {
+			delete(b.imgStreams, inst.Args[0])
+		}
+	default:
+		if _, ok := rewindOpcodes[inst.Opcode]; !ok {
+			return
+		}
+	}
+	b.pending.Instructions = append(b.pending.Instructions, *inst)
+	b.pending.size += instructionSize(inst)
+}
+
+// commit 保存一帧，超出时长或大小的帧交给 base 协程处理，不在这里解码图片
+func (b *rewindBuffer) commit(syncTime int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.baseTime == 0 {
+		b.baseTime = syncTime
+	}
+	if len(b.pending.Instructions) > 0 {
+		b.pending.Time = syncTime
+		b.frames = append(b.frames, b.pending)
+		b.size += b.pending.size
+		b.pending = RewindFrame{}
+	}
+	evicted := false
+	for len(b.frames) > 0 && (b.size > b.maxSize || syncTime-b.frames[0].Time > b.maxDuration) {
+		frame := b.frames[0]
+		b.evicted = append(b.evicted, frame)
+		b.evictedSize += frame.size
+		b.size -= frame.size
+		b.frames[0] = RewindFrame{}
+		b.frames = b.frames[1:]
+		evicted = true
+	}
+	if !evicted || b.closed {
+		return
+	}
+	if b.evictedSize > b.maxSize {
+		logger.Warnf("Rewind base falls behind, drop %d frames", len(b.evicted))
+		b.baseTime = b.evicted[len(b.evicted)-1].Time
+		b.evicted = nil
+		b.evictedSize = 0
+		b.evictedLost = true
+	}
+	if !b.running {
+		b.running = true
+		go b.runBase()
+	}
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (b *rewindBuffer) runBase() {
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-b.notify:
+		}
+		b.processEvicted()
+	}
+}
+
+// processEvicted 将等待处理的帧处理到 base 画面，处理期间持有 baseLock，Backlog 不会看到处理了一半的 base
+func (b *rewindBuffer) processEvicted() {
+	b.baseLock.Lock()
+	defer b.baseLock.Unlock()
+	b.lock.Lock()
+	frames := b.evicted
+	b.evicted = nil
+	b.evictedSize = 0
+	b.evictedLost = false
+	b.lock.Unlock()
+	for i := range frames {
+		for j := range frames[i].Instructions {
+			b.base.Process(&frames[i].Instructions[j])
+		}
+	}
+	if len(frames) > 0 {
+		b.lock.Lock()
+		if !b.evictedLost {
+			b.baseTime = frames[len(frames)-1].Time
+		}
+		b.lock.Unlock()
+	}
+}
+
+// Close 会话结束时停止 base 协程
+func (b *rewindBuffer) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.done)
+}
+
+// Backlog 第一帧为 base 画面的关键帧，之后是还没有处理到 base 的帧和回看范围内的帧，
+// 关键帧在复制的画面上生成，不阻塞会话
+func (b *rewindBuffer) Backlog() []RewindFrame {
+	b.baseLock.Lock()
+	b.lock.Lock()
+	if b.baseTime == 0 {
+		b.lock.Unlock()
+		b.baseLock.Unlock()
+		return nil
+	}
+	keyframe := RewindFrame{Time: b.baseTime}
+	ret := make([]RewindFrame, 0, len(b.evicted)+len(b.frames)+1)
+	ret = append(ret, keyframe)
+	ret = append(ret, b.evicted...)
+	ret = append(ret, b.frames...)
+	b.lock.Unlock()
+	base := b.base.Clone()
+	b.baseLock.Unlock()
+	ret[0].Instructions = base.Keyframe(viewerBlobMaxLength)
+	return ret
+}
+
+func instructionSize(inst *guacd.Instruction) int {
+	size := len(inst.Opcode)
+	for i := range inst.Args {
+		size += len(inst.Args[i])
+	}
+	return size
+}
+
+// encodeRewindBacklog 转换为指令文本，每一帧以 sync 结束
+func encodeRewindBacklog(frames []RewindFrame) string {
+	var builder strings.Builder
+	for i := range frames {
+		for j := range frames[i].Instructions {
+			builder.WriteString(frames[i].Instructions[j].String())
+		}
+		sync := guacd.NewInstruction(guacd.InstructionClientSync, strconv.FormatInt(frames[i].Time, 10))
+		builder.WriteString(sync.String())
+	}
+	return builder.String()
+}
+
+func decodeRewindBacklog(data string) []RewindFrame {
+	var (
+		frames []RewindFrame
+		frame  RewindFrame
+	)
+	reader := bufio.NewReader(strings.NewReader(data))
+	for {
+		inst, err := ReadInstruction(reader)
+		if err != nil {
+			break
+		}
+		if inst.Opcode != guacd.InstructionClientSync {
+			frame.Instructions = append(frame.Instructions, inst)
+			continue
+		}
+		if len(inst.Args) > 0 {
+			frame.Time = int64(atoi(inst.Args[0]))
+		}
+		frames = append(frames, frame)
+		frame = RewindFrame{}
+	}
+	return frames
+}
+
+// parseRewindParams 监控用户回看的秒数和倍速，秒数为 0 表示不回看
+func parseRewindParams(ctx *gin.Context) (seconds int, speed float64) {
+	seconds, _ = strconv.Atoi(ctx.Query("REWIND"))
+	speed, _ = strconv.ParseFloat(ctx.Query("REWIND_SPEED"), 64)
+	if speed <= 0 {
+		speed = rewindDefaultSpeed
+	}
+	return seconds, min(speed, replayMaxSpeed)
+}
+
+func (t *Connection) RewindBacklog() []RewindFrame {
+	if t.rewind == nil {
+		return nil
+	}
+	return t.rewind.Backlog()
+}
+
+// playRewind 先发送关键帧和回看范围之前的帧，再按照倍速回放最近 seconds 秒的帧
+func (m *MonitorCon) playRewind(ctx context.Context, frames []RewindFrame, seconds int, speed float64) error {
+	endTime := frames[len(frames)-1].Time
+	startTime := max(endTime-int64(seconds)*1000, frames[0].Time)
+	p, _ := json.Marshal(map[string]interface{}{
+		"duration": endTime - startTime,
+		"speed":    speed,
+	})
+	_ = m.SendWsMessage(NewJmsEventInstruction(rewindStartEvent, string(p)))
+	var lastTime int64
+	for i := range frames {
+		frame := &frames[i]
+		if frame.Time > startTime && lastTime > 0 {
+			delay := time.Duration(float64(frame.Time-lastTime)/speed) * time.Millisecond
+			timer := time.NewTimer(min(delay, rewindMaxFrameDelay))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		lastTime = frame.Time
+		for j := range frame.Instructions {
+			if err := m.wsBatch.WriteInstruction(&frame.Instructions[j]); err != nil {
+				return err
+			}
+		}
+		sync := guacd.NewInstruction(guacd.InstructionClientSync, strconv.FormatInt(frame.Time, 10))
+		if err := m.wsBatch.WriteInstruction(&sync); err != nil {
+			return err
+		}
+	}
+	// web client 回复回看画面的 sync，不需要转发给 guacd
+	m.rewindEndTime = endTime
+	return m.SendWsMessage(NewJmsEventInstruction(rewindEndEvent, "{}"))
+}
+
+// isRewindSync web client 对回看画面回复的 sync
+func (m *MonitorCon) isRewindSync(inst *guacd.Instruction) bool {
+	if m.rewindEndTime == 0 || inst.Opcode != guacd.InstructionClientSync || len(inst.Args) == 0 {
+		return false
+	}
+	return int64(atoi(inst.Args[0])) <= m.rewindEndTime
+}
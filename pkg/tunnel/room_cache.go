@@ -10,10 +10,22 @@ type MetaShareUserMessage struct {
 	RemoteAddr string `json:"remote_addr"`
 	Primary    bool   `json:"primary"`
 	Writable   bool   `json:"writable"`
+	// 分享用户的加入记录，同一个分享链接可能有多个用户加入
+	RecordId string `json:"record_id,omitempty"`
+}
+
+// ParticipantId 区分会话中的参与者，主用户使用 ShareId
+func (m MetaShareUserMessage) ParticipantId() string {
+	if m.RecordId != "" {
+		return m.RecordId
+	}
+	return m.ShareId
 }
 
 type SessionRoomMessage struct {
 	Id        string `json:"id"`
 	SessionId string `json:"session_id"`
 	Event     *Event `json:"event"`
+	// redis 分配的序号，发布时由脚本写入
+	Seq uint64 `json:"seq,omitempty"`
 }
@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"errors"
+	"time"
+
+	"lion/pkg/display"
+	"lion/pkg/guacd"
+)
+
+const (
+	screenshotTimeout = 15 * time.Second
+
+	// 收到画面后，超过该时间没有新的指令则认为画面已经完整
+	screenshotQuietTime = time.Second
+)
+
+var ErrScreenshotTimeout = errors.New("capture screen timeout")
+
+// CaptureScreen 读取 join tunnel 的画面，guacd 在用户加入时会发送完整的画面，
+// 收到画面后遇到第一个 sync 即可截图
+func CaptureScreen(tunnel Tunneler, timeout time.Duration) (*display.Display, error) {
+	d := display.New()
+	insChan := make(chan guacd.Instruction, 100)
+	errChan := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			ins, err := tunnel.ReadInstruction()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			select {
+			case insChan <- ins:
+			case <-done:
+				return
+			}
+		}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var quiet <-chan time.Time
+	started := func() bool {
+		width, height := d.Size()
+		return width > 0 && height > 0
+	}
+	for {
+		select {
+		case ins := <-insChan:
+			switch ins.Opcode {
+			case guacd.InstructionClientSync, guacd.InstructionClientNop:
+				if started() {
+					return d, nil
+				}
+				continue
+			}
+			d.Process(&ins)
+			quiet = time.After(screenshotQuietTime)
+		case <-quiet:
+			if started() {
+				return d, nil
+			}
+		case err := <-errChan:
+			return nil, err
+		case <-timer.C:
+			return nil, ErrScreenshotTimeout
+		}
+	}
+}
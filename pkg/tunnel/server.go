@@ -3,6 +3,7 @@ package tunnel
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -15,6 +16,7 @@ import (
 	"github.com/gorilla/websocket"
 
 	"lion/pkg/config"
+	"lion/pkg/display"
 	"lion/pkg/gateway"
 	"lion/pkg/guacd"
 	"lion/pkg/logger"
@@ -39,6 +41,24 @@ var upGrader = websocket.Upgrader{
 	},
 }
 
+// 启用 permessage-deflate，浏览器支持时压缩 instruction
+var compressUpGrader = websocket.Upgrader{
+	ReadBufferSize:    defaultBufferSize,
+	WriteBufferSize:   defaultBufferSize,
+	Subprotocols:      []string{"guacamole"},
+	EnableCompression: true,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+func getUpGrader() *websocket.Upgrader {
+	if config.GlobalConfig.EnableWsCompression {
+		return &compressUpGrader
+	}
+	return &upGrader
+}
+
 type GuacamoleTunnelServer struct {
 	JmsService     *service.JMService
 	Cache          *GuaTunnelCacheManager
@@ -72,14 +92,64 @@ func (g *GuacamoleTunnelServer) getClientInfo(ctx *gin.Context, token *model.Con
 	return info
 }
 
+func (g *GuacamoleTunnelServer) reattach(ctx *gin.Context, ws ClientConn, resumeToken string) {
+	sessionId, ok := ctx.GetQuery("SESSION_ID")
+	if !ok || resumeToken == "" {
+		logger.Error("No session id or resume token params")
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrBadParams.String()))
+		return
+	}
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok {
+		logger.Error("No auth user found")
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrAuthUser.String()))
+		return
+	}
+	user := userItem.(*model.User)
+	conn := g.Cache.GetBySessionId(sessionId)
+	if conn == nil || conn.resumeToken != resumeToken {
+		logger.Errorf("User %s reattach session %s not found", user, sessionId)
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrNoSession.String()))
+		return
+	}
+	if conn.Sess.User.ID != user.ID {
+		logger.Errorf("User %s has no permission to reattach session %s", user, sessionId)
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrAuthUser.String()))
+		return
+	}
+	p, _ := json.Marshal(conn.Sess)
+	ins := NewJmsEventInstruction("session", string(p))
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(ins.String())); err != nil {
+		logger.Errorf("Write session message err: %+v", err)
+		return
+	}
+	info := g.getClientInfo(ctx, conn.Sess.AuthInfo)
+	logger.Infof("User %s start to reattach session %s", user, sessionId)
+	if err := conn.Reattach(ctx.Request.Context(), ws, info); err != nil {
+		logger.Errorf("User %s reattach session %s err: %+v", user, sessionId, err)
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrReattachFailed.String()))
+		return
+	}
+	logger.Infof("User %s reattach session %s finished", user, sessionId)
+}
+
 func (g *GuacamoleTunnelServer) Connect(ctx *gin.Context) {
-	ws, err := upGrader.Upgrade(ctx.Writer, ctx.Request, ctx.Writer.Header())
+	ws, err := getUpGrader().Upgrade(ctx.Writer, ctx.Request, ctx.Writer.Header())
 	if err != nil {
 		logger.Errorf("Websocket Upgrade err: %+v", err)
 		ctx.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 	defer ws.Close()
+	g.connect(ctx, ws)
+}
+
+// connect 建立会话并阻塞直到会话结束，websocket 和 http tunnel 共用
+func (g *GuacamoleTunnelServer) connect(ctx *gin.Context, ws ClientConn) {
+	if resumeToken, ok := ctx.GetQuery("RESUME_TOKEN"); ok {
+		g.reattach(ctx, ws, resumeToken)
+		return
+	}
 
 	tokenId, ok := ctx.GetQuery("TOKEN_ID")
 	if !ok {
@@ -220,7 +290,11 @@ func (g *GuacamoleTunnelServer) Connect(ctx *gin.Context) {
 		Cache:       g.Cache,
 		meta:        &meta,
 
+		resumeToken:  common.UUID(),
+		reattachChan: make(chan *reattachRequest),
+
 		currentOnlineUsers: make(map[string]MetaShareUserMessage),
+		chatSender:         chatSender{User: user.String(), UserId: user.ID, Role: ChatRolePrimary},
 	}
 	outFilter := OutputStreamInterceptingFilter{
 		acknowledgeBlobs: true,
@@ -233,6 +307,13 @@ func (g *GuacamoleTunnelServer) Connect(ctx *gin.Context) {
 	}
 	conn.outputFilter = &outFilter
 	conn.inputFilter = &inputFilter
+	conn.wsBatch = newWsBatchWriter(conn.writeWsMessage)
+	if config.GlobalConfig.EnableSessionWall {
+		conn.screen = display.New()
+	}
+	if minutes := config.GlobalConfig.RewindMaxDuration; minutes > 0 {
+		conn.rewind = newRewindBuffer(time.Duration(minutes)*time.Minute, config.GlobalConfig.RewindMaxSize)
+	}
 	logger.Infof("Session[%s] connect success", sessionId)
 	g.Cache.Add(&conn)
 	replayRecorder := &ReplayRecorder{
@@ -243,17 +324,43 @@ func (g *GuacamoleTunnelServer) Connect(ctx *gin.Context) {
 		info:          info.Clone(),
 		newPartChan:   make(chan struct{}, 1),
 		MaxSize:       config.GlobalConfig.ReplayMaxSize,
+		MaxDuration:   int64(config.GlobalConfig.ReplayMaxDuration) * 60 * 1000,
 		apiClient:     g.JmsService,
 		currentIndex:  0,
+
+		RecoverTimeout: time.Duration(config.GlobalConfig.ReplayRecoverTimeout) * time.Second,
+	}
+	var platformName string
+	if tunnelSession.Platform != nil {
+		platformName = tunnelSession.Platform.Name
+	}
+	if config.GlobalConfig.IsReplayRequired(platformName) {
+		conn.requireRecorder(replayRecorder)
+	}
+	conn.replayRecorder = replayRecorder
+	if config.GlobalConfig.ReplayRecordInput {
+		conn.inputAnnotator = newInputAnnotator(user.ID, config.GlobalConfig.ReplayInputMask)
 	}
 	childCtx, cancel := context.WithCancel(ctx)
-	replayRecorder.Start(childCtx)
 	defer func() {
 		cancel()
 		logger.Infof("replayRecorder[%s] stop", sessionId)
 		replayRecorder.Stop()
 
 	}()
+	// 强制录像模式下，录像开始写入之后才接收用户的输入
+	err = replayRecorder.Start(childCtx)
+	if err == nil && replayRecorder.Required {
+		err = conn.waitRecorder(childCtx)
+	}
+	if err != nil {
+		conn.terminateByRecorder(err)
+		g.Cache.Delete(&conn)
+		if err = tunnelSession.DisConnectedCallback(); err != nil {
+			logger.Errorf("Session DisConnectedCallback err: %+v", err)
+		}
+		return
+	}
 	_ = conn.Run(ctx)
 	g.Cache.Delete(&conn)
 	if err = tunnelSession.DisConnectedCallback(); err != nil {
@@ -309,11 +416,13 @@ func (g *GuacamoleTunnelServer) DownloadFile(ctx *gin.Context) {
 			logger.Errorf("Session[%s] download file %s err: %s", tun, filename, err)
 			ctx.JSON(http.StatusBadRequest, ErrorResponse(err))
 			g.SessionService.AuditFileOperation(fileLog)
+			tun.recordFileMarker(MarkerFileDownload, filename, false)
 			recorder.RemoveFtpLog(fileLog.ID)
 			return
 		}
 		fileLog.IsSuccess = true
 		g.SessionService.AuditFileOperation(fileLog)
+		tun.recordFileMarker(MarkerFileDownload, filename, true)
 		recorder.FinishFTPFile(fileLog.ID)
 		logger.Infof("Session[%s] download file %s success", tun, filename)
 		return
@@ -369,11 +478,13 @@ func (g *GuacamoleTunnelServer) UploadFile(ctx *gin.Context) {
 			if err := stream.WaitErr(); err != nil {
 				logger.Errorf("Session[%s] upload file %s err: %s", tun, filename, err)
 				g.SessionService.AuditFileOperation(fileLog)
+				tun.recordFileMarker(MarkerFileUpload, filename, false)
 				continue
 			}
 			logger.Infof("Session[%s] upload file %s success", tun, filename)
 			fileLog.IsSuccess = true
 			g.SessionService.AuditFileOperation(fileLog)
+			tun.recordFileMarker(MarkerFileUpload, filename, true)
 			_, _ = fdReader.(io.Seeker).Seek(0, io.SeekStart)
 			if err1 := recorder.Record(&fileLog, fdReader); err1 != nil {
 				logger.Errorf("Record file %s err: %s", filename, err1)
@@ -387,7 +498,7 @@ func (g *GuacamoleTunnelServer) UploadFile(ctx *gin.Context) {
 }
 
 func (g *GuacamoleTunnelServer) Monitor(ctx *gin.Context) {
-	ws, err := upGrader.Upgrade(ctx.Writer, ctx.Request, ctx.Writer.Header())
+	ws, err := getUpGrader().Upgrade(ctx.Writer, ctx.Request, ctx.Writer.Header())
 	if err != nil {
 		logger.Errorf("Websocket Upgrade err: %+v", err)
 		ctx.AbortWithStatus(http.StatusBadRequest)
@@ -423,6 +534,49 @@ func (g *GuacamoleTunnelServer) Monitor(ctx *gin.Context) {
 		return
 	}
 
+	conn := MonitorCon{
+		Id:      sessionId,
+		ws:      ws,
+		Service: g,
+		User:    user,
+	}
+	conn.wsBatch = newWsBatchWriter(conn.writeWsMessage)
+	// 监控用户只有接管会话时可以输入，输入总是记录到录像
+	conn.inputAnnotator = newInputAnnotator(user.ID, config.GlobalConfig.ReplayInputMask)
+	logObj := model.SessionLifecycleLog{User: user.String()}
+	joined := false
+	recordJoin := func() {
+		if joined {
+			return
+		}
+		joined = true
+		g.RecordLifecycleLog(sessionId, model.AdminJoinMonitor, logObj)
+		BroadcastReplayMarker(g.Cache, sessionId, NewReplayMarker(MarkerMonitorJoin, user.String(), ""))
+	}
+	defer func() {
+		if joined {
+			g.RecordLifecycleLog(sessionId, model.AdminExitMonitor, logObj)
+			BroadcastReplayMarker(g.Cache, sessionId, NewReplayMarker(MarkerMonitorExit, user.String(), ""))
+		}
+	}()
+
+	opened := false
+	// 回看结束后再加入会话
+	if seconds, speed := parseRewindParams(ctx); seconds > 0 {
+		if frames := g.Cache.GetRewindBacklog(sessionId); len(frames) > 0 {
+			// 回看期间还没有 join tunnel，使用临时的 id 打开 web client 的 tunnel
+			ints := guacd.NewInstruction(INTERNALDATAOPCODE, common.UUID())
+			_ = ws.WriteMessage(websocket.TextMessage, []byte(ints.String()))
+			opened = true
+			recordJoin()
+			logger.Infof("User %s rewind session %s for %d seconds at speed %.1f", user, sessionId, seconds, speed)
+			if err = conn.playRewind(ctx.Request.Context(), frames, seconds, speed); err != nil {
+				logger.Errorf("User %s rewind session %s err: %s", user, sessionId, err)
+				return
+			}
+		}
+	}
+
 	tunnelCon := g.Cache.GetMonitorTunnelerBySessionId(sessionId)
 	if tunnelCon == nil {
 		logger.Error("No session tunnel found")
@@ -431,21 +585,13 @@ func (g *GuacamoleTunnelServer) Monitor(ctx *gin.Context) {
 	}
 	defer tunnelCon.Close()
 
-	ints := guacd.NewInstruction(INTERNALDATAOPCODE, tunnelCon.UUID())
-	_ = ws.WriteMessage(websocket.TextMessage, []byte(ints.String()))
-	conn := MonitorCon{
-		Id:          sessionId,
-		guacdTunnel: tunnelCon,
-		ws:          ws,
-		Service:     g,
-		User:        user,
+	if !opened {
+		ints := guacd.NewInstruction(INTERNALDATAOPCODE, tunnelCon.UUID())
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ints.String()))
 	}
+	conn.guacdTunnel = tunnelCon
 	logger.Infof("User %s start to monitor session %s", user, sessionId)
-	logObj := model.SessionLifecycleLog{User: user.String()}
-	g.RecordLifecycleLog(sessionId, model.AdminJoinMonitor, logObj)
-	defer func() {
-		g.RecordLifecycleLog(sessionId, model.AdminExitMonitor, logObj)
-	}()
+	recordJoin()
 	_ = conn.Run(ctx.Request.Context())
 	g.Cache.RemoveMonitorTunneler(sessionId, tunnelCon)
 	logger.Infof("User %s stop to monitor session %s", user, sessionId)
@@ -529,7 +675,7 @@ func (g *GuacamoleTunnelServer) GetShare(ctx *gin.Context) {
 }
 
 func (g *GuacamoleTunnelServer) Share(ctx *gin.Context) {
-	ws, err := upGrader.Upgrade(ctx.Writer, ctx.Request, ctx.Writer.Header())
+	ws, err := getUpGrader().Upgrade(ctx.Writer, ctx.Request, ctx.Writer.Header())
 	if err != nil {
 		logger.Errorf("Websocket Upgrade err: %+v", err)
 		ctx.AbortWithStatus(http.StatusBadRequest)
@@ -569,6 +715,34 @@ func (g *GuacamoleTunnelServer) Share(ctx *gin.Context) {
 	writable = strings.EqualFold(writePem, "true")
 
 	logger.Debugf("User %s start to share session %s", user, sessionId)
+	meta := MetaShareUserMessage{
+		ShareId:    shareId,
+		SessionId:  sessionId,
+		UserId:     user.ID,
+		User:       user.String(),
+		Created:    time.Now().UTC().String(),
+		RemoteAddr: ctx.ClientIP(),
+		Primary:    false,
+		Writable:   writable,
+		RecordId:   recordId,
+	}
+	logObj := model.SessionLifecycleLog{User: user.String()}
+	joinLogObj := logObj
+	var clientWs ClientConn = ws
+	if config.GlobalConfig.ShareApproval {
+		knockWs := newKnockWsConn(ws)
+		defer knockWs.Close()
+		clientWs = knockWs
+		approval := g.waitShareApproval(knockWs, &meta)
+		if !approval.Accepted {
+			g.RecordLifecycleLog(sessionId, model.UserLeaveSession, approval.LifecycleLog(&meta))
+			if err1 := g.JmsService.FinishShareRoom(recordId); err1 != nil {
+				logger.Errorf("Finish share room err: %s", err1)
+			}
+			return
+		}
+		joinLogObj = approval.LifecycleLog(&meta)
+	}
 	tunnelCon := g.Cache.GetMonitorTunnelerBySessionId(sessionId)
 	if tunnelCon == nil {
 		logger.Error("No session tunnel found")
@@ -577,31 +751,24 @@ func (g *GuacamoleTunnelServer) Share(ctx *gin.Context) {
 	}
 	defer tunnelCon.Close()
 
-	logObj := model.SessionLifecycleLog{User: user.String()}
-	g.RecordLifecycleLog(sessionId, model.UserJoinSession, logObj)
+	g.RecordLifecycleLog(sessionId, model.UserJoinSession, joinLogObj)
 	defer func() {
 		g.RecordLifecycleLog(sessionId, model.UserLeaveSession, logObj)
 	}()
 	ints := guacd.NewInstruction(INTERNALDATAOPCODE, tunnelCon.UUID())
 	_ = ws.WriteMessage(websocket.TextMessage, []byte(ints.String()))
-	meta := MetaShareUserMessage{
-		ShareId:    shareId,
-		SessionId:  sessionId,
-		UserId:     user.ID,
-		User:       user.String(),
-		Created:    time.Now().UTC().String(),
-		RemoteAddr: ctx.ClientIP(),
-		Primary:    false,
-		Writable:   writable,
-	}
 	conn := MonitorCon{
 		Id:          sessionId,
 		guacdTunnel: tunnelCon,
-		ws:          ws,
+		ws:          clientWs,
 		Service:     g,
 		User:        user,
 		Meta:        &meta,
 	}
+	conn.wsBatch = newWsBatchWriter(conn.writeWsMessage)
+	if config.GlobalConfig.ReplayRecordInput && writable {
+		conn.inputAnnotator = newInputAnnotator(user.ID, config.GlobalConfig.ReplayInputMask)
+	}
 	logger.Infof("User %s start to share session %s", user, sessionId)
 	_ = conn.Run(ctx.Request.Context())
 	g.Cache.RemoveMonitorTunneler(sessionId, tunnelCon)
@@ -642,3 +809,61 @@ func (g *GuacamoleTunnelServer) DeleteShare(ctx *gin.Context) {
 	})
 	ctx.JSON(http.StatusOK, gin.H{"ok": true})
 }
+
+func (g *GuacamoleTunnelServer) Screenshot(ctx *gin.Context) {
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrNoAuthUser))
+		return
+	}
+	user := userItem.(*model.User)
+	sessionId := ctx.Param("sid")
+	result, err := g.JmsService.ValidateJoinSessionPermission(user.ID, sessionId)
+	if err != nil {
+		logger.Errorf("Validate join session err: %s", err)
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse(err))
+		return
+	}
+	if !result.Ok {
+		logger.Errorf("Validate join session failed : %s", result.Msg)
+		ctx.JSON(http.StatusForbidden, ErrorResponse(errors.New(result.Msg)))
+		return
+	}
+	tunnelCon := g.Cache.GetMonitorTunnelerBySessionId(sessionId)
+	if tunnelCon == nil {
+		logger.Errorf("No session %s tunnel found", sessionId)
+		ctx.JSON(http.StatusNotFound, ErrorResponse(ErrNotFoundSession))
+		return
+	}
+	defer func() {
+		_ = tunnelCon.Close()
+		g.Cache.RemoveMonitorTunneler(sessionId, tunnelCon)
+	}()
+	logger.Infof("User %s capture screen of session %s", user, sessionId)
+	screen, err := CaptureScreen(tunnelCon, screenshotTimeout)
+	if err != nil {
+		logger.Errorf("Capture screen of session %s err: %s", sessionId, err)
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse(err))
+		return
+	}
+	ctx.Header("Content-Type", "image/png")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Status(http.StatusOK)
+	if err = screen.EncodePNG(ctx.Writer); err != nil {
+		logger.Errorf("Encode screenshot of session %s err: %s", sessionId, err)
+	}
+}
+
+func (g *GuacamoleTunnelServer) ViewerStats(ctx *gin.Context) {
+	stats := GetViewerStats()
+	if sid := ctx.Query("session_id"); sid != "" {
+		ret := make([]ViewerStats, 0, len(stats))
+		for i := range stats {
+			if stats[i].SessionId == sid {
+				ret = append(ret, stats[i])
+			}
+		}
+		stats = ret
+	}
+	ctx.JSON(http.StatusOK, stats)
+}
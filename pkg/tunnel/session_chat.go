@@ -0,0 +1,266 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jumpserver-dev/sdk-go/common"
+
+	"lion/pkg/config"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+	"lion/pkg/session"
+)
+
+/*
+	会话聊天
+
+	主用户、分享用户和监控用户在 web client 中发送:
+		chat,<内容>
+	消息通过会话事件广播给所有参与者(包括其他节点上的参与者):
+		jms_event,chat_message,{ChatMessage}
+	主用户的 Connection 保存最近的消息，新加入的分享用户和监控用户通过会话事件请求历史消息:
+		jms_event,chat_history,[ChatMessage...]
+	每个用户的发送频率受限制，超过时只通知发送者:
+		jms_event,chat_error,{"error":..}
+	每条消息都以命令记录(# chat(<role>): <内容>)保存到会话的命令审计，和是否开启录像无关；
+	开启录像时同时保存在 {sid}.chat.json，上传时汇总到 replay.json；开启 CHAT_REPLAY_MARKER 时同时写入录像标记。
+*/
+
+const (
+	InstructionChat = "chat"
+
+	ChatMessageEvent        = "chat_message"
+	ChatHistoryRequestEvent = "chat_history_request"
+	ChatHistoryEvent        = "chat_history"
+	ChatErrorEvent          = "chat_error"
+
+	ChatSuffix = ".chat.json"
+
+	ChatRolePrimary = "primary"
+	ChatRoleShare   = "share"
+	ChatRoleMonitor = "monitor"
+
+	chatMaxLength   = 1000
+	chatHistorySize = 200
+
+	// 命令记录的 input 最多 128 个字符，完整的内容保存在录像中
+	chatCommandFormat    = "# chat(%s): %s"
+	chatCommandMaxLength = 128
+
+	// 每个用户 chatRateWindow 内最多发送 chatRateLimit 条消息
+	chatRateLimit  = 5
+	chatRateWindow = 10 * time.Second
+)
+
+const (
+	chatErrTooLong     = "message too long"
+	chatErrRateLimited = "send too frequently"
+)
+
+type ChatMessage struct {
+	Id      string `json:"id"`
+	User    string `json:"user"`
+	UserId  string `json:"user_id"`
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	Time    int64  `json:"time"`
+}
+
+type chatHistoryMessage struct {
+	// 请求历史消息的连接
+	Id       string        `json:"id"`
+	Messages []ChatMessage `json:"messages,omitempty"`
+}
+
+// chatSender 校验消息内容和发送频率，只在读取 web client 消息的协程中使用
+type chatSender struct {
+	User   string
+	UserId string
+	Role   string
+
+	sent []time.Time
+}
+
+func (s *chatSender) NewMessage(inst *guacd.Instruction, now time.Time) (ChatMessage, string) {
+	var content string
+	if len(inst.Args) > 0 {
+		content = strings.TrimSpace(inst.Args[0])
+	}
+	if content == "" {
+		return ChatMessage{}, ""
+	}
+	if utf8.RuneCountInString(content) > chatMaxLength {
+		return ChatMessage{}, chatErrTooLong
+	}
+	recent := s.sent[:0]
+	for _, sentTime := range s.sent {
+		if now.Sub(sentTime) < chatRateWindow {
+			recent = append(recent, sentTime)
+		}
+	}
+	s.sent = recent
+	if len(s.sent) >= chatRateLimit {
+		return ChatMessage{}, chatErrRateLimited
+	}
+	s.sent = append(s.sent, now)
+	return ChatMessage{
+		Id:      common.UUID(),
+		User:    s.User,
+		UserId:  s.UserId,
+		Role:    s.Role,
+		Content: content,
+		Time:    now.UnixMilli(),
+	}, ""
+}
+
+func chatErrorInstruction(errMsg string) guacd.Instruction {
+	p, _ := json.Marshal(map[string]string{"error": errMsg})
+	return NewJmsEventInstruction(ChatErrorEvent, string(p))
+}
+
+func broadcastChatMessage(cache GuaTunnelCache, sid string, msg ChatMessage) {
+	p, _ := json.Marshal(msg)
+	cache.BroadcastSessionEvent(sid, &Event{Type: ChatMessageEvent, Data: p})
+}
+
+// sendChat 内容为空时忽略，超过限制时只通知发送者
+func (t *Connection) sendChat(inst *guacd.Instruction) {
+	msg, errMsg := t.chatSender.NewMessage(inst, time.Now())
+	if errMsg != "" {
+		logger.Infof("Session[%s] drop chat message of %s: %s", t, t.meta.User, errMsg)
+		_ = t.SendWsMessage(chatErrorInstruction(errMsg))
+		return
+	}
+	if msg.Id != "" {
+		broadcastChatMessage(t.Cache, t.Sess.ID, msg)
+	}
+}
+
+// recordChat 主用户的 Connection 保存历史消息并持久化
+func (t *Connection) recordChat(eventMsg *Event) {
+	var msg ChatMessage
+	if err := json.Unmarshal(eventMsg.Data, &msg); err != nil {
+		logger.Errorf("Session[%s] invalid chat message: %s", t, eventMsg.Data)
+		return
+	}
+	t.chatLock.Lock()
+	t.chatHistory = append(t.chatHistory, msg)
+	if len(t.chatHistory) > chatHistorySize {
+		t.chatHistory = t.chatHistory[len(t.chatHistory)-chatHistorySize:]
+	}
+	t.chatLock.Unlock()
+	logger.Infof("Session[%s] chat message from %s(%s): %s", t, msg.User, msg.Role, msg.Content)
+	t.auditChat(msg)
+	if t.replayRecorder != nil {
+		t.replayRecorder.RecordChat(msg)
+	}
+	if config.GlobalConfig.ChatReplayMarker {
+		marker := NewReplayMarker(MarkerChat, msg.User, msg.Content)
+		marker.Time = msg.Time
+		t.recordMarker(marker)
+	}
+}
+
+// auditChat 聊天消息记录到会话的命令审计
+func (t *Connection) auditChat(msg ChatMessage) {
+	input := []rune(fmt.Sprintf(chatCommandFormat, msg.Role, msg.Content))
+	if len(input) > chatCommandMaxLength {
+		input = input[:chatCommandMaxLength]
+	}
+	item := session.ExecutedCommand{CreatedDate: time.UnixMilli(msg.Time)}
+	cmd := t.Service.GenerateCommandItem(t.Sess, msg.User, string(input), "", &item)
+	if err := t.Service.AuditCommand(t.Sess, cmd); err != nil {
+		logger.Errorf("Session[%s] audit chat message of %s err: %s", t, msg.User, err)
+	}
+}
+
+func (t *Connection) chatHistoryMessages() []ChatMessage {
+	t.chatLock.Lock()
+	defer t.chatLock.Unlock()
+	return append([]ChatMessage(nil), t.chatHistory...)
+}
+
+func (t *Connection) replyChatHistory(eventMsg *Event) {
+	var req chatHistoryMessage
+	if err := json.Unmarshal(eventMsg.Data, &req); err != nil || req.Id == "" {
+		logger.Errorf("Session[%s] invalid chat history request: %s", t, eventMsg.Data)
+		return
+	}
+	req.Messages = t.chatHistoryMessages()
+	p, _ := json.Marshal(req)
+	t.Cache.BroadcastSessionEvent(t.Sess.ID, &Event{Type: ChatHistoryEvent, Data: p})
+}
+
+func (t *Connection) chatHistoryInstruction() guacd.Instruction {
+	p, _ := json.Marshal(t.chatHistoryMessages())
+	return NewJmsEventInstruction(ChatHistoryEvent, string(p))
+}
+
+func (m *MonitorCon) sendChat(inst *guacd.Instruction) {
+	msg, errMsg := m.chatSender.NewMessage(inst, time.Now())
+	if errMsg != "" {
+		logger.Infof("Monitor[%s] drop chat message of %s: %s", m.Id, m.User, errMsg)
+		_ = m.SendWsMessage(chatErrorInstruction(errMsg))
+		return
+	}
+	if msg.Id != "" {
+		broadcastChatMessage(m.Service.Cache, m.Id, msg)
+	}
+}
+
+func (m *MonitorCon) requestChatHistory() {
+	p, _ := json.Marshal(chatHistoryMessage{Id: m.subscriberId})
+	m.Service.Cache.BroadcastSessionEvent(m.Id, &Event{Type: ChatHistoryRequestEvent, Data: p})
+}
+
+// chatHistoryInstruction 只处理自己请求的历史消息
+func (m *MonitorCon) chatHistoryInstruction(eventMsg *Event) (guacd.Instruction, bool) {
+	var history chatHistoryMessage
+	if err := json.Unmarshal(eventMsg.Data, &history); err != nil || history.Id != m.subscriberId {
+		return guacd.Instruction{}, false
+	}
+	p, _ := json.Marshal(history.Messages)
+	return NewJmsEventInstruction(ChatHistoryEvent, string(p)), true
+}
+
+func isChatEvent(eventType string) bool {
+	switch eventType {
+	case ChatMessageEvent, ChatHistoryEvent:
+		return true
+	}
+	return false
+}
+
+// RecordChat 追加到 {sid}.chat.json
+func (r *ReplayRecorder) RecordChat(msg ChatMessage) {
+	if r.RootPath == "" {
+		return
+	}
+	r.chatLock.Lock()
+	defer r.chatLock.Unlock()
+	r.chats = append(r.chats, msg)
+	chatPath := filepath.Join(r.RootPath, r.SessionId+ChatSuffix)
+	buf, _ := json.Marshal(r.chats)
+	if err := os.WriteFile(chatPath, buf, os.ModePerm); err != nil {
+		logger.Errorf("ReplayRecorder %s write chat file failed: %v", r.SessionId, err)
+	}
+}
+
+func LoadChatMessages(rootPath, sessionId string) []ChatMessage {
+	buf, err := os.ReadFile(filepath.Join(rootPath, sessionId+ChatSuffix))
+	if err != nil {
+		return nil
+	}
+	var messages []ChatMessage
+	if err = json.Unmarshal(buf, &messages); err != nil {
+		logger.Errorf("Load replay %s chat messages failed: %v", sessionId, err)
+		return nil
+	}
+	return messages
+}
@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/config"
+	"lion/pkg/logger"
+)
+
+/*
+	会话的操作权限，都由 core 已有的接口校验:
+		接管(write)   ValidateJoinSessionPermission，即 core 的监控会话权限，只对进行中的会话有效
+		录像(replay)  以用户的 cookie 请求 core 的会话详情和会话录像 API，
+		              core 按用户在会话所属组织的审计权限(查看会话、查看录像)返回结果
+	释放其他管理员的接管只能由 core 的 unlock_session 任务完成(见 session_takeover.go)。
+*/
+
+const (
+	coreSessionDetailURL = "/api/v1/terminal/sessions/%s/"
+	coreSessionReplayURL = "/api/v1/terminal/sessions/%s/replay/"
+
+	corePermissionTimeout = 10 * time.Second
+)
+
+const (
+	reasonReplayNoSession  = "session not found or no permission to view it"
+	reasonReplayPermission = "no permission to view session replay"
+)
+
+var corePermissionClient = &http.Client{Timeout: corePermissionTimeout}
+
+// ValidateReplayPermission 返回的 error 为调用 core API 失败，没有权限时 Ok 为 false
+func (g *GuacamoleTunnelServer) ValidateReplayPermission(ctx *gin.Context, sessionId string) (model.ValidJoinSessionResult, error) {
+	cookies := ctx.Request.Cookies()
+	code, err := requestCoreAsUser(cookies, fmt.Sprintf(coreSessionDetailURL, sessionId))
+	if err != nil {
+		return model.ValidJoinSessionResult{}, err
+	}
+	switch code {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return model.ValidJoinSessionResult{Ok: false, Msg: reasonReplayNoSession}, nil
+	default:
+		return model.ValidJoinSessionResult{}, fmt.Errorf("core session api status %d", code)
+	}
+	code, err = requestCoreAsUser(cookies, fmt.Sprintf(coreSessionReplayURL, sessionId))
+	if err != nil {
+		return model.ValidJoinSessionResult{}, err
+	}
+	switch code {
+	// 404 为录像还没有上传到 core 的存储
+	case http.StatusOK, http.StatusNotFound:
+		return model.ValidJoinSessionResult{Ok: true}, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return model.ValidJoinSessionResult{Ok: false, Msg: reasonReplayPermission}, nil
+	default:
+		return model.ValidJoinSessionResult{}, fmt.Errorf("core session replay api status %d", code)
+	}
+}
+
+// requestCoreAsUser 携带用户浏览器的 cookie 请求 core，由 core 按用户的权限返回状态码
+func requestCoreAsUser(cookies []*http.Cookie, path string) (int, error) {
+	reqURL := strings.TrimRight(config.GlobalConfig.CoreHost, "/") + path
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	for i := range cookies {
+		req.AddCookie(cookies[i])
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := corePermissionClient.Do(req)
+	if err != nil {
+		logger.Errorf("Request core %s err: %s", path, err)
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
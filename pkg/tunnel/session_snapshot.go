@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"encoding/json"
+
+	"lion/pkg/logger"
+)
+
+/*
+	会话状态的快照和重新同步
+
+	主用户的 Connection 维护会话的状态(在线用户、锁定、控制权、管理员接管)。
+	分享用户和监控用户加入时，以及收到 session_resync(丢失了事件)时，请求状态的快照:
+		session_snapshot_request {"id":<subscriber>}
+		session_snapshot         {"id":..,"users":..,"locked":..,"operator":..,"control":..,"takeover":..}
+	主用户的 Connection 丢失事件时，无法确定在线的分享用户，请求所有分享用户重新上报:
+		share_presence_request
+		share_presence           {MetaShareUserMessage}
+*/
+
+const (
+	SessionSnapshotRequestEvent = "session_snapshot_request"
+	SessionSnapshotEvent        = "session_snapshot"
+
+	SharePresenceRequestEvent = "share_presence_request"
+	SharePresenceEvent        = "share_presence"
+)
+
+type SessionSnapshot struct {
+	// 请求快照的订阅者
+	Id       string                          `json:"id"`
+	Users    map[string]MetaShareUserMessage `json:"users"`
+	Locked   bool                            `json:"locked"`
+	Operator string                          `json:"operator,omitempty"`
+	Control  ControlState                    `json:"control"`
+	Takeover TakeoverState                   `json:"takeover"`
+}
+
+func (t *Connection) replySnapshot(eventMsg *Event) {
+	var snapshot SessionSnapshot
+	if err := json.Unmarshal(eventMsg.Data, &snapshot); err != nil || snapshot.Id == "" {
+		logger.Errorf("Session[%s] invalid snapshot request: %s", t, eventMsg.Data)
+		return
+	}
+	t.traceLock.Lock()
+	snapshot.Users = make(map[string]MetaShareUserMessage, len(t.currentOnlineUsers))
+	for key, meta := range t.currentOnlineUsers {
+		snapshot.Users[key] = meta
+	}
+	t.traceLock.Unlock()
+	switch {
+	case t.lockedStatus.Load():
+		snapshot.Locked = true
+		snapshot.Operator, _ = t.operatorUser.Load().(string)
+	case t.recordBroken.Load():
+		snapshot.Locked = true
+		snapshot.Operator = replayRecorderOperator
+	}
+	snapshot.Control = t.controlState("", controlSync)
+	snapshot.Takeover = t.takeoverState()
+	p, _ := json.Marshal(snapshot)
+	t.Cache.BroadcastSessionEvent(t.Sess.ID, &Event{Type: SessionSnapshotEvent, Data: p})
+}
+
+// resyncPresence 只保留主用户，等待分享用户重新上报
+func (t *Connection) resyncPresence() {
+	logger.Warnf("Session[%s] lost session events, request share users presence", t)
+	t.traceLock.Lock()
+	for key, meta := range t.currentOnlineUsers {
+		if meta.ShareId != t.meta.ShareId {
+			delete(t.currentOnlineUsers, key)
+		}
+	}
+	t.traceLock.Unlock()
+	t.Cache.BroadcastSessionEvent(t.Sess.ID, &Event{Type: SharePresenceRequestEvent})
+}
+
+func (t *Connection) handlePresence(eventMsg *Event) {
+	var meta MetaShareUserMessage
+	if err := json.Unmarshal(eventMsg.Data, &meta); err != nil {
+		logger.Errorf("Session[%s] unmarshal presence message err: %s", t, err)
+		return
+	}
+	key := meta.User + meta.Created
+	t.traceLock.Lock()
+	_, ok := t.currentOnlineUsers[key]
+	t.currentOnlineUsers[key] = meta
+	t.traceLock.Unlock()
+	if !ok {
+		t.notifyShareUsers()
+	}
+}
+
+func (m *MonitorCon) requestSnapshot() {
+	p, _ := json.Marshal(SessionSnapshot{Id: m.subscriberId})
+	m.Service.Cache.BroadcastSessionEvent(m.Id, &Event{Type: SessionSnapshotRequestEvent, Data: p})
+}
+
+func (m *MonitorCon) reportPresence() {
+	p, _ := json.Marshal(m.Meta)
+	m.Service.Cache.BroadcastSessionEvent(m.Id, &Event{Type: SharePresenceEvent, Data: p})
+}
+
+// applySnapshot 只处理自己请求的快照，同步状态并通知 web client
+func (m *MonitorCon) applySnapshot(eventMsg *Event) {
+	var snapshot SessionSnapshot
+	if err := json.Unmarshal(eventMsg.Data, &snapshot); err != nil || snapshot.Id != m.subscriberId {
+		return
+	}
+	m.updateTakeover(snapshot.Takeover)
+	takeover, _ := json.Marshal(snapshot.Takeover)
+	_ = m.SendWsMessage(NewJmsEventInstruction(SessionTakeoverEvent, string(takeover)))
+	if m.Meta == nil {
+		return
+	}
+	users, _ := json.Marshal(snapshot.Users)
+	_ = m.SendWsMessage(NewJmsEventInstruction(ShareUsers, string(users)))
+	wasLocked := m.lockedStatus.Swap(snapshot.Locked)
+	if snapshot.Locked || wasLocked {
+		action := ShareSessionResume
+		if snapshot.Locked {
+			action = ShareSessionPause
+		}
+		p, _ := json.Marshal(map[string]interface{}{"user": snapshot.Operator})
+		_ = m.SendWsMessage(NewJmsEventInstruction(action, string(p)))
+	}
+	m.hasControl.Store(snapshot.Control.Holder == m.Meta.ParticipantId())
+	control, _ := json.Marshal(snapshot.Control)
+	_ = m.SendWsMessage(NewJmsEventInstruction(ControlChangedEvent, string(control)))
+}
@@ -0,0 +1,274 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jumpserver-dev/sdk-go/common"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/config"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+	"lion/pkg/session"
+)
+
+/*
+	管理员接管会话
+
+	管理员在监控页面发送:
+		takeover,start|release
+	也可以通过 REST API 操作，会话不存在(本节点和其他节点)时返回 404:
+		POST   /lion/api/sessions/:sid/takeover/
+		DELETE /lion/api/sessions/:sid/takeover/
+	操作以会话事件转发给主用户的 Connection 处理:
+		session_takeover_action {"action":..,"user":..,"user_id":..,"id":<monitor>}
+	接管期间复用会话的锁定状态(lockedStatus)，主用户和分享用户的输入被丢弃，
+	监控用户默认只读，只有接管的管理员可以输入。结果广播给所有参与者:
+		jms_event,session_takeover,{"action":..,"user":..,"id":..}
+	只有接管的管理员可以释放，在监控页面接管的管理员退出监控时自动释放。
+	其他管理员在 core 解锁会话(unlock_session 任务)时强制释放接管，core 校验解锁会话的权限。
+	core 没有接管相关的 terminal task 和生命周期事件，接管和释放与会话聊天一样记录到会话的命令审计:
+		# takeover: start | release | force release
+	命令的用户为操作的管理员，和监控的 admin_join_monitor/admin_exit_monitor 区分，同时记录录像标记。
+*/
+
+const (
+	InstructionTakeover = "takeover"
+
+	SessionTakeoverActionEvent = "session_takeover_action"
+	SessionTakeoverEvent       = "session_takeover"
+
+	TakeoverStart   = "start"
+	TakeoverRelease = "release"
+)
+
+const (
+	takeoverCommandFormat = "# takeover: %s"
+
+	takeoverCommandForceRelease = "force release"
+)
+
+type TakeoverState struct {
+	Action string `json:"action"`
+	User   string `json:"user,omitempty"`
+	UserId string `json:"user_id,omitempty"`
+	// 在监控页面接管时为监控连接的 subscriberId，REST API 接管时为空，该管理员的所有监控连接都可以输入
+	Id string `json:"id,omitempty"`
+	// core 的 unlock_session 任务强制释放接管，只在主用户的 Connection 中设置
+	Force bool `json:"-"`
+	// 监控页面接管失败的原因，只发送给请求接管的监控用户
+	Error string `json:"error,omitempty"`
+}
+
+func (s TakeoverState) Active() bool {
+	return s.Action == TakeoverStart
+}
+
+// IsHolder 是否是接管会话的管理员的监控连接
+func (s TakeoverState) IsHolder(user, subscriberId string) bool {
+	return s.Active() && s.User == user && (s.Id == "" || s.Id == subscriberId)
+}
+
+func broadcastTakeoverAction(cache GuaTunnelCache, sid string, action TakeoverState) {
+	p, _ := json.Marshal(action)
+	cache.BroadcastSessionEvent(sid, &Event{Type: SessionTakeoverActionEvent, Data: p})
+}
+
+func (t *Connection) handleTakeoverAction(eventMsg *Event) {
+	var action TakeoverState
+	if err := json.Unmarshal(eventMsg.Data, &action); err != nil {
+		logger.Errorf("Session[%s] invalid takeover action: %s", t, eventMsg.Data)
+		return
+	}
+	t.applyTakeover(action)
+}
+
+// applyTakeover 接管前锁定的会话，释放后保持锁定
+func (t *Connection) applyTakeover(action TakeoverState) {
+	t.takeoverLock.Lock()
+	defer t.takeoverLock.Unlock()
+	var (
+		wsEvent   string
+		shareSync string
+		marker    string
+		command   string
+	)
+	switch action.Action {
+	case TakeoverStart:
+		if t.takeover.Active() && action.UserId != t.takeover.UserId && !action.Force {
+			logger.Errorf("Session[%s] ignore takeover from %s, taken over by %s",
+				t, action.User, t.takeover.User)
+			return
+		}
+		if !t.takeover.Active() {
+			t.takeoverLocked = t.lockedStatus.Load()
+		}
+		t.lockedStatus.Store(true)
+		t.operatorUser.Store(action.User)
+		wsEvent, shareSync = "session_pause", ShareSessionPause
+		marker, command = MarkerSessionTakeover, TakeoverStart
+	case TakeoverRelease:
+		if !t.takeover.Active() {
+			logger.Infof("Session[%s] ignore release from %s, not taken over", t, action.User)
+			return
+		}
+		if action.UserId != t.takeover.UserId && !action.Force {
+			logger.Errorf("Session[%s] ignore release from %s, taken over by %s",
+				t, action.User, t.takeover.User)
+			return
+		}
+		if !t.takeoverLocked {
+			t.lockedStatus.Store(false)
+			wsEvent, shareSync = "session_resume", ShareSessionResume
+		}
+		t.operatorUser.Store(action.User)
+		marker, command = MarkerSessionRelease, TakeoverRelease
+		if action.Force {
+			command = takeoverCommandForceRelease
+		}
+	default:
+		logger.Errorf("Session[%s] unknown takeover action %s", t, action.Action)
+		return
+	}
+	logger.Infof("Session[%s] admin %s %s takeover", t, action.User, action.Action)
+	action.Force = false
+	t.takeover = action
+	t.recordMarker(NewReplayMarker(marker, action.User, ""))
+	t.auditSessionAction(action.User, fmt.Sprintf(takeoverCommandFormat, command))
+	if wsEvent != "" {
+		p, _ := json.Marshal(map[string]interface{}{"user": action.User})
+		_ = t.SendWsMessage(NewJmsEventInstruction(wsEvent, string(p)))
+		t.notifySessionAction(shareSync, action.User)
+	}
+	p, _ := json.Marshal(action)
+	t.Cache.BroadcastSessionEvent(t.Sess.ID, &Event{Type: SessionTakeoverEvent, Data: p})
+}
+
+// auditSessionAction 会话操作(接管、控制权转移)和聊天消息一样记录到会话的命令审计
+func (t *Connection) auditSessionAction(user, input string) {
+	item := session.ExecutedCommand{CreatedDate: time.Now()}
+	cmd := t.Service.GenerateCommandItem(t.Sess, user, input, "", &item)
+	if err := t.Service.AuditCommand(t.Sess, cmd); err != nil {
+		logger.Errorf("Session[%s] audit %q of %s err: %s", t, input, user, err)
+	}
+}
+
+// forceReleaseTakeover core 的 unlock_session 任务释放接管并解锁会话
+func (t *Connection) forceReleaseTakeover(user string) bool {
+	if !t.setTakeoverLocked(false) {
+		return false
+	}
+	t.applyTakeover(TakeoverState{Action: TakeoverRelease, User: user, Force: true})
+	return true
+}
+
+// setTakeoverLocked 接管期间管理员锁定或解锁会话，释放接管后生效
+func (t *Connection) setTakeoverLocked(locked bool) bool {
+	t.takeoverLock.Lock()
+	defer t.takeoverLock.Unlock()
+	if !t.takeover.Active() {
+		return false
+	}
+	t.takeoverLocked = locked
+	return true
+}
+
+func (t *Connection) takeoverState() TakeoverState {
+	t.takeoverLock.Lock()
+	defer t.takeoverLock.Unlock()
+	if !t.takeover.Active() {
+		return TakeoverState{Action: TakeoverRelease}
+	}
+	return t.takeover
+}
+
+func (t *Connection) takeoverStateInstruction() guacd.Instruction {
+	p, _ := json.Marshal(t.takeoverState())
+	return NewJmsEventInstruction(SessionTakeoverEvent, string(p))
+}
+
+// handleTakeoverInstruction 只有监控用户可以接管会话
+func (m *MonitorCon) handleTakeoverInstruction(inst *guacd.Instruction) {
+	if len(inst.Args) < 1 || (inst.Args[0] != TakeoverStart && inst.Args[0] != TakeoverRelease) {
+		return
+	}
+	action := TakeoverState{Action: inst.Args[0], User: m.User.String(), UserId: m.User.ID, Id: m.subscriberId}
+	if action.Active() {
+		if err := m.Service.validateWritePermission(m.User.ID, m.Id); err != nil {
+			logger.Errorf("Monitor[%s] user %s takeover permission denied: %s", m.Id, m.User, err)
+			p, _ := json.Marshal(TakeoverState{Action: TakeoverRelease, Error: err.Error()})
+			_ = m.SendWsMessage(NewJmsEventInstruction(SessionTakeoverEvent, string(p)))
+			return
+		}
+	}
+	logger.Infof("Monitor[%s] user %s request %s takeover", m.Id, m.User, action.Action)
+	broadcastTakeoverAction(m.Service.Cache, m.Id, action)
+}
+
+func (m *MonitorCon) updateTakeover(state TakeoverState) {
+	holder := state.IsHolder(m.User.String(), m.subscriberId)
+	if m.takeoverHolder.Swap(holder) && !holder {
+		m.logAdminInputs()
+	}
+	m.takeoverOwned.Store(state.Active() && state.Id == m.subscriberId)
+}
+
+// releaseTakeover 在监控页面接管的管理员退出监控，REST API 的接管需要主动释放
+func (m *MonitorCon) releaseTakeover() {
+	m.logAdminInputs()
+	if !m.takeoverOwned.Load() {
+		return
+	}
+	action := TakeoverState{Action: TakeoverRelease, User: m.User.String(), UserId: m.User.ID}
+	broadcastTakeoverAction(m.Service.Cache, m.Id, action)
+}
+
+// isMonitorEvent 监控用户(不是分享用户)需要处理的会话事件
+func isMonitorEvent(eventType string) bool {
+	switch eventType {
+	case SessionTakeoverEvent, SessionSnapshotEvent, SessionResyncEvent:
+		return true
+	}
+	return isChatEvent(eventType)
+}
+
+func (g *GuacamoleTunnelServer) TakeoverSession(ctx *gin.Context) {
+	g.sessionTakeover(ctx, TakeoverStart)
+}
+
+func (g *GuacamoleTunnelServer) ReleaseSession(ctx *gin.Context) {
+	g.sessionTakeover(ctx, TakeoverRelease)
+}
+
+// sessionTakeover 会话可能在其他节点，通过会话事件转发
+func (g *GuacamoleTunnelServer) sessionTakeover(ctx *gin.Context, action string) {
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrNoAuthUser))
+		return
+	}
+	user := userItem.(*model.User)
+	sessionId := ctx.Param("sid")
+	if !common.IsUUID(sessionId) {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse(ErrNotFoundSession))
+		return
+	}
+	if !g.Cache.HasSession(sessionId) {
+		ctx.JSON(http.StatusNotFound, ErrorResponse(ErrNotFoundSession))
+		return
+	}
+	if err := g.validateWritePermission(user.ID, sessionId); err != nil {
+		logger.Errorf("Validate takeover session %s failed: %s", sessionId, err)
+		ctx.JSON(http.StatusForbidden, ErrorResponse(err))
+		return
+	}
+	// 是否是接管的管理员由主用户的 Connection 判断
+	state := TakeoverState{Action: action, User: user.String(), UserId: user.ID}
+	logger.Infof("User %s request %s takeover of session %s", user, action, sessionId)
+	broadcastTakeoverAction(g.Cache, sessionId, state)
+	ctx.JSON(http.StatusOK, SuccessResponse(state))
+}
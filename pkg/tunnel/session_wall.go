@@ -0,0 +1,255 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/jpeg"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/config"
+	"lion/pkg/display"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	会话墙：启用后每个会话根据 guacd 转发的指令维护画面 (Connection.screen)，
+	定时生成缩略图，通过 websocket 推送给有监控权限的用户。
+	转发 guacd 指令的协程只把指令放入有界的队列(screenFeeder)，图片在单独的协程中解码；
+	队列满时丢弃之后的指令直到下一个 sync，缩略图可能短暂不完整，不会拖慢会话。
+*/
+
+const (
+	thumbnailMaxWidth  = 320
+	thumbnailMaxHeight = 180
+	thumbnailQuality   = 60
+
+	// 监控权限的缓存时间
+	wallPermissionCacheTime = time.Minute
+
+	// 会话画面处理队列的指令数量
+	screenQueueSize = 1024
+)
+
+type SessionThumbnail struct {
+	SessionId string `json:"session_id"`
+	User      string `json:"user"`
+	Asset     string `json:"asset"`
+	Account   string `json:"account"`
+	Protocol  string `json:"protocol"`
+	DateStart string `json:"date_start"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Image     string `json:"image"`
+	Updated   int64  `json:"updated"`
+}
+
+type SessionWallMessage struct {
+	Type string             `json:"type"`
+	Data []SessionThumbnail `json:"data"`
+}
+
+func getSessionWallInterval() time.Duration {
+	interval := config.GlobalConfig.SessionWallInterval
+	if interval <= 0 {
+		interval = 5
+	}
+	return time.Duration(interval) * time.Second
+}
+
+type screenFeeder struct {
+	screen *display.Display
+	queue  chan guacd.Instruction
+
+	// 只在转发 guacd 指令的协程中使用
+	skipping bool
+	dropped  int64
+}
+
+func newScreenFeeder(screen *display.Display) *screenFeeder {
+	f := screenFeeder{
+		screen: screen,
+		queue:  make(chan guacd.Instruction, screenQueueSize),
+	}
+	go f.run()
+	return &f
+}
+
+// Feed 不阻塞，队列满时丢弃指令直到下一个 sync 可以入队
+func (f *screenFeeder) Feed(inst *guacd.Instruction) {
+	if f.skipping && inst.Opcode != guacd.InstructionClientSync {
+		f.dropped++
+		return
+	}
+	select {
+	case f.queue <- *inst:
+		f.skipping = false
+	default:
+		f.skipping = true
+		f.dropped++
+	}
+}
+
+// Close 由转发 guacd 指令的协程在退出时调用
+func (f *screenFeeder) Close() {
+	close(f.queue)
+	if f.dropped > 0 {
+		logger.Infof("Session wall screen dropped %d instructions", f.dropped)
+	}
+}
+
+func (f *screenFeeder) run() {
+	for inst := range f.queue {
+		f.screen.Process(&inst)
+	}
+}
+
+// Thumbnail 画面没有变化时返回缓存的缩略图，未启用会话墙或者没有画面时返回 nil
+func (t *Connection) Thumbnail() *SessionThumbnail {
+	if t.screen == nil {
+		return nil
+	}
+	t.thumbLock.Lock()
+	defer t.thumbLock.Unlock()
+	version := t.screen.Version()
+	if t.thumbnail != nil && t.thumbVersion == version {
+		return t.thumbnail
+	}
+	width, height := t.screen.Size()
+	if width == 0 || height == 0 {
+		return nil
+	}
+	img := t.screen.Thumbnail(thumbnailMaxWidth, thumbnailMaxHeight)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		logger.Errorf("Session[%s] encode thumbnail err: %s", t, err)
+		return nil
+	}
+	thumbnail := SessionThumbnail{
+		SessionId: t.Sess.ID,
+		User:      t.Sess.User.String(),
+		Asset:     t.Sess.Asset.String(),
+		Account:   t.Sess.Account.String(),
+		Protocol:  t.Sess.Protocol,
+		DateStart: t.Sess.Created.String(),
+		Width:     width,
+		Height:    height,
+		Image:     "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+		Updated:   time.Now().Unix(),
+	}
+	t.thumbnail = &thumbnail
+	t.thumbVersion = version
+	return t.thumbnail
+}
+
+func getLocalSessionThumbnails(conns []*Connection) []SessionThumbnail {
+	ret := make([]SessionThumbnail, 0, len(conns))
+	for i := range conns {
+		if thumbnail := conns[i].Thumbnail(); thumbnail != nil {
+			ret = append(ret, *thumbnail)
+		}
+	}
+	return ret
+}
+
+func (g *GuacamoleTunnelServer) SessionWall(ctx *gin.Context) {
+	ws, err := getUpGrader().Upgrade(ctx.Writer, ctx.Request, ctx.Writer.Header())
+	if err != nil {
+		logger.Errorf("Websocket Upgrade err: %+v", err)
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	defer ws.Close()
+	userItem, ok := ctx.Get(config.GinCtxUserKey)
+	if !ok {
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrAuthUser.String()))
+		return
+	}
+	user := userItem.(*model.User)
+	if !config.GlobalConfig.EnableSessionWall {
+		logger.Errorf("User %s request session wall, but session wall is disabled", user)
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrBadParams.String()))
+		return
+	}
+	logger.Infof("User %s start to watch session wall", user)
+	defer logger.Infof("User %s stop to watch session wall", user)
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err1 := ws.ReadMessage(); err1 != nil {
+				readErr <- err1
+				return
+			}
+		}
+	}()
+	perms := newWallPermissionCache(g, user)
+	ticker := time.NewTicker(getSessionWallInterval())
+	defer ticker.Stop()
+	sent := make(map[string]int64)
+	for {
+		msg := SessionWallMessage{Type: "thumbnails", Data: make([]SessionThumbnail, 0)}
+		current := make(map[string]int64)
+		for _, thumbnail := range g.Cache.GetSessionThumbnails() {
+			if !perms.Allow(thumbnail.SessionId) {
+				continue
+			}
+			current[thumbnail.SessionId] = thumbnail.Updated
+			// 没有变化的缩略图不重复发送
+			if updated, ok := sent[thumbnail.SessionId]; ok && updated == thumbnail.Updated {
+				thumbnail.Image = ""
+			}
+			msg.Data = append(msg.Data, thumbnail)
+		}
+		sent = current
+		if err = ws.WriteJSON(msg); err != nil {
+			logger.Errorf("User %s session wall write err: %s", user, err)
+			return
+		}
+		select {
+		case <-ticker.C:
+		case err = <-readErr:
+			logger.Infof("User %s session wall read err: %s", user, err)
+			return
+		case <-ctx.Request.Context().Done():
+			return
+		}
+	}
+}
+
+func newWallPermissionCache(g *GuacamoleTunnelServer, user *model.User) *wallPermissionCache {
+	return &wallPermissionCache{
+		g:     g,
+		user:  user,
+		perms: make(map[string]wallPermission),
+	}
+}
+
+type wallPermission struct {
+	ok      bool
+	expired time.Time
+}
+
+type wallPermissionCache struct {
+	g     *GuacamoleTunnelServer
+	user  *model.User
+	perms map[string]wallPermission
+}
+
+func (w *wallPermissionCache) Allow(sid string) bool {
+	if perm, ok := w.perms[sid]; ok && time.Now().Before(perm.expired) {
+		return perm.ok
+	}
+	result, err := w.g.JmsService.ValidateJoinSessionPermission(w.user.ID, sid)
+	if err != nil {
+		logger.Errorf("Validate user %s join session %s err: %s", w.user, sid, err)
+		return false
+	}
+	w.perms[sid] = wallPermission{ok: result.Ok, expired: time.Now().Add(wallPermissionCacheTime)}
+	return result.Ok
+}
@@ -0,0 +1,275 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jumpserver-dev/sdk-go/common"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"lion/pkg/config"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	分享用户加入前需要主用户同意(SHARE_APPROVAL)
+
+	分享用户的 websocket 处于等待状态，收到:
+		jms_event,share_knock_pending,{ShareKnock}
+	主用户的 web client 收到包含用户和 IP 的请求，同意或拒绝:
+		jms_event,share_knock,{ShareKnock}
+		knock,<id>,accept|deny
+	结果广播给所有节点，主用户的 web client 也会收到，用于关闭提示:
+		jms_event,share_knock_reply,{ShareKnockReply}
+	SHARE_APPROVAL_TIMEOUT 秒内没有结果时拒绝，结果记录到会话的生命周期日志。
+	等待期间在后台读取分享用户的 websocket(knockWsConn)，回复 ping 并定时发送 nop 保持连接，
+	丢弃其他消息；分享用户关闭连接时取消等待，同样广播 share_knock_reply 关闭主用户的提示。
+	同意后 MonitorCon 继续从 knockWsConn 读取消息。
+*/
+
+const (
+	InstructionKnock = "knock"
+
+	ShareKnockEvent        = "share_knock"
+	ShareKnockReplyEvent   = "share_knock_reply"
+	ShareKnockPendingEvent = "share_knock_pending"
+
+	knockAccept  = "accept"
+	knockDeny    = "deny"
+	knockTimeout = "timeout"
+	knockCancel  = "cancel"
+
+	knockNopInterval = 5 * time.Second
+)
+
+const (
+	reasonShareApproved        = "Share join approved by %s"
+	reasonShareDenied          = "Share join denied by %s"
+	reasonShareApprovalTimeout = "Share join approval timeout"
+	reasonShareKnockCanceled   = "Share join canceled by user"
+)
+
+type ShareKnock struct {
+	Id      string               `json:"id"`
+	Meta    MetaShareUserMessage `json:"meta"`
+	Timeout int                  `json:"timeout"`
+}
+
+type ShareKnockReply struct {
+	Id       string `json:"id"`
+	Accepted bool   `json:"accepted"`
+	// 做出决定的主用户，超时为空
+	User   string `json:"user,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (r *ShareKnockReply) LifecycleLog(meta *MetaShareUserMessage) model.SessionLifecycleLog {
+	logObj := model.SessionLifecycleLog{User: meta.User}
+	switch r.Reason {
+	case knockAccept:
+		logObj.Reason = fmt.Sprintf(reasonShareApproved, r.User)
+	case knockDeny:
+		logObj.Reason = fmt.Sprintf(reasonShareDenied, r.User)
+	case knockCancel:
+		logObj.Reason = reasonShareKnockCanceled
+	default:
+		logObj.Reason = reasonShareApprovalTimeout
+	}
+	return logObj
+}
+
+type wsMessage struct {
+	messageType int
+	data        []byte
+}
+
+// knockWsConn 在后台读取 websocket，等待期间和同意后的 MonitorCon 都从 messages 读取
+type knockWsConn struct {
+	*websocket.Conn
+
+	messages chan wsMessage
+	// 读取失败的原因，messages 关闭后可以读取
+	err error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newKnockWsConn(ws *websocket.Conn) *knockWsConn {
+	c := &knockWsConn{
+		Conn:     ws,
+		messages: make(chan wsMessage),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *knockWsConn) readLoop() {
+	for {
+		messageType, data, err := c.Conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			close(c.messages)
+			return
+		}
+		select {
+		case c.messages <- wsMessage{messageType: messageType, data: data}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *knockWsConn) ReadMessage() (int, []byte, error) {
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			return 0, nil, c.err
+		}
+		return msg.messageType, msg.data, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *knockWsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// waitShareApproval 等待主用户的决定，等待期间只回复 ping，分享用户关闭连接时取消等待
+func (g *GuacamoleTunnelServer) waitShareApproval(ws *knockWsConn, meta *MetaShareUserMessage) ShareKnockReply {
+	timeout := time.Duration(config.GlobalConfig.ShareApprovalTimeout) * time.Second
+	knock := ShareKnock{Id: common.UUID(), Meta: *meta, Timeout: int(timeout.Seconds())}
+	eventChan := g.Cache.GetSessionEventChan(meta.SessionId)
+	defer g.Cache.RecycleSessionEventChannel(meta.SessionId, eventChan)
+
+	p, _ := json.Marshal(knock)
+	pending := NewJmsEventInstruction(ShareKnockPendingEvent, string(p))
+	_ = ws.WriteMessage(websocket.TextMessage, []byte(pending.String()))
+	logger.Infof("User %s(%s) knock to join session %s", meta.User, meta.RemoteAddr, meta.SessionId)
+	g.Cache.BroadcastSessionEvent(meta.SessionId, &Event{Type: ShareKnockEvent, Data: p})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	nopTicker := time.NewTicker(knockNopInterval)
+	defer nopTicker.Stop()
+	nop := guacd.NewInstruction(guacd.InstructionClientNop)
+	reply := ShareKnockReply{Id: knock.Id, Reason: knockTimeout}
+	for waiting := true; waiting; {
+		select {
+		case msg, ok := <-ws.messages:
+			if !ok {
+				logger.Infof("User %s cancel knock to join session %s: %v", meta.User, meta.SessionId, ws.err)
+				reply.Reason = knockCancel
+				p, _ = json.Marshal(reply)
+				g.Cache.BroadcastSessionEvent(meta.SessionId, &Event{Type: ShareKnockReplyEvent, Data: p})
+				waiting = false
+				break
+			}
+			ret, err := guacd.ParseInstructionString(string(msg.data))
+			if err == nil && ret.Opcode == INTERNALDATAOPCODE && len(ret.Args) >= 2 && ret.Args[0] == PINGOPCODE {
+				ping := guacd.NewInstruction(INTERNALDATAOPCODE, PINGOPCODE)
+				_ = ws.WriteMessage(websocket.TextMessage, []byte(ping.String()))
+			}
+		case <-nopTicker.C:
+			_ = ws.WriteMessage(websocket.TextMessage, []byte(nop.String()))
+		case event, ok := <-eventChan.eventCh:
+			if !ok {
+				waiting = false
+				break
+			}
+			if event.Type != ShareKnockReplyEvent {
+				continue
+			}
+			var ret ShareKnockReply
+			if err := json.Unmarshal(event.Data, &ret); err != nil || ret.Id != knock.Id {
+				continue
+			}
+			reply = ret
+			waiting = false
+		case <-timer.C:
+			// 通知主用户的 web client 关闭提示
+			p, _ = json.Marshal(reply)
+			g.Cache.BroadcastSessionEvent(meta.SessionId, &Event{Type: ShareKnockReplyEvent, Data: p})
+			waiting = false
+		}
+	}
+	logger.Infof("User %s knock to join session %s result: %s %s",
+		meta.User, meta.SessionId, reply.Reason, reply.User)
+	switch {
+	case reply.Accepted, reply.Reason == knockCancel:
+	case reply.Reason == knockDeny:
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrShareDenied.String()))
+	default:
+		_ = ws.WriteMessage(websocket.TextMessage, []byte(ErrShareApprovalTimeout.String()))
+	}
+	return reply
+}
+
+func (t *Connection) addKnock(eventMsg *Event) {
+	var knock ShareKnock
+	if err := json.Unmarshal(eventMsg.Data, &knock); err != nil {
+		logger.Errorf("Session[%s] invalid knock event: %s", t, eventMsg.Data)
+		return
+	}
+	t.traceLock.Lock()
+	defer t.traceLock.Unlock()
+	if t.knocks == nil {
+		t.knocks = make(map[string]ShareKnock)
+	}
+	t.knocks[knock.Id] = knock
+}
+
+func (t *Connection) removeKnock(eventMsg *Event) {
+	var reply ShareKnockReply
+	if err := json.Unmarshal(eventMsg.Data, &reply); err != nil {
+		return
+	}
+	t.traceLock.Lock()
+	defer t.traceLock.Unlock()
+	delete(t.knocks, reply.Id)
+}
+
+// handleKnockInstruction 主用户同意或拒绝等待中的分享用户
+func (t *Connection) handleKnockInstruction(inst *guacd.Instruction) {
+	if len(inst.Args) < 2 {
+		return
+	}
+	id, action := inst.Args[0], inst.Args[1]
+	t.traceLock.Lock()
+	knock, ok := t.knocks[id]
+	t.traceLock.Unlock()
+	if !ok || (action != knockAccept && action != knockDeny) {
+		logger.Infof("Session[%s] ignore knock %s %s", t, id, action)
+		return
+	}
+	reply := ShareKnockReply{
+		Id:       id,
+		Accepted: action == knockAccept,
+		User:     t.meta.User,
+		Reason:   action,
+	}
+	logger.Infof("Session[%s] user %s %s knock of %s(%s)", t, t.meta.User, action,
+		knock.Meta.User, knock.Meta.RemoteAddr)
+	p, _ := json.Marshal(reply)
+	t.Cache.BroadcastSessionEvent(t.Sess.ID, &Event{Type: ShareKnockReplyEvent, Data: p})
+}
+
+// pendingKnockInstructions web client 重连后重新提示等待中的分享用户
+func (t *Connection) pendingKnockInstructions() []guacd.Instruction {
+	t.traceLock.Lock()
+	defer t.traceLock.Unlock()
+	ret := make([]guacd.Instruction, 0, len(t.knocks))
+	for _, knock := range t.knocks {
+		p, _ := json.Marshal(knock)
+		ret = append(ret, NewJmsEventInstruction(ShareKnockEvent, string(p)))
+	}
+	return ret
+}
@@ -0,0 +1,559 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image/jpeg"
+	"image/png"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"lion/pkg/config"
+	"lion/pkg/display"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	监控、分享用户的画面先读入有界队列，再由发送协程转发给用户，
+	保证 guacd 的 join tunnel 始终被及时读取，避免慢速用户拖慢会话。
+	guacd 的 sync 在入队(或丢弃)时由 lion 立即回复，guacd 不会因为慢速用户降低帧率；
+	用户 web client 回复的 sync 不再转发给 guacd，只用于统计用户的延迟(ack_lag_ms)。
+
+	队列超过上限时的处理策略:
+	drop: 丢弃绘制指令直到队列降到一半以下的 sync；
+	      lion 为每个用户维护完整的画面，结束丢帧时先发送全屏的关键帧，修复丢弃的绘制
+	degrade: 队列超过 1/4 时将不透明的 png 转为 jpeg，仍然超过上限时按照 drop 处理
+	disconnect: 断开该用户
+	无法丢弃的指令使队列超过上限的两倍时，任何策略都会断开该用户
+*/
+
+const (
+	ViewerPolicyDrop       = "drop"
+	ViewerPolicyDegrade    = "degrade"
+	ViewerPolicyDisconnect = "disconnect"
+)
+
+var ErrViewerQueueOverflow = errors.New("viewer queue overflow")
+
+// 丢帧时可以丢弃的绘制指令，改变图层状态的指令 (size, move, dispose 等) 必须发送
+var viewerDroppableOpcodes = map[string]struct{}{
+	guacd.InstructionDrawingArc:      {},
+	guacd.InstructionDrawingCfill:    {},
+	guacd.InstructionDrawingClip:     {},
+	guacd.InstructionDrawingClose:    {},
+	guacd.InstructionDrawingCopy:     {},
+	guacd.InstructionDrawingCstroke:  {},
+	guacd.InstructionDrawingCurve:    {},
+	guacd.InstructionDrawingJpeg:     {},
+	guacd.InstructionDrawingLfill:    {},
+	guacd.InstructionDrawingLine:     {},
+	guacd.InstructionDrawingLstroke:  {},
+	guacd.InstructionDrawingPng:      {},
+	guacd.InstructionDrawingRect:     {},
+	guacd.InstructionDrawingStart:    {},
+	guacd.InstructionDrawingTransfer: {},
+}
+
+const viewerBlobMaxLength = 6048
+
+// 等待用户回复的 sync 数量上限，只用于统计延迟
+const viewerPendingAckMax = 128
+
+// 关键帧使用的图片流编号，避免和 guacd 正在传输的图片流冲突
+const viewerKeyframeStreamBase = 1 << 20
+
+var viewers = viewerManager{streams: make(map[string]*ViewerStream)}
+
+type viewerManager struct {
+	sync.Mutex
+	streams map[string]*ViewerStream
+}
+
+func (m *viewerManager) Add(v *ViewerStream) {
+	m.Lock()
+	defer m.Unlock()
+	m.streams[v.Id] = v
+}
+
+func (m *viewerManager) Delete(v *ViewerStream) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.streams, v.Id)
+}
+
+func (m *viewerManager) Stats() []ViewerStats {
+	m.Lock()
+	ret := make([]ViewerStats, 0, len(m.streams))
+	for _, v := range m.streams {
+		ret = append(ret, v.Stats())
+	}
+	m.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created < ret[j].Created
+	})
+	return ret
+}
+
+func GetViewerStats() []ViewerStats {
+	return viewers.Stats()
+}
+
+type ViewerStats struct {
+	Id        string `json:"id"`
+	SessionId string `json:"session_id"`
+	User      string `json:"user"`
+	Policy    string `json:"policy"`
+	Created   string `json:"created"`
+
+	QueuedBytes        int   `json:"queued_bytes"`
+	QueuedInstructions int   `json:"queued_instructions"`
+	LagMs              int64 `json:"lag_ms"`
+	Dropping           bool  `json:"dropping"`
+
+	SentBytes      int64 `json:"sent_bytes"`
+	DroppedFrames  int64 `json:"dropped_frames"`
+	DroppedBytes   int64 `json:"dropped_bytes"`
+	DegradedImages int64 `json:"degraded_images"`
+	SlowTimes      int64 `json:"slow_times"`
+
+	AckedSyncs int64 `json:"acked_syncs"`
+	AckLagMs   int64 `json:"ack_lag_ms"`
+}
+
+type viewerItem struct {
+	ins  guacd.Instruction
+	size int
+	time time.Time
+}
+
+type viewerSync struct {
+	timestamp int64
+	time      time.Time
+}
+
+type degradeImage struct {
+	img     guacd.Instruction
+	data    bytes.Buffer
+	invalid bool
+}
+
+// NewViewerStream ackSync 为 nil 时不回复 guacd 的 sync (由 redis 代理所在节点的 ViewerStream 回复)
+func NewViewerStream(id, sessionId, user string, tunnel Tunneler,
+	ackSync func(ins *guacd.Instruction) error) *ViewerStream {
+	cfg := config.GlobalConfig
+	policy := cfg.ViewerSlowPolicy
+	switch policy {
+	case ViewerPolicyDrop, ViewerPolicyDegrade, ViewerPolicyDisconnect:
+	default:
+		policy = ViewerPolicyDrop
+	}
+	quality := cfg.ViewerDegradeQuality
+	if quality <= 0 || quality > 100 {
+		quality = jpeg.DefaultQuality
+	}
+	var screen *display.Display
+	if policy != ViewerPolicyDisconnect {
+		screen = display.New()
+	}
+	return &ViewerStream{
+		Id:             id,
+		SessionId:      sessionId,
+		User:           user,
+		tunnel:         tunnel,
+		ackSync:        ackSync,
+		policy:         policy,
+		maxSize:        cfg.ViewerQueueMaxSize,
+		quality:        quality,
+		created:        time.Now(),
+		notify:         make(chan struct{}, 1),
+		droppedStreams: make(map[string]struct{}),
+		degradeStreams: make(map[string]*degradeImage),
+		screen:         screen,
+	}
+}
+
+// ViewerStream 监控、分享用户的有界发送队列
+type ViewerStream struct {
+	Id        string
+	SessionId string
+	User      string
+
+	tunnel  Tunneler
+	ackSync func(ins *guacd.Instruction) error
+
+	policy  string
+	maxSize int
+	quality int
+	created time.Time
+
+	lock        sync.Mutex
+	items       []viewerItem
+	queuedBytes int
+	notify      chan struct{}
+	readErr     error
+	overflow    bool
+
+	dropping       bool
+	droppedStreams map[string]struct{}
+	degradeStreams map[string]*degradeImage
+
+	// 发送给用户、等待用户回复的 sync
+	pendingAcks []viewerSync
+
+	// 只在 receive 协程中使用，结束丢帧的 sync
+	screen       *display.Display
+	keyframeSync *guacd.Instruction
+
+	sentBytes      int64
+	droppedFrames  int64
+	droppedBytes   int64
+	degradedImages int64
+	slowTimes      int64
+	ackedSyncs     int64
+	ackLag         time.Duration
+}
+
+func (v *ViewerStream) String() string {
+	return v.Id
+}
+
+// Run 持续读取 guacd 的画面，通过 send 发送给用户，直到 tunnel 读取失败或者发送失败
+func (v *ViewerStream) Run(send func(ins *guacd.Instruction) error) error {
+	viewers.Add(v)
+	defer viewers.Delete(v)
+	go v.receive()
+	for {
+		item, err := v.next()
+		if err != nil {
+			return err
+		}
+		if err = send(&item.ins); err != nil {
+			return err
+		}
+		v.lock.Lock()
+		v.sentBytes += int64(item.size)
+		v.lock.Unlock()
+	}
+}
+
+func (v *ViewerStream) Stats() ViewerStats {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	var lag int64
+	if len(v.items) > 0 {
+		lag = time.Since(v.items[0].time).Milliseconds()
+	}
+	return ViewerStats{
+		Id:                 v.Id,
+		SessionId:          v.SessionId,
+		User:               v.User,
+		Policy:             v.policy,
+		Created:            v.created.UTC().Format(time.RFC3339),
+		QueuedBytes:        v.queuedBytes,
+		QueuedInstructions: len(v.items),
+		LagMs:              lag,
+		Dropping:           v.dropping,
+		SentBytes:          v.sentBytes,
+		DroppedFrames:      v.droppedFrames,
+		DroppedBytes:       v.droppedBytes,
+		DegradedImages:     v.degradedImages,
+		SlowTimes:          v.slowTimes,
+		AckedSyncs:         v.ackedSyncs,
+		AckLagMs:           v.ackLag.Milliseconds(),
+	}
+}
+
+func (v *ViewerStream) signal() {
+	select {
+	case v.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (v *ViewerStream) receive() {
+	for {
+		ins, err := v.tunnel.ReadInstruction()
+		if err != nil {
+			v.lock.Lock()
+			v.readErr = err
+			v.lock.Unlock()
+			v.signal()
+			return
+		}
+		overflow := v.push(ins)
+		v.signal()
+		if overflow {
+			return
+		}
+	}
+}
+
+// next 读取队列中的指令，队列为空时等待；tunnel 读取失败时，先发送完剩余的指令
+func (v *ViewerStream) next() (viewerItem, error) {
+	for {
+		v.lock.Lock()
+		if v.overflow {
+			v.lock.Unlock()
+			return viewerItem{}, ErrViewerQueueOverflow
+		}
+		if len(v.items) > 0 {
+			item := v.items[0]
+			v.items[0] = viewerItem{}
+			v.items = v.items[1:]
+			v.queuedBytes -= item.size
+			v.lock.Unlock()
+			return item, nil
+		}
+		if err := v.readErr; err != nil {
+			v.lock.Unlock()
+			return viewerItem{}, err
+		}
+		v.lock.Unlock()
+		<-v.notify
+	}
+}
+
+// push 只在 receive 协程中调用，sync 入队或丢弃后立即回复 guacd，回复 sync 和生成关键帧时不持有 v.lock
+func (v *ViewerStream) push(ins guacd.Instruction) bool {
+	if v.screen != nil {
+		v.screen.Process(&ins)
+	}
+	v.lock.Lock()
+	if v.policy != ViewerPolicyDegrade || !v.degradeLocked(&ins) {
+		v.enqueueLocked(ins)
+	}
+	syncIns := v.keyframeSync
+	v.keyframeSync = nil
+	overflow := v.overflow
+	v.lock.Unlock()
+	if ins.Opcode == guacd.InstructionClientSync && v.ackSync != nil && !overflow {
+		if err := v.ackSync(&ins); err != nil {
+			logger.Errorf("Viewer[%s] reply sync err: %+v", v, err)
+		}
+	}
+	if syncIns != nil && !overflow {
+		v.enqueueKeyframe(*syncIns)
+	}
+	return overflow
+}
+
+// enqueueKeyframe 结束丢帧时发送全屏的关键帧和结束丢帧的 sync
+func (v *ViewerStream) enqueueKeyframe(syncIns guacd.Instruction) {
+	frame := append(viewerKeyframe(v.screen), syncIns)
+	now := time.Now()
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, ins := range frame {
+		size := len(ins.String())
+		v.items = append(v.items, viewerItem{ins: ins, size: size, time: now})
+		v.queuedBytes += size
+	}
+	v.trackSyncLocked(&syncIns, now)
+}
+
+// trackSyncLocked 记录入队的 sync，用户回复时计算延迟
+func (v *ViewerStream) trackSyncLocked(ins *guacd.Instruction, now time.Time) {
+	if ins.Opcode != guacd.InstructionClientSync || len(ins.Args) == 0 {
+		return
+	}
+	if len(v.pendingAcks) >= viewerPendingAckMax {
+		v.pendingAcks[0] = viewerSync{}
+		v.pendingAcks = v.pendingAcks[1:]
+	}
+	v.pendingAcks = append(v.pendingAcks, viewerSync{timestamp: int64(atoi(ins.Args[0])), time: now})
+}
+
+// ClientAck 用户 web client 回复的 sync，guacd 的 sync 已经由 lion 回复，这里只统计延迟
+func (v *ViewerStream) ClientAck(ins *guacd.Instruction) {
+	if len(ins.Args) == 0 {
+		return
+	}
+	timestamp := int64(atoi(ins.Args[0]))
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for len(v.pendingAcks) > 0 && v.pendingAcks[0].timestamp <= timestamp {
+		item := v.pendingAcks[0]
+		v.pendingAcks[0] = viewerSync{}
+		v.pendingAcks = v.pendingAcks[1:]
+		if item.timestamp == timestamp {
+			v.ackedSyncs++
+			v.ackLag = time.Since(item.time)
+		}
+	}
+}
+
+// viewerKeyframe 关键帧的图片流使用单独的编号
+func viewerKeyframe(screen *display.Display) []guacd.Instruction {
+	frame := screen.Keyframe(viewerBlobMaxLength)
+	for i := range frame {
+		switch frame[i].Opcode {
+		case guacd.InstructionStreamingImg, guacd.InstructionStreamingBlob, guacd.InstructionStreamingEnd:
+			args := append([]string(nil), frame[i].Args...)
+			args[0] = strconv.Itoa(viewerKeyframeStreamBase + atoi(args[0]))
+			frame[i] = guacd.NewInstruction(frame[i].Opcode, args...)
+		}
+	}
+	return frame
+}
+
+func (v *ViewerStream) enqueueLocked(ins guacd.Instruction) {
+	size := len(ins.String())
+	switch ins.Opcode {
+	case guacd.InstructionStreamingBlob, guacd.InstructionStreamingEnd:
+		// 已经丢弃的图片流，后续的数据也需要丢弃
+		if len(ins.Args) > 0 {
+			if _, ok := v.droppedStreams[ins.Args[0]]; ok {
+				if ins.Opcode == guacd.InstructionStreamingEnd {
+					delete(v.droppedStreams, ins.Args[0])
+				}
+				v.droppedBytes += int64(size)
+				return
+			}
+		}
+	}
+	if !v.dropping && v.queuedBytes+size > v.maxSize {
+		v.slowTimes++
+		if v.policy == ViewerPolicyDisconnect {
+			logger.Errorf("Viewer[%s] of session %s queue overflow %d bytes, disconnect",
+				v, v.SessionId, v.queuedBytes)
+			v.overflow = true
+			return
+		}
+		logger.Warnf("Viewer[%s] of session %s queue overflow %d bytes, drop frames",
+			v, v.SessionId, v.queuedBytes)
+		v.dropping = true
+	}
+	if v.dropping && v.dropLocked(&ins, size) {
+		return
+	}
+	// 不能丢弃的指令 (音频等) 也超过上限太多时，只能断开
+	if v.queuedBytes+size > 2*v.maxSize {
+		logger.Errorf("Viewer[%s] of session %s queue overflow %d bytes when dropping, disconnect",
+			v, v.SessionId, v.queuedBytes)
+		v.overflow = true
+		return
+	}
+	now := time.Now()
+	v.items = append(v.items, viewerItem{ins: ins, size: size, time: now})
+	v.queuedBytes += size
+	v.trackSyncLocked(&ins, now)
+}
+
+// dropLocked 返回 true 表示指令已丢弃
+func (v *ViewerStream) dropLocked(ins *guacd.Instruction, size int) bool {
+	switch ins.Opcode {
+	case guacd.InstructionClientSync:
+		if v.queuedBytes <= v.maxSize/2 {
+			v.dropping = false
+			syncIns := *ins
+			v.keyframeSync = &syncIns
+			logger.Infof("Viewer[%s] of session %s stop dropping frames, send keyframe", v, v.SessionId)
+			return true
+		}
+		v.droppedFrames++
+		v.droppedBytes += int64(size)
+		return true
+	case guacd.InstructionStreamingImg:
+		if len(ins.Args) > 0 {
+			v.droppedStreams[ins.Args[0]] = struct{}{}
+		}
+		v.droppedBytes += int64(size)
+		return true
+	}
+	if _, ok := viewerDroppableOpcodes[ins.Opcode]; ok {
+		v.droppedBytes += int64(size)
+		return true
+	}
+	return false
+}
+
+// degradeLocked 缓存 png 图片流，结束时转换为 jpeg，返回 true 表示指令已处理
+func (v *ViewerStream) degradeLocked(ins *guacd.Instruction) bool {
+	switch ins.Opcode {
+	case guacd.InstructionStreamingImg:
+		// img,stream,mask,layer,mimetype,x,y
+		if len(ins.Args) < 6 || ins.Args[3] != "image/png" || v.queuedBytes < v.maxSize/4 {
+			return false
+		}
+		v.degradeStreams[ins.Args[0]] = &degradeImage{img: *ins}
+		return true
+	case guacd.InstructionStreamingBlob:
+		if len(ins.Args) < 2 {
+			return false
+		}
+		d, ok := v.degradeStreams[ins.Args[0]]
+		if !ok {
+			return false
+		}
+		data, err := base64.StdEncoding.DecodeString(ins.Args[1])
+		if err != nil {
+			d.invalid = true
+		}
+		d.data.Write(data)
+		return true
+	case guacd.InstructionStreamingEnd:
+		if len(ins.Args) < 1 {
+			return false
+		}
+		d, ok := v.degradeStreams[ins.Args[0]]
+		if !ok {
+			return false
+		}
+		delete(v.degradeStreams, ins.Args[0])
+		for _, item := range v.degradeImage(d, *ins) {
+			v.enqueueLocked(item)
+		}
+		return true
+	}
+	return false
+}
+
+func (v *ViewerStream) degradeImage(d *degradeImage, end guacd.Instruction) []guacd.Instruction {
+	stream := d.img.Args[0]
+	raw := d.data.Bytes()
+	img := d.img
+	if !d.invalid {
+		if data, ok := encodeOpaqueJpeg(raw, v.quality); ok {
+			args := append([]string(nil), d.img.Args...)
+			args[3] = "image/jpeg"
+			img = guacd.NewInstruction(d.img.Opcode, args...)
+			raw = data
+			v.degradedImages++
+		}
+	}
+	ret := make([]guacd.Instruction, 0, len(raw)/viewerBlobMaxLength+3)
+	ret = append(ret, img)
+	for len(raw) > 0 {
+		n := len(raw)
+		if n > viewerBlobMaxLength {
+			n = viewerBlobMaxLength
+		}
+		ret = append(ret, guacd.NewInstruction(guacd.InstructionStreamingBlob,
+			stream, base64.StdEncoding.EncodeToString(raw[:n])))
+		raw = raw[n:]
+	}
+	return append(ret, end)
+}
+
+// encodeOpaqueJpeg 只转换不透明的图片，jpeg 没有 alpha 通道
+func encodeOpaqueJpeg(pngData []byte, quality int) ([]byte, bool) {
+	img, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		return nil, false
+	}
+	if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(pngData) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
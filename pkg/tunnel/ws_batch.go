@@ -0,0 +1,114 @@
+package tunnel
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"lion/pkg/config"
+	"lion/pkg/guacd"
+	"lion/pkg/logger"
+)
+
+/*
+	guacd 发往浏览器的 instruction 合并成一个 websocket frame 发送，
+	遇到 sync、达到最大字节数或者等待时间超过上限时发送
+*/
+
+func newWsBatchWriter(write func(p []byte) error) *wsBatchWriter {
+	cfg := config.GlobalConfig
+	return &wsBatchWriter{
+		maxBytes: cfg.WsBatchMaxBytes,
+		maxDelay: time.Duration(cfg.WsBatchMaxDelay) * time.Millisecond,
+		write:    write,
+	}
+}
+
+type wsBatchWriter struct {
+	lock     sync.Mutex
+	buf      bytes.Buffer
+	maxBytes int
+	maxDelay time.Duration
+
+	timer   *time.Timer
+	pending bool
+	lastErr error
+
+	write func(p []byte) error
+}
+
+func (w *wsBatchWriter) enabled() bool {
+	return w.maxBytes > 0 && w.maxDelay > 0
+}
+
+func (w *wsBatchWriter) WriteInstruction(instruction *guacd.Instruction) error {
+	if !w.enabled() {
+		return w.write([]byte(instruction.String()))
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.lastErr; err != nil {
+		w.lastErr = nil
+		return err
+	}
+	w.buf.WriteString(instruction.String())
+	if instruction.Opcode == guacd.InstructionClientSync || w.buf.Len() >= w.maxBytes {
+		return w.flushLocked()
+	}
+	if !w.pending {
+		w.pending = true
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.maxDelay, w.delayFlush)
+		} else {
+			w.timer.Reset(w.maxDelay)
+		}
+	}
+	return nil
+}
+
+// Flush 发送缓存的 instruction，其他消息发送前需要调用，保证消息顺序
+func (w *wsBatchWriter) Flush() error {
+	if !w.enabled() {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.flushLocked()
+}
+
+// Reset 丢弃缓存的 instruction，web client 断开时调用
+func (w *wsBatchWriter) Reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.pending = false
+	w.lastErr = nil
+	w.buf.Reset()
+}
+
+func (w *wsBatchWriter) delayFlush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.pending {
+		return
+	}
+	if err := w.flushLocked(); err != nil {
+		logger.Debugf("Batch flush websocket message err: %+v", err)
+		w.lastErr = err
+	}
+}
+
+func (w *wsBatchWriter) flushLocked() error {
+	if w.pending && w.timer != nil {
+		w.timer.Stop()
+	}
+	w.pending = false
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	err := w.write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
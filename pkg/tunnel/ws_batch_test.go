@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"lion/pkg/guacd"
+)
+
+// 模拟 RDP 画面更新：若干图片块 + sync
+func benchmarkFrameInstructions() []guacd.Instruction {
+	data := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("lion-image-data", 64)))
+	ret := make([]guacd.Instruction, 0, 64)
+	for i := 0; i < 20; i++ {
+		index := strconv.Itoa(i)
+		ret = append(ret,
+			guacd.NewInstruction("img", index, "14", "0", "image/png", index, index),
+			guacd.NewInstruction("blob", index, data),
+			guacd.NewInstruction("end", index),
+		)
+	}
+	ret = append(ret, guacd.NewInstruction(guacd.InstructionClientSync, "1700000000000"))
+	return ret
+}
+
+func newBenchmarkWsConn(b *testing.B, compression bool) (*websocket.Conn, func()) {
+	upgrader := websocket.Upgrader{EnableCompression: compression}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			if _, _, err = ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	dialer := websocket.Dialer{EnableCompression: compression}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		b.Fatal(err)
+	}
+	return ws, func() {
+		_ = ws.Close()
+		server.Close()
+	}
+}
+
+func benchmarkWsWrite(b *testing.B, maxBytes int, compression bool) {
+	var frames int64
+	ws, closeFn := newBenchmarkWsConn(b, compression)
+	defer closeFn()
+	batch := &wsBatchWriter{
+		maxBytes: maxBytes,
+		maxDelay: 10 * time.Millisecond,
+		write: func(p []byte) error {
+			frames++
+			return ws.WriteMessage(websocket.TextMessage, p)
+		},
+	}
+	instructions := benchmarkFrameInstructions()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range instructions {
+			if err := batch.WriteInstruction(&instructions[j]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	_ = batch.Flush()
+	b.StopTimer()
+	b.ReportMetric(float64(frames)/float64(b.N), "frames/op")
+}
+
+func BenchmarkWsWriteUnbatched(b *testing.B) {
+	benchmarkWsWrite(b, 0, false)
+}
+
+func BenchmarkWsWriteBatched(b *testing.B) {
+	benchmarkWsWrite(b, 64*1024, false)
+}
+
+func BenchmarkWsWriteBatchedCompression(b *testing.B) {
+	benchmarkWsWrite(b, 64*1024, true)
+}
+
+func TestWsBatchWriter(t *testing.T) {
+	var frames []string
+	batch := &wsBatchWriter{
+		maxBytes: 1024,
+		maxDelay: 20 * time.Millisecond,
+		write: func(p []byte) error {
+			frames = append(frames, string(p))
+			return nil
+		},
+	}
+	key := guacd.NewInstruction("size", "0", "1024", "768")
+	sync := guacd.NewInstruction(guacd.InstructionClientSync, "1")
+	_ = batch.WriteInstruction(&key)
+	_ = batch.WriteInstruction(&key)
+	_ = batch.WriteInstruction(&sync)
+	if len(frames) != 1 || frames[0] != key.String()+key.String()+sync.String() {
+		t.Fatalf("sync should flush batch: %v", frames)
+	}
+	_ = batch.WriteInstruction(&key)
+	batch.lock.Lock()
+	pending := batch.buf.Len()
+	batch.lock.Unlock()
+	if pending == 0 {
+		t.Fatal("instruction should be buffered")
+	}
+	time.Sleep(100 * time.Millisecond)
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	if len(frames) != 2 || frames[1] != key.String() {
+		t.Fatalf("delay should flush batch: %v", frames)
+	}
+}
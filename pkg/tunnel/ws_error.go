@@ -70,4 +70,14 @@ var (
 	ErrPermission = NewJMSGuacamoleError(256, "No permission")
 
 	ErrDisconnect = NewJMSGuacamoleError(1009, "Disconnect by client")
+
+	ErrReattachFailed = NewJMSGuacamoleError(1012, "Reattach session failed")
+
+	ErrViewerTooSlow = NewJMSGuacamoleError(1013, "Disconnect by slow network")
+
+	ErrReplayRecordFailed = NewJMSGuacamoleError(1014, "Terminated by replay recording failed")
+
+	ErrShareDenied = NewJMSGuacamoleError(1015, "Share join denied")
+
+	ErrShareApprovalTimeout = NewJMSGuacamoleError(1016, "Share join approval timeout")
 )